@@ -0,0 +1,160 @@
+package entities
+
+import (
+	"encoding/json"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+func UnmarshalCivitai(data []byte) (Civitai, error) {
+	var r Civitai
+	err := json.Unmarshal(data, &r)
+	return r, err
+}
+
+func (r *Civitai) Marshal() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+// Civitai is the generation data of an image on Civitai, either the "meta" of the images API
+// or the resources written by the Civitai generator as "Civitai resources: [...]" in the infotext.
+type Civitai struct {
+	Prompt            string            `json:"prompt"`
+	NegativePrompt    string            `json:"negativePrompt"`
+	CFGScale          float64           `json:"cfgScale"`
+	Steps             int64             `json:"steps"`
+	Sampler           string            `json:"sampler"`
+	Seed              int64             `json:"seed"`
+	Size              string            `json:"Size"` // e.g. "832x1216"
+	ClipSkip          float64           `json:"clipSkip"`
+	Model             string            `json:"Model,omitempty"`
+	ModelHash         string            `json:"Model hash,omitempty"`
+	DenoisingStrength float64           `json:"Denoising strength,omitempty"`
+	HiresUpscale      float64           `json:"Hires upscale,omitempty"`
+	HiresUpscaler     string            `json:"Hires upscaler,omitempty"`
+	HiresSteps        int64             `json:"Hires steps,omitempty"`
+	CreatedDate       string            `json:"Created Date,omitempty"`
+	Hashes            map[string]string `json:"hashes,omitempty"` // e.g. {"model": "...", "lora:name": "..."}
+	Resources         []CivitaiResource `json:"resources,omitempty"`
+	CivitaiResources  []CivitaiResource `json:"civitaiResources,omitempty"`
+}
+
+// CivitaiResource is a model used for the image.
+// Resources from the images API have a name and hash, while the generator only writes the model version ID.
+type CivitaiResource struct {
+	Type             string   `json:"type"` // e.g. "checkpoint", "lora", "embed"
+	Name             string   `json:"name,omitempty"`
+	Hash             string   `json:"hash,omitempty"`
+	Weight           *float64 `json:"weight,omitempty"`
+	ModelVersionID   int64    `json:"modelVersionId,omitempty"`
+	ModelName        string   `json:"modelName,omitempty"`
+	ModelVersionName string   `json:"modelVersionName,omitempty"`
+}
+
+// ModelVersionIDs returns the Civitai model version IDs of every resource, in order.
+func (r *Civitai) ModelVersionIDs() []int64 {
+	var ids []int64
+	for _, resource := range slices.Concat(r.Resources, r.CivitaiResources) {
+		if resource.ModelVersionID > 0 {
+			ids = append(ids, resource.ModelVersionID)
+		}
+	}
+	return ids
+}
+
+// Convert converts a Civitai instance into a TextToImageRequest.
+// LoRA and embedding hashes are kept in LoraHashes and TIHashes,
+// and the model version IDs are kept in Comments as "civitai_model_version_ids".
+func (r *Civitai) Convert() *TextToImageRequest {
+	if r == nil {
+		return nil
+	}
+
+	var config Config
+	config.CLIPStopAtLastLayers = r.ClipSkip
+	if r.Model != "" {
+		config.SDModelCheckpoint = &r.Model
+	}
+	config.SDCheckpointHash = r.ModelHash
+
+	request := &TextToImageRequest{
+		Prompt:            r.Prompt,
+		NegativePrompt:    r.NegativePrompt,
+		CFGScale:          r.CFGScale,
+		Steps:             int(r.Steps),
+		SamplerName:       r.Sampler,
+		Seed:              r.Seed,
+		DenoisingStrength: r.DenoisingStrength,
+		OverrideSettings:  config,
+	}
+
+	if width, height, ok := strings.Cut(r.Size, "x"); ok {
+		request.Width, _ = strconv.Atoi(width)
+		request.Height, _ = strconv.Atoi(height)
+	}
+
+	if r.HiresUpscale > 0 || r.HiresUpscaler != "" {
+		request.EnableHr = true
+		request.HrScale = r.HiresUpscale
+		request.HrUpscaler = r.HiresUpscaler
+		request.HrSecondPassSteps = r.HiresSteps
+	}
+
+	for key, hash := range r.Hashes {
+		kind, name, ok := strings.Cut(key, ":")
+		switch {
+		case key == "model":
+			if request.OverrideSettings.SDCheckpointHash == "" {
+				request.OverrideSettings.SDCheckpointHash = hash
+			}
+		case ok && kind == "lora":
+			if request.LoraHashes == nil {
+				request.LoraHashes = make(map[string]string)
+			}
+			request.LoraHashes[hash] = name
+		case ok && kind == "embed":
+			if request.TIHashes == nil {
+				request.TIHashes = make(map[string]string)
+			}
+			request.TIHashes[name] = hash
+		}
+	}
+
+	for _, resource := range r.Resources {
+		if resource.Hash == "" || resource.Name == "" {
+			continue
+		}
+		switch resource.Type {
+		case "lora", "lycoris", "locon":
+			if request.LoraHashes == nil {
+				request.LoraHashes = make(map[string]string)
+			}
+			request.LoraHashes[resource.Hash] = resource.Name
+		case "embed", "embedding", "textualinversion":
+			if request.TIHashes == nil {
+				request.TIHashes = make(map[string]string)
+			}
+			request.TIHashes[resource.Name] = resource.Hash
+		}
+	}
+
+	if ids := r.ModelVersionIDs(); len(ids) > 0 {
+		s := make([]string, len(ids))
+		for i, id := range ids {
+			s[i] = strconv.FormatInt(id, 10)
+		}
+		request.Comments = map[string]string{
+			"civitai_model_version_ids": strings.Join(s, ","),
+		}
+	}
+
+	if r.CreatedDate != "" {
+		if request.Comments == nil {
+			request.Comments = make(map[string]string)
+		}
+		request.Comments["created_date"] = r.CreatedDate
+	}
+
+	return request
+}
@@ -266,4 +266,11 @@ type Config struct {
 	// [For reproducing old seeds]: https://github.com/AUTOMATIC1111/stable-diffusion-webui/wiki/Seed-breaking-changes#180-dev-170-225-2024-01-01---zero-terminal-snr-noise-schedule-option
 	// [2024-01-01]: https://github.com/AUTOMATIC1111/stable-diffusion-webui/pull/14145
 	DowncastAlphasCumprodToFP16 bool `json:"use_downcasted_alpha_bar,omitempty"`
+	// Emphasis mode for prompt attention since 1.8.0, e.g. "Original", "No norm", "Ignore" or "None".
+	// Infotext without an Emphasis key is assumed "Original" when the prompt uses weights.
+	Emphasis string `json:"emphasis,omitempty"`
+	// PadCondUncondV0 is the "Pad conds v0" backwards compatibility option for DDIM and PLMS before 1.6.0.
+	PadCondUncondV0 bool `json:"pad_cond_uncond_v0,omitempty"`
+	// RefinerSwitchBySampleSteps is the "Refiner switch by sampling steps" backwards compatibility option before 1.8.0.
+	RefinerSwitchBySampleSteps bool `json:"refiner_switch_by_sample_steps,omitempty"`
 }
@@ -33,6 +33,11 @@ const (
 	ResizeModeJustResize ResizeMode = "Just Resize"
 	ResizeModeScaleToFit ResizeMode = "Scale to Fit (Inner Fit)"
 	ResizeModeEnvelope   ResizeMode = "Envelope (Outer Fit)"
+
+	// ResizeModeCropAndResize is how the infotext writes ResizeModeScaleToFit
+	ResizeModeCropAndResize ResizeMode = "Crop and Resize"
+	// ResizeModeResizeAndFill is how the infotext writes ResizeModeEnvelope
+	ResizeModeResizeAndFill ResizeMode = "Resize and Fill"
 )
 
 type ControlNet struct {
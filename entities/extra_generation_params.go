@@ -0,0 +1,112 @@
+package entities
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// ExtraGenerationParams is Info.ExtraGenerationParams returned by the webui.
+// The keys are the same as the ones written to the infotext, e.g. "Lora hashes" or "Hires upscale".
+// Keys starting with "ADetailer " are kept in ADetailer, as they are suffixed per unit ("ADetailer model 2nd").
+// Everything else that isn't typed here is kept in Extra.
+type ExtraGenerationParams struct {
+	LoraHashes            string  `json:"Lora hashes,omitempty"`
+	TIHashes              string  `json:"TI hashes,omitempty"`
+	ScheduleType          string  `json:"Schedule type,omitempty"`
+	Emphasis              string  `json:"Emphasis,omitempty"`
+	RNG                   string  `json:"RNG,omitempty"`
+	DowncastAlphasCumprod bool    `json:"Downcast alphas_cumprod,omitempty"`
+	HiresUpscale          float64 `json:"Hires upscale,omitempty"`
+	HiresSteps            int     `json:"Hires steps,omitempty"`
+	HiresUpscaler         string  `json:"Hires upscaler,omitempty"`
+	HiresResize           string  `json:"Hires resize,omitempty"` // e.g. "1024x1536"
+	HiresSampler          string  `json:"Hires sampler,omitempty"`
+	HiresScheduleType     string  `json:"Hires schedule type,omitempty"`
+	HiresCheckpoint       string  `json:"Hires checkpoint,omitempty"`
+	HiresPrompt           string  `json:"Hires prompt,omitempty"`
+	HiresNegativePrompt   string  `json:"Hires negative prompt,omitempty"`
+	HiresCFGScale         float64 `json:"Hires CFG Scale,omitempty"`
+	Refiner               string  `json:"Refiner,omitempty"`
+	RefinerSwitchAt       float64 `json:"Refiner switch at,omitempty"`
+
+	ADetailer map[string]any `json:"-"`
+	Extra     map[string]any `json:"-"`
+}
+
+// fields maps the webui keys to the typed fields of ExtraGenerationParams.
+func (p *ExtraGenerationParams) fields() map[string]any {
+	fields := make(map[string]any)
+	v := reflect.ValueOf(p).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		tag := v.Type().Field(i).Tag.Get("json")
+		key := strings.Split(tag, ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		fields[key] = v.Field(i).Addr().Interface()
+	}
+	return fields
+}
+
+func (p *ExtraGenerationParams) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	fields := p.fields()
+	for key, value := range raw {
+		if field, ok := fields[key]; ok {
+			// keep values an extension wrote with an unexpected type instead of failing the whole response
+			if err := json.Unmarshal(value, field); err == nil {
+				continue
+			}
+		}
+
+		var v any
+		if err := json.Unmarshal(value, &v); err != nil {
+			return err
+		}
+
+		if strings.HasPrefix(key, "ADetailer ") {
+			if p.ADetailer == nil {
+				p.ADetailer = make(map[string]any)
+			}
+			p.ADetailer[key] = v
+			continue
+		}
+
+		if p.Extra == nil {
+			p.Extra = make(map[string]any)
+		}
+		p.Extra[key] = v
+	}
+	return nil
+}
+
+func (p ExtraGenerationParams) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.Map())
+}
+
+// Map returns every key as the webui wrote it, including ADetailer and Extra.
+func (p *ExtraGenerationParams) Map() map[string]any {
+	if p == nil {
+		return nil
+	}
+	out := make(map[string]any, len(p.ADetailer)+len(p.Extra))
+	for k, v := range p.Extra {
+		out[k] = v
+	}
+	for k, v := range p.ADetailer {
+		out[k] = v
+	}
+	for k, field := range p.fields() {
+		v := reflect.ValueOf(field).Elem()
+		if v.IsZero() {
+			continue
+		}
+		out[k] = v.Interface()
+	}
+	return out
+}
@@ -0,0 +1,216 @@
+package entities
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+func UnmarshalFooocus(data []byte) (Fooocus, error) {
+	var r Fooocus
+	err := json.Unmarshal(data, &r)
+	return r, err
+}
+
+func (r *Fooocus) Marshal() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+// Fooocus is the metadata written by Fooocus with the "fooocus" metadata scheme, or the rows in log.html.
+// Numbers are json.Number because log.html and older versions write them as strings.
+type Fooocus struct {
+	Prompt             string        `json:"prompt"`
+	NegativePrompt     string        `json:"negative_prompt"`
+	FullPrompt         []string      `json:"full_prompt,omitempty"`
+	FullNegativePrompt []string      `json:"full_negative_prompt,omitempty"`
+	Styles             FooocusList   `json:"styles"`
+	Performance        string        `json:"performance"`
+	Resolution         FooocusList   `json:"resolution"` // e.g. "(1024, 1024)"
+	GuidanceScale      json.Number   `json:"guidance_scale"`
+	Sharpness          json.Number   `json:"sharpness"`
+	ADMGuidance        string        `json:"adm_guidance"`
+	BaseModel          string        `json:"base_model"`
+	BaseModelHash      string        `json:"base_model_hash"`
+	RefinerModel       string        `json:"refiner_model"`
+	RefinerSwitch      json.Number   `json:"refiner_switch"`
+	Sampler            string        `json:"sampler"`
+	Scheduler          string        `json:"scheduler"`
+	Seed               json.Number   `json:"seed"`
+	Steps              json.Number   `json:"steps"`
+	ClipSkip           json.Number   `json:"clip_skip"`
+	Vae                string        `json:"vae"`
+	Loras              []FooocusLora `json:"loras"`
+	MetadataScheme     string        `json:"metadata_scheme"`
+	Version            string        `json:"version"` // e.g. "Fooocus v2.4.3"
+}
+
+// FooocusList is a list that Fooocus sometimes writes as a python literal, e.g. "['Fooocus V2', 'Fooocus Sharp']" or "(1024, 1024)".
+type FooocusList []string
+
+func (l *FooocusList) UnmarshalJSON(data []byte) error {
+	var list []any
+	if err := json.Unmarshal(data, &list); err == nil {
+		for _, v := range list {
+			*l = append(*l, fmt.Sprint(v))
+		}
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	s = strings.Trim(strings.TrimSpace(s), "[]()")
+	for _, v := range strings.Split(s, ",") {
+		v = strings.Trim(strings.TrimSpace(v), `'"`)
+		if v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// FooocusLora is written as [name, weight, hash] in the metadata, or as "name : weight" in log.html.
+type FooocusLora struct {
+	Name   string
+	Weight float64
+	Hash   string
+}
+
+func (l *FooocusLora) UnmarshalJSON(data []byte) error {
+	var a []any
+	if err := json.Unmarshal(data, &a); err != nil {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		name, weight, _ := strings.Cut(s, " : ")
+		l.Name = strings.TrimSpace(name)
+		l.Weight, _ = strconv.ParseFloat(strings.TrimSpace(weight), 64)
+		return nil
+	}
+	for i, v := range a {
+		switch i {
+		case 0:
+			l.Name = fmt.Sprint(v)
+		case 1:
+			switch w := v.(type) {
+			case float64:
+				l.Weight = w
+			case string:
+				l.Weight, _ = strconv.ParseFloat(w, 64)
+			}
+		case 2:
+			l.Hash = fmt.Sprint(v)
+		}
+	}
+	return nil
+}
+
+func (l FooocusLora) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]any{l.Name, l.Weight, l.Hash})
+}
+
+var fooocusLogRow = regexp.MustCompile(`(?s)<td class=['"]key['"]>(.*?)</td>\s*<td class=['"]value['"]>(.*?)</td>`)
+
+// UnmarshalFooocusLog reads the first image of a Fooocus log.html.
+// The rows use readable keys such as "Guidance Scale" and "LoRA 1", which are mapped to the metadata keys.
+func UnmarshalFooocusLog(data []byte) (Fooocus, error) {
+	var (
+		row   = make(map[string]any)
+		loras []string
+	)
+	for _, match := range fooocusLogRow.FindAllSubmatch(data, -1) {
+		key := html.UnescapeString(strings.TrimSpace(string(match[1])))
+		value := html.UnescapeString(strings.TrimSpace(string(match[2])))
+		key = strings.ToLower(strings.ReplaceAll(key, " ", "_"))
+		if _, seen := row[key]; seen {
+			// the next image in the log starts here
+			break
+		}
+		if value == "" {
+			continue
+		}
+		if strings.HasPrefix(key, "lora_") {
+			loras = append(loras, value)
+			continue
+		}
+		row[key] = value
+	}
+	if len(row) == 0 {
+		return Fooocus{}, fmt.Errorf("no fooocus log rows found")
+	}
+	row["loras"] = loras
+
+	b, err := json.Marshal(row)
+	if err != nil {
+		return Fooocus{}, err
+	}
+	return UnmarshalFooocus(b)
+}
+
+// Convert converts a Fooocus instance into a TextToImageRequest.
+// Styles are kept in Styles, and LoRAs are appended to the prompt like ComfyUI.
+func (r *Fooocus) Convert() *TextToImageRequest {
+	if r == nil {
+		return nil
+	}
+	var prompt strings.Builder
+	prompt.WriteString(r.Prompt)
+	for _, lora := range r.Loras {
+		if lora.Name == "" || lora.Name == "None" {
+			continue
+		}
+		prompt.WriteString(fmt.Sprintf("<lora:%s:%.2f>", lora.Name, lora.Weight))
+	}
+
+	request := &TextToImageRequest{
+		Prompt:         prompt.String(),
+		NegativePrompt: r.NegativePrompt,
+		Styles:         r.Styles,
+		SamplerName:    r.Sampler,
+		Comments: map[string]string{
+			"performance":  r.Performance,
+			"sharpness":    r.Sharpness.String(),
+			"adm_guidance": r.ADMGuidance,
+			"version":      r.Version,
+		},
+	}
+
+	if len(r.Resolution) == 2 {
+		request.Width, _ = strconv.Atoi(r.Resolution[0])
+		request.Height, _ = strconv.Atoi(r.Resolution[1])
+	}
+	if steps, err := r.Steps.Int64(); err == nil {
+		request.Steps = int(steps)
+	}
+	if seed, err := r.Seed.Int64(); err == nil {
+		request.Seed = seed
+	}
+	if cfg, err := r.GuidanceScale.Float64(); err == nil {
+		request.CFGScale = cfg
+	}
+	if clipSkip, err := r.ClipSkip.Float64(); err == nil {
+		request.OverrideSettings.CLIPStopAtLastLayers = clipSkip
+	}
+	if r.Scheduler != "" {
+		request.Scheduler = &r.Scheduler
+	}
+	if r.BaseModel != "" {
+		request.OverrideSettings.SDModelCheckpoint = &r.BaseModel
+		request.OverrideSettings.SDCheckpointHash = r.BaseModelHash
+	}
+	if r.Vae != "" && !strings.HasPrefix(r.Vae, "Default") {
+		request.OverrideSettings.SDVae = &r.Vae
+	}
+	if r.RefinerModel != "" && r.RefinerModel != "None" {
+		request.RefinerCheckpoint = &r.RefinerModel
+		if switchAt, err := r.RefinerSwitch.Float64(); err == nil {
+			request.RefinerSwitchAt = &switchAt
+		}
+	}
+
+	return request
+}
@@ -1,6 +1,9 @@
 package entities
 
-import "encoding/json"
+import (
+	"bytes"
+	"encoding/json"
+)
 
 type Loras []Lora
 
@@ -41,6 +44,69 @@ type Metadata struct {
 	SsNewVaeHash *SsNewVaeHash `json:"ss_new_vae_hash,omitempty"`
 	SsVaeHash    *SsVaeHash    `json:"ss_vae_hash,omitempty"`
 	SsVaeName    *string       `json:"ss_vae_name,omitempty"`
+
+	// The training parameters written by kohya-ss. The numbers are kept as strings, as they are in the safetensors header.
+	SsOutputName         *string `json:"ss_output_name,omitempty"`
+	SsBaseModelVersion   *string `json:"ss_base_model_version,omitempty"`
+	SsV2                 *string `json:"ss_v2,omitempty"`
+	SsNetworkModule      *string `json:"ss_network_module,omitempty"`
+	SsNetworkDim         *string `json:"ss_network_dim,omitempty"`
+	SsNetworkAlpha       *string `json:"ss_network_alpha,omitempty"`
+	SsResolution         *string `json:"ss_resolution,omitempty"`
+	SsNumTrainImages     *string `json:"ss_num_train_images,omitempty"`
+	SsNumEpochs          *string `json:"ss_num_epochs,omitempty"`
+	SsEpoch              *string `json:"ss_epoch,omitempty"`
+	SsSteps              *string `json:"ss_steps,omitempty"`
+	SsMaxTrainSteps      *string `json:"ss_max_train_steps,omitempty"`
+	SsLearningRate       *string `json:"ss_learning_rate,omitempty"`
+	SsUnetLR             *string `json:"ss_unet_lr,omitempty"`
+	SsTextEncoderLR      *string `json:"ss_text_encoder_lr,omitempty"`
+	SsLRScheduler        *string `json:"ss_lr_scheduler,omitempty"`
+	SsOptimizer          *string `json:"ss_optimizer,omitempty"`
+	SsSeed               *string `json:"ss_seed,omitempty"`
+	SsTrainingComment    *string `json:"ss_training_comment,omitempty"`
+	SsTrainingStartedAt  *string `json:"ss_training_started_at,omitempty"`
+	SsTrainingFinishedAt *string `json:"ss_training_finished_at,omitempty"`
+	SsSessionID          *string `json:"ss_session_id,omitempty"`
+
+	SsTagFrequency TagFrequency `json:"ss_tag_frequency,omitempty"`
+	SsDatasetDirs  DatasetDirs  `json:"ss_dataset_dirs,omitempty"`
+}
+
+// TagFrequency is the count of each tag of the captions, by dataset directory.
+// In the safetensors header it's JSON written as a string, while the WebUI returns it as an object. Both are accepted.
+type TagFrequency map[string]map[string]int
+
+func (t *TagFrequency) UnmarshalJSON(data []byte) error {
+	return unmarshalJSONString(data, (*map[string]map[string]int)(t))
+}
+
+// DatasetDirs are the dataset directories used for training. Like TagFrequency, it can be JSON written as a string.
+type DatasetDirs map[string]DatasetDir
+
+type DatasetDir struct {
+	NRepeats int `json:"n_repeats"`
+	ImgCount int `json:"img_count"`
+}
+
+func (d *DatasetDirs) UnmarshalJSON(data []byte) error {
+	return unmarshalJSONString(data, (*map[string]DatasetDir)(d))
+}
+
+// unmarshalJSONString unmarshals the JSON into v, or the JSON inside of it if it's a string.
+// An empty string or "None" leaves v as is.
+func unmarshalJSONString(data []byte, v any) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte(`"`)) {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		if s == "" || s == "None" {
+			return nil
+		}
+		data = []byte(s)
+	}
+	return json.Unmarshal(data, v)
 }
 
 type SsMixedPrecision string
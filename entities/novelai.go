@@ -0,0 +1,255 @@
+package entities
+
+import (
+	"encoding/json"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+func UnmarshalNovelAI(data []byte) (NovelAI, error) {
+	var r NovelAI
+	err := json.Unmarshal(data, &r)
+	return r, err
+}
+
+func (r *NovelAI) Marshal() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+// NovelAIFromChunks builds a NovelAI from the PNG text chunks of an image, e.g. a utils.PNGChunk.
+// The Comment chunk is the JSON string with the generation parameters.
+func NovelAIFromChunks(chunks map[string]string) (NovelAI, error) {
+	r := NovelAI{
+		Title:          chunks["Title"],
+		Description:    chunks["Description"],
+		Software:       chunks["Software"],
+		Source:         chunks["Source"],
+		GenerationTime: chunks["Generation time"],
+	}
+	if comment, ok := chunks["Comment"]; ok {
+		if err := json.Unmarshal([]byte(comment), &r.Comment); err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
+// NovelAI is the metadata embedded by NovelAI in the PNG text chunks.
+// Software is always "NovelAI", and Comment holds the JSON parameters.
+type NovelAI struct {
+	Title          string         `json:"Title,omitempty"`
+	Description    string         `json:"Description,omitempty"`
+	Software       string         `json:"Software,omitempty"`
+	Source         string         `json:"Source,omitempty"` // e.g. "NovelAI Diffusion V3 7BCCAA2C"
+	GenerationTime string         `json:"Generation time,omitempty"`
+	Comment        NovelAIComment `json:"Comment"`
+}
+
+type NovelAIComment struct {
+	Prompt              string   `json:"prompt"`
+	Steps               int64    `json:"steps"`
+	Height              int64    `json:"height"`
+	Width               int64    `json:"width"`
+	Scale               float64  `json:"scale"`
+	UncondScale         float64  `json:"uncond_scale"`
+	CFGRescale          float64  `json:"cfg_rescale"`
+	Seed                int64    `json:"seed"`
+	NSamples            int64    `json:"n_samples"`
+	NoiseSchedule       string   `json:"noise_schedule"`
+	Sampler             string   `json:"sampler"`
+	SM                  bool     `json:"sm"`
+	SMDyn               bool     `json:"sm_dyn"`
+	DynamicThresholding bool     `json:"dynamic_thresholding"`
+	Strength            *float64 `json:"strength,omitempty"` // only present for img2img
+	Noise               *float64 `json:"noise,omitempty"`
+	UC                  string   `json:"uc"`
+	RequestType         string   `json:"request_type"`
+	SignedHash          string   `json:"signed_hash,omitempty"`
+}
+
+// UnmarshalJSON accepts the Comment either as an object or as the JSON string stored in the PNG chunk.
+func (c *NovelAIComment) UnmarshalJSON(data []byte) error {
+	type comment NovelAIComment
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		data = []byte(s)
+	}
+	return json.Unmarshal(data, (*comment)(c))
+}
+
+// novelAISamplers maps the NovelAI sampler names to the webui
+var novelAISamplers = map[string]string{
+	"k_euler":              "Euler",
+	"k_euler_ancestral":    "Euler a",
+	"k_heun":               "Heun",
+	"k_lms":                "LMS",
+	"k_dpm_2":              "DPM2",
+	"k_dpm_2_ancestral":    "DPM2 a",
+	"k_dpmpp_2s_ancestral": "DPM++ 2S a",
+	"k_dpmpp_2m":           "DPM++ 2M",
+	"k_dpmpp_sde":          "DPM++ SDE",
+	"k_dpmpp_2m_sde":       "DPM++ 2M SDE",
+	"k_dpm_fast":           "DPM fast",
+	"k_dpm_adaptive":       "DPM adaptive",
+	"ddim":                 "DDIM",
+	"ddim_v3":              "DDIM",
+	"plms":                 "PLMS",
+}
+
+// novelAISchedules maps the NovelAI noise_schedule to the webui schedule type
+var novelAISchedules = map[string]string{
+	"native":          "Automatic",
+	"karras":          "Karras",
+	"exponential":     "Exponential",
+	"polyexponential": "Polyexponential",
+}
+
+// Convert converts a NovelAI instance into a TextToImageRequest.
+// The {} and [] emphasis in the prompt is translated into webui weights using NovelAIPrompt.
+// Source names the NovelAI model rather than a checkpoint, so it is kept in Comments["source"].
+func (r *NovelAI) Convert() *TextToImageRequest {
+	if r == nil {
+		return nil
+	}
+	c := r.Comment
+	prompt := c.Prompt
+	if prompt == "" {
+		prompt = r.Description
+	}
+
+	sampler, ok := novelAISamplers[c.Sampler]
+	if !ok {
+		sampler = c.Sampler
+	}
+
+	var scheduler *string
+	if schedule, ok := novelAISchedules[c.NoiseSchedule]; ok {
+		scheduler = &schedule
+	}
+
+	request := &TextToImageRequest{
+		Prompt:         NovelAIPrompt(prompt),
+		NegativePrompt: NovelAIPrompt(c.UC),
+		Steps:          int(c.Steps),
+		CFGScale:       c.Scale,
+		Seed:           c.Seed,
+		Width:          int(c.Width),
+		Height:         int(c.Height),
+		BatchSize:      int(c.NSamples),
+		SamplerName:    sampler,
+		Scheduler:      scheduler,
+		Comments: map[string]string{
+			"software":       r.Software,
+			"source":         r.Source,
+			"noise_schedule": c.NoiseSchedule,
+			"sm":             strconv.FormatBool(c.SM),
+			"sm_dyn":         strconv.FormatBool(c.SMDyn),
+			"request_type":   c.RequestType,
+		},
+	}
+
+	if c.Strength != nil {
+		request.DenoisingStrength = *c.Strength
+	}
+
+	if c.CFGRescale > 0 {
+		request.CFGRescale = &CFGRescale{Args: CFGRescaleParameters{CfgRescale: c.CFGRescale}}
+	}
+
+	return request
+}
+
+const novelAIEmphasis = 1.05
+
+// novelAIWeight matches the start of the numeric emphasis added in V4, e.g. "1.5::text::"
+var novelAIWeight = regexp.MustCompile(`^(-?\d+(?:\.\d+)?)::`)
+
+// NovelAIPrompt translates NovelAI emphasis into webui weights.
+// Each {} multiplies the weight by 1.05 and each [] divides it by 1.05.
+// The numeric "1.5::text::" emphasis multiplies the weight of the text.
+// Parentheses are literal in NovelAI, so they are escaped.
+//
+//	"{{cat}}, [dog], (bird)" -> "(cat:1.1025), (dog:0.9524), \(bird\)"
+func NovelAIPrompt(prompt string) string {
+	type segment struct {
+		text   strings.Builder
+		weight float64
+	}
+
+	var (
+		segments    []*segment
+		depth       int
+		multipliers []float64
+	)
+
+	weight := func() float64 {
+		w := math.Pow(novelAIEmphasis, float64(depth))
+		for _, m := range multipliers {
+			w *= m
+		}
+		return math.Round(w*10000) / 10000
+	}
+
+	write := func(s string) {
+		w := weight()
+		if len(segments) == 0 || segments[len(segments)-1].weight != w {
+			segments = append(segments, &segment{weight: w})
+		}
+		segments[len(segments)-1].text.WriteString(s)
+	}
+
+	for i := 0; i < len(prompt); i++ {
+		switch c := prompt[i]; {
+		case c == '{':
+			depth++
+		case c == '}':
+			depth--
+		case c == '[':
+			depth--
+		case c == ']':
+			depth++
+		case c == '(' || c == ')':
+			write(`\` + string(c))
+		case strings.HasPrefix(prompt[i:], "::") && len(multipliers) > 0:
+			multipliers = multipliers[:len(multipliers)-1]
+			i++
+		case (isDigit(c) || c == '-') && (i == 0 || !isDigit(prompt[i-1])) && novelAIWeight.MatchString(prompt[i:]):
+			match := novelAIWeight.FindStringSubmatch(prompt[i:])
+			m, _ := strconv.ParseFloat(match[1], 64)
+			multipliers = append(multipliers, m)
+			i += len(match[0]) - 1
+		default:
+			write(prompt[i : i+1])
+		}
+	}
+
+	var out strings.Builder
+	for _, s := range segments {
+		text := s.text.String()
+		if s.weight == 1 {
+			out.WriteString(text)
+			continue
+		}
+		// keep the surrounding separators outside the parentheses
+		trimmed := strings.TrimLeft(text, ", ")
+		out.WriteString(text[:len(text)-len(trimmed)])
+		inner := strings.TrimRight(trimmed, ", ")
+		if inner == "" {
+			out.WriteString(trimmed)
+			continue
+		}
+		out.WriteString("(")
+		out.WriteString(inner)
+		out.WriteString(":")
+		out.WriteString(strconv.FormatFloat(s.weight, 'f', -1, 64))
+		out.WriteString(")")
+		out.WriteString(trimmed[len(inner):])
+	}
+	return out.String()
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
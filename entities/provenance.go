@@ -0,0 +1,49 @@
+package entities
+
+// Source is where the value of a field was found.
+type Source string
+
+const (
+	SourceInfotext Source = "infotext" // Key is the infotext key, e.g. "Seed"
+	SourceRegex    Source = "regex"    // Key is the name of the pattern, e.g. "seed" or "stepsAlt"
+	SourceJSON     Source = "json"     // Key is the JSON path the field was converted from, e.g. "$.seed"
+	SourceComfyUI  Source = "comfyui"  // Key is the node ID
+	SourceLLM      Source = "llm"      // Key is the model that inferred it
+	SourceDefault  Source = "default"  // Key is the infotext key that was missing and filled in with its default
+)
+
+// Evidence is why a field has its value.
+// Start and End are byte offsets of Text in the parsed input, or -1 when the value wasn't read from a span.
+// Confidence is from 0 to 1, where an explicit infotext key is strong and a regex hit in prose is weak.
+type Evidence struct {
+	Source     Source  `json:"source"`
+	Key        string  `json:"key,omitempty"`
+	Text       string  `json:"text,omitempty"`
+	Start      int     `json:"start"`
+	End        int     `json:"end"`
+	Confidence float64 `json:"confidence"`
+}
+
+// Provenance is the Evidence of each field of a TextToImageRequest, keyed by the JSON path of the field,
+// e.g. "seed" or "override_settings.sd_model_checkpoint".
+type Provenance map[string]Evidence
+
+// Add records the evidence for the field, unless stronger evidence was already recorded.
+func (p Provenance) Add(field string, evidence Evidence) {
+	if existing, ok := p[field]; ok && existing.Confidence >= evidence.Confidence {
+		return
+	}
+	p[field] = evidence
+}
+
+// Merge adds every field of other using Add.
+func (p Provenance) Merge(other Provenance) {
+	for field, evidence := range other {
+		p.Add(field, evidence)
+	}
+}
+
+// Confidence returns the confidence of the field, or 0 if there is no evidence for it.
+func (p Provenance) Confidence(field string) float64 {
+	return p[field].Confidence
+}
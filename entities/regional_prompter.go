@@ -0,0 +1,72 @@
+package entities
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// RegionalPrompterParameters are the positional args of the Regional Prompter extension.
+// The order follows the API section of https://github.com/hako-mikan/sd-webui-regional-prompter
+type RegionalPrompterParameters struct {
+	Active            bool   // RP Active
+	Debug             bool   // not written to the infotext
+	Mode              string // RP Divide mode: "Matrix", "Mask" or "Prompt"
+	MatrixMode        string // RP Matrix submode: "Columns", "Rows", "Horizontal" or "Vertical"
+	MaskMode          string // RP Mask submode
+	PromptMode        string // RP Prompt submode
+	Ratios            string // RP Ratios e.g. "1,1"
+	BaseRatios        string // RP Base Ratios e.g. "0.2"
+	UseBase           bool   // RP Use Base
+	UseCommon         bool   // RP Use Common
+	UseNegCommon      bool   // RP Use Ncommon
+	CalcMode          string // RP Calc Mode: "Attention" or "Latent"
+	NotChangeAND      bool   // RP Change AND
+	LoRATextEncoder   string // RP LoRA Neg Te Ratios
+	LoRAUNet          string // RP LoRA Neg U Ratios
+	Threshold         string // RP threshold
+	Mask              string // path to the polygon mask image
+	LoRAStopStep      int    // RP LoRA Stop Step
+	LoRAHiresStopStep int    // RP LoRA Hires Stop Step
+	Flip              bool   // RP Flip
+}
+
+func (p RegionalPrompterParameters) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.args())
+}
+
+func (p *RegionalPrompterParameters) UnmarshalJSON(data []byte) error {
+	var a []json.RawMessage
+	err := json.Unmarshal(data, &a)
+	if err != nil {
+		return err
+	}
+
+	targets := []any{
+		&p.Active, &p.Debug, &p.Mode, &p.MatrixMode, &p.MaskMode, &p.PromptMode,
+		&p.Ratios, &p.BaseRatios, &p.UseBase, &p.UseCommon, &p.UseNegCommon, &p.CalcMode,
+		&p.NotChangeAND, &p.LoRATextEncoder, &p.LoRAUNet, &p.Threshold, &p.Mask,
+		&p.LoRAStopStep, &p.LoRAHiresStopStep, &p.Flip,
+	}
+	for i, v := range a {
+		if i >= len(targets) {
+			break
+		}
+		if err := json.Unmarshal(v, targets[i]); err != nil {
+			return fmt.Errorf("unexpected type for arg %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (p RegionalPrompterParameters) args() []any {
+	return []any{
+		p.Active, p.Debug, p.Mode, p.MatrixMode, p.MaskMode, p.PromptMode,
+		p.Ratios, p.BaseRatios, p.UseBase, p.UseCommon, p.UseNegCommon, p.CalcMode,
+		p.NotChangeAND, p.LoRATextEncoder, p.LoRAUNet, p.Threshold, p.Mask,
+		p.LoRAStopStep, p.LoRAHiresStopStep, p.Flip,
+	}
+}
+
+type RegionalPrompter struct {
+	Args RegionalPrompterParameters `json:"args,omitempty"`
+}
@@ -1,7 +1,8 @@
 package entities
 
 type Scripts struct {
-	ADetailer  *ADetailer  `json:"ADetailer,omitempty"`
-	ControlNet *ControlNet `json:"ControlNet,omitempty"`
-	CFGRescale *CFGRescale `json:"CFG Rescale Extension,omitempty"`
+	ADetailer        *ADetailer        `json:"ADetailer,omitempty"`
+	ControlNet       *ControlNet       `json:"ControlNet,omitempty"`
+	CFGRescale       *CFGRescale       `json:"CFG Rescale Extension,omitempty"`
+	RegionalPrompter *RegionalPrompter `json:"Regional Prompter,omitempty"`
 }
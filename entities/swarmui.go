@@ -0,0 +1,145 @@
+package entities
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+func UnmarshalSwarmUI(data []byte) (SwarmUI, error) {
+	var r SwarmUI
+	err := json.Unmarshal(data, &r)
+	return r, err
+}
+
+func (r *SwarmUI) Marshal() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+// SwarmUI is the metadata SwarmUI writes in the parameters chunk of an image.
+type SwarmUI struct {
+	ImageParams SwarmUIParams  `json:"sui_image_params"`
+	ExtraData   map[string]any `json:"sui_extra_data,omitempty"`
+	Models      []SwarmUIModel `json:"sui_models,omitempty"`
+}
+
+type SwarmUIParams struct {
+	Prompt                   string          `json:"prompt"`
+	NegativePrompt           string          `json:"negativeprompt"`
+	Model                    string          `json:"model"`
+	Seed                     int64           `json:"seed"`
+	Steps                    int64           `json:"steps"`
+	CFGScale                 float64         `json:"cfgscale"`
+	AspectRatio              string          `json:"aspectratio,omitempty"`
+	Width                    int64           `json:"width"`
+	Height                   int64           `json:"height"`
+	Sampler                  string          `json:"sampler,omitempty"`
+	Scheduler                string          `json:"scheduler,omitempty"`
+	Vae                      string          `json:"vae,omitempty"`
+	ClipStopAtLayer          int64           `json:"clipstopatlayer,omitempty"` // negative, -2 is clip skip 2
+	Loras                    []string        `json:"loras,omitempty"`
+	LoraWeights              []StringOrFloat `json:"loraweights,omitempty"`
+	RefinerModel             string          `json:"refinermodel,omitempty"`
+	RefinerControlPercentage *float64        `json:"refinercontrolpercentage,omitempty"`
+	RefinerUpscale           *float64        `json:"refinerupscale,omitempty"`
+	RefinerSteps             int64           `json:"refinersteps,omitempty"`
+	InitImageCreativity      *float64        `json:"initimagecreativity,omitempty"`
+	SwarmVersion             string          `json:"swarm_version,omitempty"`
+	Date                     string          `json:"date,omitempty"`
+	GenerationTime           string          `json:"generation_time,omitempty"`
+}
+
+type SwarmUIModel struct {
+	Name  string `json:"name"`
+	Param string `json:"param"`
+	Hash  string `json:"hash,omitempty"` // sha256 prefixed with "0x"
+}
+
+// StringOrFloat is a number that may be written as a string, like SwarmUI's loraweights.
+type StringOrFloat float64
+
+func (f *StringOrFloat) UnmarshalJSON(data []byte) error {
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	v, err := n.Float64()
+	*f = StringOrFloat(v)
+	return err
+}
+
+// Convert converts a SwarmUI instance into a TextToImageRequest.
+// LoRAs that aren't already in the prompt are appended to it like ComfyUI.
+// The sampler and scheduler are ComfyUI names, e.g. "dpmpp_2m" and "karras".
+func (r *SwarmUI) Convert() *TextToImageRequest {
+	if r == nil {
+		return nil
+	}
+	p := r.ImageParams
+
+	var prompt strings.Builder
+	prompt.WriteString(p.Prompt)
+	for i, lora := range p.Loras {
+		if strings.Contains(p.Prompt, "<lora:"+lora) {
+			continue
+		}
+		weight := 1.0
+		if i < len(p.LoraWeights) {
+			weight = float64(p.LoraWeights[i])
+		}
+		prompt.WriteString(fmt.Sprintf("<lora:%s:%.2f>", lora, weight))
+	}
+
+	var config Config
+	if p.Model != "" {
+		config.SDModelCheckpoint = &p.Model
+	}
+	if p.Vae != "" {
+		config.SDVae = &p.Vae
+	}
+	if p.ClipStopAtLayer < 0 {
+		config.CLIPStopAtLastLayers = float64(-p.ClipStopAtLayer)
+	}
+	for _, model := range r.Models {
+		if model.Param == "model" {
+			config.SDCheckpointHash = strings.TrimPrefix(model.Hash, "0x")
+		}
+	}
+
+	request := &TextToImageRequest{
+		Prompt:           prompt.String(),
+		NegativePrompt:   p.NegativePrompt,
+		Seed:             p.Seed,
+		Steps:            int(p.Steps),
+		CFGScale:         p.CFGScale,
+		Width:            int(p.Width),
+		Height:           int(p.Height),
+		SamplerName:      p.Sampler,
+		OverrideSettings: config,
+		Comments: map[string]string{
+			"swarm_version":   p.SwarmVersion,
+			"date":            p.Date,
+			"generation_time": p.GenerationTime,
+		},
+	}
+
+	if p.Scheduler != "" {
+		request.Scheduler = &p.Scheduler
+	}
+
+	if p.RefinerModel != "" {
+		request.RefinerCheckpoint = &p.RefinerModel
+		request.RefinerSwitchAt = p.RefinerControlPercentage
+	}
+
+	if p.RefinerUpscale != nil && *p.RefinerUpscale > 1 {
+		request.EnableHr = true
+		request.HrScale = *p.RefinerUpscale
+		request.HrSecondPassSteps = p.RefinerSteps
+		if p.RefinerControlPercentage != nil {
+			request.DenoisingStrength = *p.RefinerControlPercentage
+		}
+	}
+
+	return request
+}
@@ -116,6 +116,8 @@ func UnmarshalTextToImageJSONResponse(data []byte) (TextToImageJSONResponse, err
 	return r, err
 }
 
+// JSONToTextToImageResponse unmarshals the webui response and decodes the stringified Info,
+// including the typed ExtraGenerationParams.
 func JSONToTextToImageResponse(data []byte) (*TextToImageResponse, error) {
 	r, err := UnmarshalTextToImageJSONResponse(data)
 	if err != nil {
@@ -183,7 +185,3 @@ type Info struct {
 	IsUsingInpaintingConditioning *bool                  `json:"is_using_inpainting_conditioning"`
 	Version                       *string                `json:"version"`
 }
-
-type ExtraGenerationParams struct {
-	LoraHashes string `json:"Lora hashes"`
-}
@@ -0,0 +1,210 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"sync"
+	"time"
+)
+
+// ErrBudgetExceeded is the error of the items of a Batch that weren't inferred because the Budget was spent.
+var ErrBudgetExceeded = errors.New("token budget exceeded")
+
+// Batch extracts many descriptions with Extract using a pool of Workers.
+// The tokens of every inference are counted from the Usage of the response, and an inference waits until the tokens
+// of the last minute are below TokensPerMinute. Once the Budget is spent, the remaining items fail with ErrBudgetExceeded.
+// Both limits are checked before an inference, so the requests in flight can go over them.
+// Responses from a Cache don't count towards either limit.
+type Batch struct {
+	Provider        Provider
+	Workers         int                               // defaults to 4
+	MaxAttempts     int                               // of Extract, defaults to 1
+	TokensPerMinute int64                             // zero is unlimited
+	Budget          int64                             // total tokens of a Run, zero is unlimited
+	Request         func(description string) *Request // defaults to DefaultRequest
+}
+
+// BatchResult is the Extraction of the description at Index. Usage is the sum of every attempt.
+type BatchResult struct {
+	Index       int        `json:"index"`
+	Description string     `json:"description"`
+	Extraction  Extraction `json:"extraction"`
+	Usage       Usage      `json:"usage"`
+	Err         error      `json:"-"`
+}
+
+// Run extracts the descriptions and yields the results in the order of the descriptions.
+// An item that fails is yielded with its Err without stopping the batch.
+// When the context is done, the items in flight fail with the context error and no more descriptions are read.
+//
+//	for result := range batch.Run(ctx, slices.Values(descriptions)) {
+//		if result.Err != nil {
+//			log.Printf("error extracting %d: %v", result.Index, result.Err)
+//			continue
+//		}
+//		requests = append(requests, result.Extraction.Request)
+//	}
+func (b *Batch) Run(ctx context.Context, descriptions iter.Seq[string]) iter.Seq[BatchResult] {
+	return func(yield func(BatchResult) bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		var (
+			limiter = &tokenLimiter{perMinute: b.TokensPerMinute, budget: b.Budget, window: time.Minute}
+			jobs    = make(chan BatchResult)
+			results = make(chan BatchResult)
+			wg      sync.WaitGroup
+		)
+		go func() {
+			defer close(jobs)
+			index := 0
+			for description := range descriptions {
+				select {
+				case jobs <- BatchResult{Index: index, Description: description}:
+					index++
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+
+		workers := b.Workers
+		if workers <= 0 {
+			workers = 4
+		}
+		wg.Add(workers)
+		for range workers {
+			go func() {
+				defer wg.Done()
+				for job := range jobs {
+					results <- b.extract(ctx, limiter, job)
+				}
+			}()
+		}
+		go func() {
+			wg.Wait()
+			close(results)
+		}()
+
+		pending := make(map[int]BatchResult)
+		next := 0
+		for result := range results {
+			pending[result.Index] = result
+			for {
+				result, ok := pending[next]
+				if !ok {
+					break
+				}
+				delete(pending, next)
+				next++
+				if !yield(result) {
+					cancel()
+					for range results {
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+func (b *Batch) extract(ctx context.Context, limiter *tokenLimiter, result BatchResult) BatchResult {
+	request := DefaultRequest
+	if b.Request != nil {
+		request = b.Request
+	}
+	provider := &meteredProvider{Provider: b.Provider, ctx: ctx, limiter: limiter}
+	result.Extraction, result.Err = Extract(provider, request(result.Description), max(b.MaxAttempts, 1))
+	result.Usage = provider.usage
+	return result
+}
+
+// meteredProvider waits for the tokenLimiter before every inference, and records the Usage of the responses.
+// A request already in a Cache costs no tokens, so it neither waits nor fails with ErrBudgetExceeded.
+type meteredProvider struct {
+	Provider
+	ctx     context.Context
+	limiter *tokenLimiter
+	usage   Usage
+}
+
+func (m *meteredProvider) Infer(request *Request) (Response, error) {
+	var hit bool
+	if cache, ok := m.Provider.(*Cache); ok {
+		_, hit = cache.Lookup(request)
+	}
+	if !hit {
+		if err := m.limiter.wait(m.ctx); err != nil {
+			return Response{}, err
+		}
+	}
+	response, err := m.Provider.Infer(request)
+	if err != nil {
+		return response, err
+	}
+	m.limiter.record(response.Usage)
+	m.usage.PromptTokens += response.Usage.PromptTokens
+	m.usage.CompletionTokens += response.Usage.CompletionTokens
+	m.usage.TotalTokens += response.Usage.TotalTokens
+	return response, nil
+}
+
+type tokenUse struct {
+	at     time.Time
+	tokens int64
+}
+
+// tokenLimiter keeps the tokens used in the last window and in total.
+type tokenLimiter struct {
+	mu        sync.Mutex
+	perMinute int64
+	budget    int64
+	window    time.Duration
+	total     int64
+	used      []tokenUse
+}
+
+// wait blocks until the tokens used in the window are below perMinute, or returns ErrBudgetExceeded.
+func (l *tokenLimiter) wait(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		if l.budget > 0 && l.total >= l.budget {
+			l.mu.Unlock()
+			return ErrBudgetExceeded
+		}
+
+		now := time.Now()
+		for len(l.used) > 0 && now.Sub(l.used[0].at) >= l.window {
+			l.used = l.used[1:]
+		}
+		var tokens int64
+		for _, use := range l.used {
+			tokens += use.tokens
+		}
+		if l.perMinute <= 0 || tokens < l.perMinute {
+			l.mu.Unlock()
+			return ctx.Err()
+		}
+		delay := l.window - now.Sub(l.used[0].at)
+		l.mu.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (l *tokenLimiter) record(usage Usage) {
+	if usage.Cached || usage.TotalTokens == 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total += usage.TotalTokens
+	l.used = append(l.used, tokenUse{at: time.Now(), tokens: usage.TotalTokens})
+}
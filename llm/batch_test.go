@@ -0,0 +1,138 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// echo responds with the index of the description as the steps, and takes longer for the earlier descriptions.
+func echo(t *testing.T) Config {
+	host := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		var request Request
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Error(err)
+		}
+		description := request.Messages[len(request.Messages)-1].Content
+		if description == "fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		steps, _ := strconv.Atoi(description)
+		time.Sleep(time.Duration(10-steps) * time.Millisecond)
+		json.NewEncoder(w).Encode(Response{
+			Choices: []Choice{{Message: Message{Role: AssistantRole, Content: fmt.Sprintf(`{"prompt": "a cat", "steps": %d, "width": 512, "height": 512}`, steps)}}},
+			Usage:   Usage{PromptTokens: 6, CompletionTokens: 4, TotalTokens: 10},
+		})
+	})
+	return OpenAI(host.String(), "")
+}
+
+func TestBatch(t *testing.T) {
+	batch := Batch{
+		Provider: echo(t),
+		Workers:  4,
+		Request:  func(description string) *Request { return &Request{Messages: []Message{UserMessage(description)}} },
+	}
+	descriptions := []string{"1", "2", "fail", "4", "5", "6"}
+
+	var results []BatchResult
+	for result := range batch.Run(context.Background(), slices.Values(descriptions)) {
+		results = append(results, result)
+	}
+	if len(results) != len(descriptions) {
+		t.Fatalf("Expected %d results, got %d", len(descriptions), len(results))
+	}
+	for i, result := range results {
+		if result.Index != i || result.Description != descriptions[i] {
+			t.Errorf("Expected result %d to be %q, got %d %q", i, descriptions[i], result.Index, result.Description)
+		}
+		if result.Description == "fail" {
+			if result.Err == nil {
+				t.Error("Expected the failed item to have an error")
+			}
+			continue
+		}
+		if result.Err != nil {
+			t.Errorf("Unexpected error for %q: %v", result.Description, result.Err)
+		}
+		if strconv.Itoa(int(result.Extraction.Request.Steps)) != result.Description {
+			t.Errorf("Expected steps %s, got %d", result.Description, result.Extraction.Request.Steps)
+		}
+		if result.Usage.TotalTokens != 10 {
+			t.Errorf("Expected 10 tokens, got %d", result.Usage.TotalTokens)
+		}
+	}
+}
+
+func TestBatchBudget(t *testing.T) {
+	batch := Batch{
+		Provider: echo(t),
+		Workers:  1,
+		Budget:   25,
+		Request:  func(description string) *Request { return &Request{Messages: []Message{UserMessage(description)}} },
+	}
+
+	var inferred, exceeded int
+	for result := range batch.Run(context.Background(), slices.Values([]string{"1", "2", "3", "4", "5"})) {
+		switch {
+		case result.Err == nil:
+			inferred++
+		case errors.Is(result.Err, ErrBudgetExceeded):
+			exceeded++
+		default:
+			t.Errorf("Unexpected error: %v", result.Err)
+		}
+	}
+	if inferred != 3 || exceeded != 2 {
+		t.Errorf("Expected 3 inferred and 2 over budget, got %d and %d", inferred, exceeded)
+	}
+}
+
+func TestBatchBudgetCached(t *testing.T) {
+	cache := NewCache(echo(t), t.TempDir(), 0)
+	request := func(description string) *Request { return &Request{Messages: []Message{UserMessage(description)}} }
+	prime := Batch{Provider: cache, Request: request}
+	for result := range prime.Run(context.Background(), slices.Values([]string{"1", "2"})) {
+		if result.Err != nil {
+			t.Fatal(result.Err)
+		}
+	}
+
+	batch := Batch{Provider: cache, Workers: 1, Budget: 10, Request: request}
+	for result := range batch.Run(context.Background(), slices.Values([]string{"3", "1", "2"})) {
+		if result.Err != nil {
+			t.Errorf("Expected %q to be answered after the budget was spent, got %v", result.Description, result.Err)
+		}
+	}
+}
+
+func TestTokenLimiter(t *testing.T) {
+	limiter := &tokenLimiter{perMinute: 10, window: 50 * time.Millisecond}
+	limiter.record(Usage{TotalTokens: 10})
+	limiter.record(Usage{TotalTokens: 100, Cached: true})
+
+	start := time.Now()
+	if err := limiter.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("Expected to wait for the window, waited %v", elapsed)
+	}
+	if limiter.total != 10 {
+		t.Errorf("Expected cached tokens not to count, got %d", limiter.total)
+	}
+
+	limiter.record(Usage{TotalTokens: 10})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := limiter.wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
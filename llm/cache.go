@@ -0,0 +1,198 @@
+package llm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// TemplateVersion changes whenever the template of DefaultSystem changes, so that cached responses to an older
+// template aren't reused.
+var TemplateVersion = textVersion(template)
+
+// Cache is a Provider that stores the responses of another Provider on disk, keyed by a hash of the request.
+// The key covers the model, every message, the temperature, the response format and the Version,
+// so a change to any of them is a miss. A response is reported as cached in Usage.Cached.
+type Cache struct {
+	Provider Provider
+	Dir      string
+	TTL      time.Duration // zero never expires
+	Version  string        // defaults to TemplateVersion
+
+	hits, misses atomic.Int64
+}
+
+// NewCache returns a Cache of the provider in the directory, e.g. filepath.Join(os.UserCacheDir(), "inkbunny-sd").
+func NewCache(provider Provider, dir string, ttl time.Duration) *Cache {
+	return &Cache{Provider: provider, Dir: dir, TTL: ttl, Version: TemplateVersion}
+}
+
+type cacheEntry struct {
+	Version  string    `json:"version"`
+	Created  time.Time `json:"created"`
+	Response Response  `json:"response"`
+}
+
+// modelResolver is a Provider with a default model for the requests without one, such as Ollama.
+type modelResolver interface {
+	model(request *Request) string
+}
+
+// Key returns the hash of everything in the request that changes the response.
+// The model is the one the Provider resolves, so that the default models of two providers sharing a Dir don't collide.
+func (c *Cache) Key(request *Request) string {
+	model := request.Model
+	if resolver, ok := c.Provider.(modelResolver); ok {
+		model = resolver.model(request)
+	}
+
+	data, _ := json.Marshal(struct {
+		Version        string          `json:"version"`
+		Model          string          `json:"model"`
+		Messages       []Message       `json:"messages"`
+		Temperature    float64         `json:"temperature"`
+		MaxTokens      int64           `json:"max_tokens"`
+		ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+		JSONSchema     *Schema         `json:"json_schema,omitempty"`
+		Grammar        string          `json:"grammar,omitempty"`
+	}{
+		Version:        c.version(),
+		Model:          model,
+		Messages:       request.Messages,
+		Temperature:    request.Temperature,
+		MaxTokens:      request.MaxTokens,
+		ResponseFormat: request.ResponseFormat,
+		JSONSchema:     request.JSONSchema,
+		Grammar:        request.Grammar,
+	})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *Cache) version() string {
+	if c.Version == "" {
+		return TemplateVersion
+	}
+	return c.Version
+}
+
+func (c *Cache) path(key string) string {
+	return filepath.Join(c.Dir, key[:2], key+".json")
+}
+
+// Infer returns the cached response of the request if there is one, otherwise it infers with the Provider and
+// stores the response. A streaming request that hits the cache gets the whole response as a single chunk.
+func (c *Cache) Infer(request *Request) (Response, error) {
+	key := c.Key(request)
+	if response, ok := c.load(key); ok {
+		c.hits.Add(1)
+		response.Usage.Cached = true
+		if request.Stream && request.StreamChannel != nil {
+			chunk := response
+			chunk.Choices = []Choice{{Delta: response.Choices[0].Message, FinishReason: response.Choices[0].FinishReason}}
+			request.StreamChannel <- &chunk
+			close(request.StreamChannel)
+		}
+		return response, nil
+	}
+
+	c.misses.Add(1)
+	response, err := c.Provider.Infer(request)
+	if err != nil {
+		return response, err
+	}
+	if err := c.store(key, response); err != nil {
+		return response, fmt.Errorf("error caching response: %w", err)
+	}
+	return response, nil
+}
+
+// Lookup returns the cached response of the request without inferring on a miss.
+// It doesn't count towards Stats, as the request isn't answered.
+func (c *Cache) Lookup(request *Request) (Response, bool) {
+	return c.load(c.Key(request))
+}
+
+func (c *Cache) AvailableModels() ([]string, error) {
+	return c.Provider.AvailableModels()
+}
+
+// Stats returns the number of hits and misses since the Cache was created.
+func (c *Cache) Stats() (hits, misses int64) {
+	return c.hits.Load(), c.misses.Load()
+}
+
+// Clear removes every cached response.
+func (c *Cache) Clear() error {
+	return os.RemoveAll(c.Dir)
+}
+
+func (c *Cache) load(key string) (Response, bool) {
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return Response{}, false
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil || entry.Version != c.version() || len(entry.Response.Choices) == 0 {
+		return Response{}, false
+	}
+	if c.TTL > 0 && time.Since(entry.Created) > c.TTL {
+		return Response{}, false
+	}
+	return entry.Response, true
+}
+
+// store writes the entry to a temporary file first, so that a concurrent load never reads a partial file.
+func (c *Cache) store(key string, response Response) error {
+	if len(response.Choices) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(cacheEntry{Version: c.version(), Created: time.Now(), Response: response})
+	if err != nil {
+		return err
+	}
+
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Prune removes the cached responses that expired or were made with another Version.
+func (c *Cache) Prune() error {
+	err := filepath.WalkDir(c.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Ext(path) != ".json" {
+			return err
+		}
+		key := filepath.Base(path)
+		key = key[:len(key)-len(".json")]
+		if _, ok := c.load(key); !ok {
+			return os.Remove(path)
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
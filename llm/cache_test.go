@@ -0,0 +1,111 @@
+package llm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	config, requests := replay(t, `{"prompt": "a cat"}`, `{"prompt": "a dog"}`)
+	cache := NewCache(config, t.TempDir(), time.Hour)
+
+	first, err := cache.Infer(DefaultRequest("a cat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Usage.Cached {
+		t.Error("Expected the first response not to be cached")
+	}
+
+	second, err := cache.Infer(DefaultRequest("a cat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !second.Usage.Cached || second.Choices[0].Message.Content != `{"prompt": "a cat"}` {
+		t.Errorf("Expected a cached response, got %+v", second)
+	}
+	if len(*requests) != 1 {
+		t.Errorf("Expected 1 request, got %d", len(*requests))
+	}
+
+	request := DefaultRequest("a cat")
+	request.Temperature = 0.2
+	if response, err := cache.Infer(request); err != nil {
+		t.Fatal(err)
+	} else if response.Usage.Cached {
+		t.Error("Expected a different temperature to miss the cache")
+	}
+
+	if hits, misses := cache.Stats(); hits != 1 || misses != 2 {
+		t.Errorf("Expected 1 hit and 2 misses, got %d and %d", hits, misses)
+	}
+
+	dir := t.TempDir()
+	llama, mistral := NewCache(Ollama{Model: "llama3"}, dir, 0), NewCache(Ollama{Model: "mistral"}, dir, 0)
+	if llama.Key(DefaultRequest("a cat")) == mistral.Key(DefaultRequest("a cat")) {
+		t.Error("Expected the default models of two providers sharing a Dir to have different keys")
+	}
+	request = DefaultRequest("a cat")
+	request.Model = "llama3"
+	if llama.Key(request) != llama.Key(DefaultRequest("a cat")) {
+		t.Error("Expected the default model to have the same key as the model set on the request")
+	}
+}
+
+func TestCacheStream(t *testing.T) {
+	config, _ := replay(t, `{"prompt": "a cat"}`)
+	cache := NewCache(config, t.TempDir(), 0)
+	if _, err := cache.Infer(DefaultRequest("a cat")); err != nil {
+		t.Fatal(err)
+	}
+
+	request := DefaultRequest("a cat")
+	request.Stream = true
+	request.StreamChannel = make(chan *Response, 1)
+	response, err := cache.Infer(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var content string
+	for chunk := range request.StreamChannel {
+		content += chunk.Choices[0].Delta.Content
+	}
+	if !response.Usage.Cached || content != `{"prompt": "a cat"}` {
+		t.Errorf("Expected the cached response as a chunk, got %q", content)
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	config, requests := replay(t, `{"prompt": "a cat"}`)
+	dir := t.TempDir()
+	cache := NewCache(config, dir, time.Minute)
+	if _, err := cache.Infer(DefaultRequest("a cat")); err != nil {
+		t.Fatal(err)
+	}
+
+	key := cache.Key(DefaultRequest("a cat"))
+	cache.TTL = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if _, ok := cache.load(key); ok {
+		t.Error("Expected the response to expire")
+	}
+
+	cache.TTL = time.Minute
+	cache.Version = "other"
+	if _, err := cache.Infer(DefaultRequest("a cat")); err != nil {
+		t.Fatal(err)
+	}
+	if len(*requests) != 2 {
+		t.Errorf("Expected a new version to miss the cache, got %d requests", len(*requests))
+	}
+
+	if err := cache.Prune(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, key[:2], key+".json")); !os.IsNotExist(err) {
+		t.Errorf("Expected Prune to remove the response of the old version, got %v", err)
+	}
+}
@@ -5,6 +5,10 @@
 //
 // Usage:
 // go run dataset.go
+// go run dataset.go -format chat -dedup 0.9 -max-tokens 4096
+//
+// With a format, the samples are exported as train, validation and test files with utils.ExportDataset instead,
+// along with a manifest.json. The formats are "chat", "sharegpt", "alpaca" and "completion".
 //
 // Before running, make sure to place the text files and json files in the same directory as this script.
 // The text files should contain the user descriptions, and the json files should contain the expected responses.
@@ -18,6 +22,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"github.com/ellypaws/inkbunny-sd/utils"
 	"log"
@@ -26,7 +31,33 @@ import (
 )
 
 func main() {
+	var (
+		format    = flag.String("format", "", "export format, or empty for the ### Input/### Response text files")
+		seed      = flag.String("seed", "", "seed of the train, validation and test splits")
+		dedup     = flag.Float64("dedup", 0, "similarity above which near duplicates are removed")
+		minTokens = flag.Int("min-tokens", 0, "minimum tokens of a sample")
+		maxTokens = flag.Int("max-tokens", 0, "maximum tokens of a sample")
+	)
+	flag.Parse()
+
 	text, json := getFiles()
+	if *format != "" {
+		manifest, err := utils.ExportDataset("dataset", utils.DatasetSamples(text, json), utils.ExportOptions{
+			Format:     utils.ExportFormat(*format),
+			Seed:       *seed,
+			Duplicates: *dedup,
+			MinTokens:  *minTokens,
+			MaxTokens:  *maxTokens,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, file := range manifest.Files {
+			fmt.Printf("%s: %d samples\n", file.Name, file.Samples)
+		}
+		return
+	}
+
 	dataset := utils.ParseDataset(text, json)
 
 	for name, data := range dataset {
@@ -176,14 +176,23 @@ func UserMessage(content string) Message {
 }
 
 func Localhost() Config {
+	return OpenAI("http://localhost:7869", "api-key")
+}
+
+// OpenAI returns the Config of an OpenAI compatible server, e.g. OpenAI("http://localhost:1234", "") for LM Studio.
+// The chat completions endpoint is added to the base URL unless it already has a path.
+func OpenAI(baseURL, apiKey string) Config {
+	endpoint, err := url.Parse(baseURL)
+	if err != nil || endpoint.Host == "" {
+		endpoint = &url.URL{Scheme: "http", Host: baseURL}
+	}
+	if endpoint.Path == "" || endpoint.Path == "/" {
+		endpoint.Path = "/v1/chat/completions"
+	}
 	return Config{
-		Host:   "localhost:7869",
-		APIKey: "api-key",
-		Endpoint: url.URL{
-			Scheme: "http",
-			Host:   "localhost:7869",
-			Path:   "/v1/chat/completions",
-		},
+		Host:     endpoint.Host,
+		APIKey:   apiKey,
+		Endpoint: *endpoint,
 	}
 }
 
@@ -0,0 +1,267 @@
+package llm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/ellypaws/inkbunny-sd/entities"
+	"github.com/ellypaws/inkbunny-sd/utils"
+)
+
+// Extractor returns the request of a description, to be scored by Evaluate.
+type Extractor func(description string) (entities.TextToImageRequest, error)
+
+// HeuristicExtractor extracts with the deterministic parsers of utils.Parse.
+func HeuristicExtractor(description string) (entities.TextToImageRequest, error) {
+	result, err := utils.Parse([]byte(description), utils.Hints{})
+	if err != nil {
+		return entities.TextToImageRequest{}, err
+	}
+	return firstRequest(result.Requests)
+}
+
+// LLMExtractor extracts with Extract and the DefaultRequest of the description.
+func LLMExtractor(provider Provider, maxAttempts int) Extractor {
+	return func(description string) (entities.TextToImageRequest, error) {
+		extraction, err := Extract(provider, DefaultRequest(description), maxAttempts)
+		var validation ValidationErrors
+		if errors.As(err, &validation) {
+			// The best attempt is still scored, as the fields that are wrong are what the eval measures
+			return extraction.Request, nil
+		}
+		return extraction.Request, err
+	}
+}
+
+// HybridExtractor extracts with Hybrid.Extract.
+func HybridExtractor(h Hybrid) Extractor {
+	return func(description string) (entities.TextToImageRequest, error) {
+		result, err := h.Extract([]byte(description), utils.Hints{})
+		if err != nil {
+			return entities.TextToImageRequest{}, err
+		}
+		return firstRequest(result.Requests)
+	}
+}
+
+// firstRequest is the request with the first key, as a description in llm/data has a single expected request.
+func firstRequest(requests map[string]entities.TextToImageRequest) (entities.TextToImageRequest, error) {
+	if len(requests) == 0 {
+		return entities.TextToImageRequest{}, errors.New("no requests found")
+	}
+	keys := make([]string, 0, len(requests))
+	for key := range requests {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return requests[keys[0]], nil
+}
+
+// Metric is the mean score of a field over the examples where it's expected.
+// A score is 0 or 1 for an exact or tolerance match, and between 0 and 1 for F1, precision and recall.
+type Metric struct {
+	Sum   float64 `json:"sum"`
+	Count int     `json:"count"`
+}
+
+func (m Metric) Score() float64 {
+	if m.Count == 0 {
+		return 0
+	}
+	return m.Sum / float64(m.Count)
+}
+
+func (m *Metric) add(score float64) {
+	m.Sum += score
+	m.Count++
+}
+
+// Report is the result of Evaluate. Errors are the examples that failed to extract, by name.
+// A failed example scores 0 on every metric it has an expected value for.
+type Report struct {
+	Examples int               `json:"examples"`
+	Metrics  map[string]Metric `json:"metrics"`
+	Errors   map[string]string `json:"errors,omitempty"`
+}
+
+// Names returns the name of every metric, sorted.
+func (r Report) Names() []string {
+	names := make([]string, 0, len(r.Metrics))
+	for name := range r.Metrics {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Save writes the report as JSON to be used as the baseline of a later run.
+func (r Report) Save(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// LoadReport reads a report written by Report.Save.
+func LoadReport(path string) (Report, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Report{}, err
+	}
+	var r Report
+	if err := json.Unmarshal(data, &r); err != nil {
+		return Report{}, fmt.Errorf("error decoding report %s: %w", path, err)
+	}
+	return r, nil
+}
+
+// Regression is a metric that scored lower than in the baseline.
+type Regression struct {
+	Metric   string  `json:"metric"`
+	Baseline float64 `json:"baseline"`
+	Current  float64 `json:"current"`
+}
+
+func (r Regression) String() string {
+	return fmt.Sprintf("%s: %.3f -> %.3f", r.Metric, r.Baseline, r.Current)
+}
+
+// Compare returns the metrics that dropped by more than tolerance from the baseline.
+// A metric of the baseline that is missing from the report counts as a score of 0.
+func (r Report) Compare(baseline Report, tolerance float64) []Regression {
+	var regressions []Regression
+	for _, name := range baseline.Names() {
+		before, after := baseline.Metrics[name].Score(), r.Metrics[name].Score()
+		if before-after > tolerance {
+			regressions = append(regressions, Regression{Metric: name, Baseline: before, Current: after})
+		}
+	}
+	return regressions
+}
+
+var loraName = regexp.MustCompile(`(?i)<lora:([^:>]+)`)
+
+// evalTolerance is the difference allowed between floats, e.g. a cfg_scale of 7 and 7.0001.
+const evalTolerance = 1e-3
+
+// Evaluate runs the extractor on every example and scores it against the JSON of the example.
+// The prompts are scored by the F1 of their words, the LoRAs by the precision and recall of their names,
+// and the other fields by an exact match, with a tolerance for floats.
+func Evaluate(examples Examples, extract Extractor) Report {
+	report := Report{Metrics: make(map[string]Metric)}
+	add := func(name string, score float64) {
+		m := report.Metrics[name]
+		m.add(score)
+		report.Metrics[name] = m
+	}
+	exact := func(name string, expected, got any) {
+		if !isZero(expected) {
+			add(name, boolScore(expected == got))
+		}
+	}
+	tolerance := func(name string, expected, got float64) {
+		if expected != 0 {
+			add(name, boolScore(math.Abs(expected-got) <= evalTolerance))
+		}
+	}
+
+	for _, example := range examples {
+		expected, err := entities.UnmarshalTextToImageRequest([]byte(example.JSON))
+		if err != nil {
+			report.error(example.Name, fmt.Errorf("error unmarshalling expected json: %w", err))
+			continue
+		}
+		report.Examples++
+
+		got, err := extract(example.Text)
+		if err != nil {
+			report.error(example.Name, err)
+			got = entities.TextToImageRequest{}
+		}
+
+		if expected.Prompt != "" {
+			add("prompt_f1", f1(utils.Words(expected.Prompt), utils.Words(got.Prompt)))
+		}
+		if expected.NegativePrompt != "" {
+			add("negative_prompt_f1", f1(utils.Words(expected.NegativePrompt), utils.Words(got.NegativePrompt)))
+		}
+		exact("seed", expected.Seed, got.Seed)
+		exact("steps", expected.Steps, got.Steps)
+		exact("width", expected.Width, got.Width)
+		exact("height", expected.Height, got.Height)
+		exact("sampler_name", strings.ToLower(expected.SamplerName), strings.ToLower(got.SamplerName))
+		tolerance("cfg_scale", expected.CFGScale, got.CFGScale)
+		tolerance("denoising_strength", expected.DenoisingStrength, got.DenoisingStrength)
+
+		expectedLoras, gotLoras := loras(expected), loras(got)
+		if len(gotLoras) > 0 {
+			add("lora_precision", float64(overlap(expectedLoras, gotLoras))/float64(len(gotLoras)))
+		}
+		if len(expectedLoras) > 0 {
+			add("lora_recall", float64(overlap(expectedLoras, gotLoras))/float64(len(expectedLoras)))
+		}
+	}
+	return report
+}
+
+func (r *Report) error(name string, err error) {
+	if r.Errors == nil {
+		r.Errors = make(map[string]string)
+	}
+	r.Errors[name] = err.Error()
+}
+
+// isZero reports whether the expected value is the zero value, i.e. it isn't in the JSON of the example.
+func isZero(v any) bool {
+	switch v := v.(type) {
+	case int:
+		return v == 0
+	case int64:
+		return v == 0
+	case string:
+		return v == ""
+	}
+	return v == nil
+}
+
+func boolScore(ok bool) float64 {
+	if ok {
+		return 1
+	}
+	return 0
+}
+
+func f1(expected, got map[string]bool) float64 {
+	shared := overlap(expected, got)
+	if shared == 0 {
+		return 0
+	}
+	precision := float64(shared) / float64(len(got))
+	recall := float64(shared) / float64(len(expected))
+	return 2 * precision * recall / (precision + recall)
+}
+
+func overlap(a, b map[string]bool) int {
+	var shared int
+	for key := range a {
+		if b[key] {
+			shared++
+		}
+	}
+	return shared
+}
+
+func loras(request entities.TextToImageRequest) map[string]bool {
+	set := make(map[string]bool)
+	for _, match := range loraName.FindAllStringSubmatch(request.Prompt+" "+request.NegativePrompt, -1) {
+		set[strings.ToLower(strings.TrimSpace(match[1]))] = true
+	}
+	return set
+}
@@ -0,0 +1,103 @@
+// This command measures how well an extractor reproduces the dataset of llm/data.
+// Every text file is run through the extractor, and the result is scored against the json file with the same name.
+//
+// Usage:
+// go run ./llm/eval -data llm/data -extractor heuristics
+// go run ./llm/eval -data llm/data -extractor llm -host http://localhost:7869 -save baseline.json
+// go run ./llm/eval -data llm/data -extractor hybrid -host http://localhost:11434 -ollama llama3 -baseline baseline.json
+//
+// With a baseline, the metrics that dropped by more than the tolerance are listed and the command exits with status 1.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"text/tabwriter"
+
+	"github.com/ellypaws/inkbunny-sd/llm"
+)
+
+func main() {
+	var (
+		data      = flag.String("data", "llm/data", "directory of the txt and json pairs")
+		extractor = flag.String("extractor", "heuristics", `one of "heuristics", "llm" or "hybrid"`)
+		host      = flag.String("host", "http://localhost:7869", "base URL of the OpenAI compatible server")
+		apiKey    = flag.String("key", "", "API key of the server")
+		ollama    = flag.String("ollama", "", "use the Ollama server at host with this model instead")
+		attempts  = flag.Int("attempts", 3, "attempts of the LLM to return a valid request")
+		baseline  = flag.String("baseline", "", "report to compare against")
+		save      = flag.String("save", "", "write the report to this file")
+		tolerance = flag.Float64("tolerance", 0.01, "drop in a metric that is reported as a regression")
+	)
+	flag.Parse()
+
+	examples, err := llm.LoadExamples(os.DirFS(*data))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(examples) == 0 {
+		log.Fatalf("no txt and json pairs in %s", *data)
+	}
+
+	var provider llm.Provider = llm.OpenAI(*host, *apiKey)
+	if *ollama != "" {
+		u, err := url.Parse(*host)
+		if err != nil {
+			log.Fatal(err)
+		}
+		provider = llm.Ollama{Host: *u, Model: *ollama}
+	}
+
+	var extract llm.Extractor
+	switch *extractor {
+	case "heuristics":
+		extract = llm.HeuristicExtractor
+	case "llm":
+		extract = llm.LLMExtractor(provider, *attempts)
+	case "hybrid":
+		extract = llm.HybridExtractor(llm.Hybrid{Provider: provider, MaxAttempts: *attempts})
+	default:
+		log.Fatalf("unknown extractor %q", *extractor)
+	}
+
+	report := llm.Evaluate(examples, extract)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "metric\tscore\tcount\n")
+	for _, name := range report.Names() {
+		metric := report.Metrics[name]
+		fmt.Fprintf(w, "%s\t%.3f\t%d\n", name, metric.Score(), metric.Count)
+	}
+	w.Flush()
+	fmt.Printf("%d examples, %d errors\n", report.Examples, len(report.Errors))
+	for name, err := range report.Errors {
+		fmt.Printf("  %s: %s\n", name, err)
+	}
+
+	if *save != "" {
+		if err := report.Save(*save); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *baseline != "" {
+		previous, err := llm.LoadReport(*baseline)
+		if err != nil {
+			log.Fatal(err)
+		}
+		regressions := report.Compare(previous, *tolerance)
+		if len(regressions) == 0 {
+			fmt.Println("no regressions")
+			return
+		}
+		fmt.Println("regressions:")
+		for _, r := range regressions {
+			fmt.Printf("  %s\n", r)
+		}
+		os.Exit(1)
+	}
+}
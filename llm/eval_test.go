@@ -0,0 +1,78 @@
+package llm
+
+import (
+	"errors"
+	"math"
+	"path/filepath"
+	"testing"
+
+	"github.com/ellypaws/inkbunny-sd/entities"
+)
+
+func TestEvaluate(t *testing.T) {
+	examples := Examples{
+		{Name: "1", Text: "one", JSON: `{"prompt": "a cat, <lora:fluffy:0.8>, <lora:style:1>", "steps": 20, "seed": 42, "cfg_scale": 7}`},
+		{Name: "2", Text: "two", JSON: `{"prompt": "a dog", "steps": 30, "sampler_name": "Euler a"}`},
+		{Name: "3", Text: "three", JSON: `{"prompt": "a bird", "steps": 25}`},
+		{Name: "4", Text: "four", JSON: `not json`},
+	}
+	extracted := map[string]entities.TextToImageRequest{
+		"one": {Prompt: "a cat, <lora:Fluffy:0.5>, <lora:other:1>", Steps: 20, Seed: 1, CFGScale: 7.0001},
+		"two": {Prompt: "a dog", Steps: 30, SamplerName: "euler a"},
+	}
+	report := Evaluate(examples, func(description string) (entities.TextToImageRequest, error) {
+		request, ok := extracted[description]
+		if !ok {
+			return request, errors.New("nothing found")
+		}
+		return request, nil
+	})
+
+	if report.Examples != 3 || len(report.Errors) != 2 || report.Errors["3"] != "nothing found" {
+		t.Errorf("Expected 3 examples with 2 errors, got %d and %v", report.Examples, report.Errors)
+	}
+	tests := map[string]float64{
+		"steps":          2.0 / 3,
+		"seed":           0,
+		"cfg_scale":      1,
+		"sampler_name":   1,
+		"lora_precision": 0.5,
+		"lora_recall":    0.5,
+	}
+	for name, want := range tests {
+		if got := report.Metrics[name].Score(); math.Abs(got-want) > 1e-9 {
+			t.Errorf("Expected %s to be %g, got %g", name, want, got)
+		}
+	}
+	if f1 := report.Metrics["prompt_f1"]; f1.Count != 3 || f1.Score() <= 0.5 || f1.Score() >= 2.0/3 {
+		t.Errorf("Expected a prompt F1 between 0.5 and 0.67 over 3 examples, got %+v", f1)
+	}
+	if _, ok := report.Metrics["negative_prompt_f1"]; ok {
+		t.Error("Expected no negative prompt metric when none are expected")
+	}
+}
+
+func TestReportCompare(t *testing.T) {
+	baseline := Report{Metrics: map[string]Metric{
+		"steps":     {Sum: 9, Count: 10},
+		"seed":      {Sum: 5, Count: 10},
+		"cfg_scale": {Sum: 1, Count: 1},
+	}}
+	path := filepath.Join(t.TempDir(), "baseline.json")
+	if err := baseline.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadReport(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current := Report{Metrics: map[string]Metric{
+		"steps": {Sum: 7, Count: 10},
+		"seed":  {Sum: 4.95, Count: 10},
+	}}
+	regressions := current.Compare(loaded, 0.01)
+	if len(regressions) != 2 || regressions[0].Metric != "cfg_scale" || regressions[1].Metric != "steps" {
+		t.Errorf("Expected cfg_scale and steps to regress, got %v", regressions)
+	}
+}
@@ -0,0 +1,169 @@
+package llm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ellypaws/inkbunny-sd/entities"
+	"github.com/ellypaws/inkbunny-sd/utils"
+)
+
+// ValidationError is a field of an inferred entities.TextToImageRequest that is missing or out of range.
+type ValidationError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%s %s", e.Field, e.Message)
+}
+
+// ValidationErrors are every ValidationError of a request. A nil ValidationErrors means the request is valid.
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Validate checks that the prompt is set and that the fields are within the ranges accepted by the webui.
+// Fields that are zero are considered missing and are only an error if they're required.
+func Validate(request entities.TextToImageRequest) ValidationErrors {
+	var errs ValidationErrors
+	check := func(ok bool, field, format string, args ...any) {
+		if !ok {
+			errs = append(errs, ValidationError{Field: field, Message: fmt.Sprintf(format, args...)})
+		}
+	}
+
+	check(strings.TrimSpace(request.Prompt) != "", "prompt", "is required")
+	check(request.Steps >= 1 && request.Steps <= 150, "steps", "must be between 1 and 150, got %d", request.Steps)
+	check(request.Width >= 64 && request.Width <= 8192, "width", "must be between 64 and 8192, got %d", request.Width)
+	check(request.Height >= 64 && request.Height <= 8192, "height", "must be between 64 and 8192, got %d", request.Height)
+	check(request.CFGScale >= 0 && request.CFGScale <= 30, "cfg_scale", "must be at most 30, got %g", request.CFGScale)
+	check(request.DenoisingStrength >= 0 && request.DenoisingStrength <= 1, "denoising_strength", "must be between 0 and 1, got %g", request.DenoisingStrength)
+	check(request.Seed >= -1, "seed", "must be -1 or a positive number, got %d", request.Seed)
+	check(request.BatchSize >= 0 && request.BatchSize <= 64, "batch_size", "must be at most 64, got %d", request.BatchSize)
+	check(request.NIter >= 0 && request.NIter <= 100, "n_iter", "must be at most 100, got %d", request.NIter)
+	check(request.HrScale == 0 || request.HrScale >= 1 && request.HrScale <= 8, "hr_scale", "must be between 1 and 8, got %g", request.HrScale)
+	check(request.HrSecondPassSteps >= 0 && request.HrSecondPassSteps <= 150, "hr_second_pass_steps", "must be at most 150, got %d", request.HrSecondPassSteps)
+
+	return errs
+}
+
+// Attempt is one inference of Extract. Content is the raw output of the model.
+// Err is set when the inference or the JSON failed, and Errors when the request didn't validate.
+type Attempt struct {
+	Model   string                       `json:"model,omitempty"`
+	Content string                       `json:"content"`
+	Request *entities.TextToImageRequest `json:"request,omitempty"`
+	Repairs []utils.Repair               `json:"repairs,omitempty"`
+	Errors  ValidationErrors             `json:"errors,omitempty"`
+	Err     error                        `json:"-"`
+}
+
+// Extraction is the result of Extract. Transcript is every message sent and received, including the follow-ups.
+// Best is the index of the attempt in Attempts that Request is from, or -1 if no attempt returned a request.
+type Extraction struct {
+	Request    entities.TextToImageRequest `json:"request"`
+	Attempts   []Attempt                   `json:"attempts"`
+	Best       int                         `json:"best"`
+	Transcript []Message                   `json:"transcript"`
+}
+
+// ErrNoAttempts is returned by Extract when no attempt could be unmarshalled into a request.
+var ErrNoAttempts = errors.New("no attempt returned a request")
+
+// Extract infers an entities.TextToImageRequest from the request with the provider, and re-prompts with the validation errors
+// until it validates or maxAttempts is reached. The request with the fewest errors is returned along with
+// the ValidationErrors if none of the attempts were valid.
+func Extract(provider Provider, request *Request, maxAttempts int) (Extraction, error) {
+	return ExtractWith(provider, request, maxAttempts, Validate)
+}
+
+// ExtractWith is Extract with a different validation, e.g. one that only checks the fields that were asked for.
+func ExtractWith(provider Provider, request *Request, maxAttempts int, validate func(entities.TextToImageRequest) ValidationErrors) (Extraction, error) {
+	if request.Stream {
+		return Extraction{Best: -1}, errors.New("streaming requests can't be extracted")
+	}
+
+	extraction := Extraction{Best: -1, Transcript: append([]Message(nil), request.Messages...)}
+	best := -1
+	for range max(maxAttempts, 1) {
+		attempt := attempt(provider, request, extraction.Transcript, validate)
+		extraction.Attempts = append(extraction.Attempts, attempt)
+
+		if attempt.Content != "" {
+			extraction.Transcript = append(extraction.Transcript, Message{Role: AssistantRole, Content: attempt.Content})
+		}
+		if attempt.Request != nil && (best < 0 || len(attempt.Errors) < len(extraction.Attempts[best].Errors)) {
+			best = len(extraction.Attempts) - 1
+		}
+		if attempt.Request != nil && attempt.Errors == nil {
+			extraction.Request, extraction.Best = *attempt.Request, len(extraction.Attempts)-1
+			return extraction, nil
+		}
+		if followUp, ok := followUp(attempt); ok {
+			extraction.Transcript = append(extraction.Transcript, followUp)
+		}
+	}
+
+	if best < 0 {
+		last := extraction.Attempts[len(extraction.Attempts)-1]
+		return extraction, fmt.Errorf("%w after %d attempts: %w", ErrNoAttempts, len(extraction.Attempts), last.Err)
+	}
+	extraction.Request, extraction.Best = *extraction.Attempts[best].Request, best
+	return extraction, extraction.Attempts[best].Errors
+}
+
+func attempt(provider Provider, request *Request, messages []Message, validate func(entities.TextToImageRequest) ValidationErrors) Attempt {
+	r := *request
+	r.Messages = messages
+
+	response, err := provider.Infer(&r)
+	if err != nil {
+		return Attempt{Err: err}
+	}
+	if len(response.Choices) == 0 {
+		return Attempt{Err: errors.New("response has no choices")}
+	}
+
+	attempt := Attempt{Model: response.Model, Content: response.Choices[0].Message.Content}
+	repaired, repairs, err := utils.RepairJSON([]byte(attempt.Content))
+	attempt.Repairs = repairs
+	if err != nil {
+		attempt.Err = fmt.Errorf("error repairing JSON: %w", err)
+		return attempt
+	}
+	inferred, err := entities.UnmarshalTextToImageRequest(repaired)
+	if err != nil {
+		attempt.Err = fmt.Errorf("error unmarshalling text to image: %w", err)
+		return attempt
+	}
+	attempt.Request = &inferred
+	attempt.Errors = validate(inferred)
+	return attempt
+}
+
+// followUp is the message asking the model to fix the errors of the attempt.
+// There is nothing to follow up on if the inference itself failed.
+func followUp(attempt Attempt) (Message, bool) {
+	var b strings.Builder
+	switch {
+	case attempt.Content == "":
+		return Message{}, false
+	case attempt.Request == nil:
+		fmt.Fprintf(&b, "The output could not be parsed as JSON: %v\n", attempt.Err)
+	default:
+		b.WriteString("The JSON has the following errors:\n")
+		for _, err := range attempt.Errors {
+			fmt.Fprintf(&b, "- %s\n", err)
+		}
+	}
+	b.WriteString("Output only the corrected JSON object.")
+	return UserMessage(b.String()), true
+}
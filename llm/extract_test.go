@@ -0,0 +1,86 @@
+package llm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// replay returns a Config for a server that answers with each of the contents in order.
+func replay(t *testing.T, contents ...string) (Config, *[]Request) {
+	t.Helper()
+	var requests []Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request Request
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Error(err)
+		}
+		requests = append(requests, request)
+		content := contents[min(len(requests), len(contents))-1]
+		json.NewEncoder(w).Encode(Response{Model: fmt.Sprintf("replay-%d", len(requests)), Choices: []Choice{{Message: Message{Role: AssistantRole, Content: content}}}})
+	}))
+	t.Cleanup(server.Close)
+
+	endpoint, _ := url.Parse(server.URL + "/v1/chat/completions")
+	return Config{Host: endpoint.Host, Endpoint: *endpoint}, &requests
+}
+
+func TestExtract(t *testing.T) {
+	config, requests := replay(t,
+		"Here you go: {prompt: 'a cat', steps: 5000, width: 0, height: 512}",
+		`{"prompt": "a cat", "steps": 20, "width": 512, "height": 512}`,
+	)
+
+	extraction, err := Extract(config, DefaultRequest("a cat, 20 steps, 512x512"), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if extraction.Request.Steps != 20 || extraction.Request.Width != 512 {
+		t.Errorf("Unexpected request %+v", extraction.Request)
+	}
+	if len(extraction.Attempts) != 2 || len(extraction.Attempts[0].Errors) != 2 || len(extraction.Attempts[0].Repairs) == 0 {
+		t.Errorf("Unexpected attempts %+v", extraction.Attempts)
+	}
+	if extraction.Best != 1 {
+		t.Errorf("Expected the request of the second attempt, got %d", extraction.Best)
+	}
+
+	// system, user, assistant, follow-up, assistant
+	if len(extraction.Transcript) != 5 {
+		t.Fatalf("Expected 5 messages in the transcript, got %d", len(extraction.Transcript))
+	}
+	followUp := extraction.Transcript[3]
+	if followUp.Role != UserRole || !strings.Contains(followUp.Content, "steps must be between 1 and 150, got 5000") || !strings.Contains(followUp.Content, "width") {
+		t.Errorf("Unexpected follow-up %q", followUp.Content)
+	}
+	if sent := (*requests)[1].Messages; len(sent) != 4 || sent[3].Content != followUp.Content {
+		t.Errorf("Expected the follow-up to be sent in the second attempt, got %+v", sent)
+	}
+}
+
+func TestExtractBest(t *testing.T) {
+	config, _ := replay(t,
+		"not json",
+		`{"steps": 5000, "width": 0}`,
+		`{"prompt": "a cat", "steps": 5000, "width": 512, "height": 512}`,
+	)
+
+	extraction, err := Extract(config, DefaultRequest("a cat"), 3)
+	var errs ValidationErrors
+	if !errors.As(err, &errs) || len(errs) != 1 || errs[0].Field != "steps" {
+		t.Fatalf("Expected the steps to be invalid, got %v", err)
+	}
+	if extraction.Request.Prompt != "a cat" || len(extraction.Attempts) != 3 || extraction.Attempts[0].Err == nil || extraction.Best != 2 {
+		t.Errorf("Expected the attempt with the fewest errors, got %+v", extraction)
+	}
+
+	config, _ = replay(t, "no")
+	if _, err := Extract(config, DefaultRequest("a cat"), 2); !errors.Is(err, ErrNoAttempts) {
+		t.Errorf("Expected ErrNoAttempts, got %v", err)
+	}
+}
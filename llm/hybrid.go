@@ -0,0 +1,210 @@
+package llm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/ellypaws/inkbunny-sd/entities"
+	"github.com/ellypaws/inkbunny-sd/utils"
+)
+
+// HybridFields are the fields Hybrid makes sure are found, as JSON paths of entities.TextToImageRequest.
+var HybridFields = []string{
+	"prompt", "negative_prompt", "steps", "sampler_name", "cfg_scale", "seed", "width", "height",
+	"override_settings.sd_model_checkpoint",
+}
+
+// Hybrid runs the deterministic parsers of utils.Parse first, and only asks the LLM for the fields
+// that are missing or have evidence with a confidence below Threshold.
+// The values from the parsers win, unless their evidence is below Threshold,
+// and a value the parsers set without any evidence is never replaced.
+type Hybrid struct {
+	Provider    Provider
+	Fields      []string // defaults to HybridFields
+	Threshold   float64  // defaults to utils.ConfidenceRegex
+	MaxAttempts int      // defaults to 3
+}
+
+// HybridResult is every request found by Hybrid.Extract.
+// Gaps are the fields that were asked for, and Extractions are the LLM attempts for the requests that had gaps.
+type HybridResult struct {
+	utils.ParseResult
+	Gaps        map[string][]string   `json:"gaps,omitempty"`
+	Extractions map[string]Extraction `json:"extractions,omitempty"`
+}
+
+const hybridTemplate = "You are a backend API that responds to requests in natural language and outputs a raw JSON object. \n" +
+	"Process the following description of an image generated with Stable Diffusion. \n" +
+	"These parameters were already found in the description: \n%s\n" +
+	"Find only the following parameters: %s. \n" +
+	"Output only a raw JSON object with those parameters and do not include any comments. \n" +
+	"Keep loras as is `<lora:MODELNAME:weight>`"
+
+// Extract parses the blob with utils.Parse and infers the missing fields of each request.
+// If the parsers found nothing, the whole request is inferred.
+func (h Hybrid) Extract(blob []byte, hints utils.Hints) (HybridResult, error) {
+	fields, threshold, attempts := h.Fields, h.Threshold, h.MaxAttempts
+	if fields == nil {
+		fields = HybridFields
+	}
+	if threshold == 0 {
+		threshold = utils.ConfidenceRegex
+	}
+	if attempts == 0 {
+		attempts = 3
+	}
+
+	parsed, err := utils.Parse(blob, hints)
+	if err != nil {
+		parsed = utils.ParseResult{
+			Requests:   map[string]entities.TextToImageRequest{hints.Filename: {}},
+			Provenance: map[string]entities.Provenance{hints.Filename: {}},
+			Format:     utils.FormatUnknown,
+		}
+	}
+
+	if parsed.Provenance == nil {
+		parsed.Provenance = make(map[string]entities.Provenance)
+	}
+	result := HybridResult{
+		ParseResult: parsed,
+		Gaps:        make(map[string][]string),
+		Extractions: make(map[string]Extraction),
+	}
+	for name, request := range parsed.Requests {
+		provenance := parsed.Provenance[name]
+		if provenance == nil {
+			provenance = make(entities.Provenance)
+			result.Provenance[name] = provenance
+		}
+
+		var gaps []string
+		for _, field := range fields {
+			value := fieldByPath(reflect.ValueOf(&request).Elem(), field)
+			if !value.IsValid() {
+				continue
+			}
+			if _, ok := provenance[field]; value.IsZero() || ok && provenance.Confidence(field) < threshold {
+				gaps = append(gaps, field)
+			}
+		}
+		if len(gaps) == 0 {
+			continue
+		}
+		result.Gaps[name] = gaps
+
+		// Only the values from the LLM are validated, so an invalid value from the parsers doesn't use up the attempts
+		missing := zeroFields(request, gaps)
+		extraction, err := ExtractWith(h.Provider, gapRequest(blob, request, gaps), attempts, func(inferred entities.TextToImageRequest) ValidationErrors {
+			merged := request
+			supplied := fill(&merged, &inferred, gaps)
+			return onlyFields(Validate(merged), append(supplied, missing...))
+		})
+		result.Extractions[name] = extraction
+		// Invalid fields aren't filled in, but the valid ones of the best attempt still are
+		var invalid ValidationErrors
+		if err != nil && !errors.As(err, &invalid) {
+			return result, fmt.Errorf("error inferring %v for %s: %w", gaps, name, err)
+		}
+		for _, e := range invalid {
+			extraction.Request = clearField(extraction.Request, e.Field)
+		}
+
+		model := extraction.Attempts[extraction.Best].Model
+		for _, field := range fill(&request, &extraction.Request, gaps) {
+			// Set rather than Add, as the inferred value replaced the weaker evidence of the parsers
+			provenance[field] = entities.Evidence{
+				Source:     entities.SourceLLM,
+				Key:        model,
+				Start:      -1,
+				End:        -1,
+				Confidence: utils.ConfidenceLLM,
+			}
+		}
+		result.Requests[name] = request
+	}
+
+	return result, nil
+}
+
+// gapRequest asks for the gaps only, with the values that were already found as context.
+func gapRequest(blob []byte, request entities.TextToImageRequest, gaps []string) *Request {
+	known, _ := json.MarshalIndent(request, "", "  ")
+	system := fmt.Sprintf(hybridTemplate, known, strings.Join(gaps, ", "))
+	return (&Request{
+		Messages:    []Message{{Role: SystemRole, Content: system}, UserMessage(string(blob))},
+		Temperature: 0.7,
+		MaxTokens:   1024,
+	}).WithResponseFormat("missing_parameters", TextToImageSchema.Pick(gaps...))
+}
+
+// fill sets the fields of dst to the values inferred in src, and returns the fields that were set.
+// Only the gaps are passed, so the values the parsers were confident about are never replaced.
+func fill(dst, src *entities.TextToImageRequest, fields []string) []string {
+	var filled []string
+	for _, field := range fields {
+		d, s := fieldByPath(reflect.ValueOf(dst).Elem(), field), fieldByPath(reflect.ValueOf(src).Elem(), field)
+		if !d.IsValid() || !s.IsValid() || s.IsZero() {
+			continue
+		}
+		d.Set(s)
+		filled = append(filled, field)
+	}
+	return filled
+}
+
+// zeroFields returns the fields that the parsers didn't find at all.
+func zeroFields(request entities.TextToImageRequest, fields []string) []string {
+	var zero []string
+	for _, field := range fields {
+		if v := fieldByPath(reflect.ValueOf(&request).Elem(), field); v.IsValid() && v.IsZero() {
+			zero = append(zero, field)
+		}
+	}
+	return zero
+}
+
+// clearField returns the request with the field set to its zero value.
+func clearField(request entities.TextToImageRequest, field string) entities.TextToImageRequest {
+	if v := fieldByPath(reflect.ValueOf(&request).Elem(), field); v.IsValid() {
+		v.SetZero()
+	}
+	return request
+}
+
+// onlyFields keeps the errors of the fields that were asked for.
+func onlyFields(errs ValidationErrors, fields []string) ValidationErrors {
+	var out ValidationErrors
+	for _, err := range errs {
+		for _, field := range fields {
+			if err.Field == field {
+				out = append(out, err)
+			}
+		}
+	}
+	return out
+}
+
+// fieldByPath returns the field of the struct at the JSON path, e.g. "override_settings.sd_model_checkpoint",
+// or the zero reflect.Value if there is no such field.
+func fieldByPath(v reflect.Value, path string) reflect.Value {
+	for _, name := range strings.Split(path, ".") {
+		if v.Kind() != reflect.Struct {
+			return reflect.Value{}
+		}
+		t, found := v.Type(), false
+		for i := 0; i < t.NumField(); i++ {
+			if tag, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ","); tag == name {
+				v, found = v.Field(i), true
+				break
+			}
+		}
+		if !found {
+			return reflect.Value{}
+		}
+	}
+	return v
+}
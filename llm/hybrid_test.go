@@ -0,0 +1,87 @@
+package llm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ellypaws/inkbunny-sd/entities"
+	"github.com/ellypaws/inkbunny-sd/utils"
+)
+
+func TestHybrid(t *testing.T) {
+	const parameters = "a cat\nNegative prompt: blurry\nSteps: 20, Sampler: Euler a, CFG scale: 7, Seed: 1, Size: 512x512"
+
+	config, requests := replay(t, `{"override_settings": {"sd_model_checkpoint": "EasyFluff"}, "steps": 99}`)
+	hybrid := Hybrid{Provider: config}
+	result, err := hybrid.Extract([]byte(parameters), utils.Hints{Filename: "image.png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gaps := result.Gaps["image.png"]; len(gaps) != 1 || gaps[0] != "override_settings.sd_model_checkpoint" {
+		t.Fatalf("Expected only the model to be missing, got %v", gaps)
+	}
+	if len(*requests) != 1 {
+		t.Fatalf("Expected a single inference, got %d", len(*requests))
+	}
+	sent := (*requests)[0]
+	if !strings.Contains(sent.Messages[0].Content, `"steps": 20`) || sent.ResponseFormat == nil || len(sent.ResponseFormat.JSONSchema.Schema.Properties) != 1 {
+		t.Errorf("Expected a request for the model with the known values as context, got %+v", sent)
+	}
+
+	request := result.Requests["image.png"]
+	if request.Steps != 20 {
+		t.Errorf("Expected the heuristic steps to win, got %d", request.Steps)
+	}
+	if request.OverrideSettings.SDModelCheckpoint == nil || *request.OverrideSettings.SDModelCheckpoint != "EasyFluff" {
+		t.Errorf("Expected the inferred model, got %v", request.OverrideSettings.SDModelCheckpoint)
+	}
+	if evidence := result.Provenance["image.png"]["override_settings.sd_model_checkpoint"]; evidence.Source != entities.SourceLLM {
+		t.Errorf("Expected the model to come from the LLM, got %+v", evidence)
+	}
+
+	config, requests = replay(t, "{}")
+	hybrid = Hybrid{Provider: config, Fields: []string{"prompt", "steps", "seed"}}
+	if _, err := hybrid.Extract([]byte(parameters), utils.Hints{Filename: "image.png"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(*requests) != 0 {
+		t.Errorf("Expected no inference when nothing is missing, got %d", len(*requests))
+	}
+}
+
+func TestHybridInvalidHeuristic(t *testing.T) {
+	const description = "A cat.\nPositive prompt: a cat sleeping\nSteps: 20\nCFG scale: 45\nSeed: 1"
+
+	config, requests := replay(t, `{"cfg_scale": 7}`)
+	hybrid := Hybrid{Provider: config, Fields: []string{"steps", "cfg_scale", "seed"}}
+	result, err := hybrid.Extract([]byte(description), utils.Hints{Filename: "image.png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*requests) != 1 {
+		t.Errorf("Expected a single inference when the LLM answers a valid value, got %d", len(*requests))
+	}
+	if request := result.Requests["image.png"]; request.CFGScale != 7 || request.Steps != 20 {
+		t.Errorf("Expected the low confidence cfg scale to be replaced, got %g and steps %d", request.CFGScale, request.Steps)
+	}
+	if evidence := result.Provenance["image.png"]["cfg_scale"]; evidence.Source != entities.SourceLLM {
+		t.Errorf("Expected the cfg scale to come from the LLM, got %+v", evidence)
+	}
+}
+
+func TestHybridBestAttempt(t *testing.T) {
+	const description = "A cat.\nPositive prompt: a cat sleeping\nSteps: 20\nCFG scale: 45\nSeed: 1"
+
+	config, _ := replay(t, `{"cfg_scale": 45, "sampler_name": "Euler a"}`, "not json")
+	hybrid := Hybrid{Provider: config, Fields: []string{"cfg_scale", "sampler_name"}, MaxAttempts: 2}
+	result, err := hybrid.Extract([]byte(description), utils.Hints{Filename: "image.png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request := result.Requests["image.png"]; request.SamplerName != "Euler a" {
+		t.Errorf("Expected the valid sampler of the best attempt, got %q", request.SamplerName)
+	}
+	if evidence := result.Provenance["image.png"]["sampler_name"]; evidence.Source != entities.SourceLLM || evidence.Key != "replay-1" {
+		t.Errorf("Expected the model of the first attempt, got %+v", evidence)
+	}
+}
@@ -0,0 +1,138 @@
+package llm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// LlamaCPP uses the /completion endpoint of the llama.cpp server, which accepts a GBNF grammar.
+// The messages are joined into a single prompt with Template, which defaults to AlpacaTemplate.
+type LlamaCPP struct {
+	Host     url.URL
+	Template func([]Message) string
+}
+
+func LocalLlamaCPP() LlamaCPP {
+	return LlamaCPP{Host: url.URL{Scheme: "http", Host: "localhost:8080"}}
+}
+
+// AlpacaTemplate joins the messages in the "### Instruction:" format used by the dataset of utils.ParseDataset.
+func AlpacaTemplate(messages []Message) string {
+	var b strings.Builder
+	for _, m := range messages {
+		switch m.Role {
+		case SystemRole:
+			b.WriteString("### Instruction:\n")
+		case UserRole:
+			b.WriteString("### Input:\n")
+		case AssistantRole:
+			b.WriteString("### Response:\n")
+		}
+		b.WriteString(m.Content)
+		b.WriteString("\n\n")
+	}
+	b.WriteString("### Response:\n")
+	return b.String()
+}
+
+type llamaCPPRequest struct {
+	Prompt      string  `json:"prompt"`
+	NPredict    int64   `json:"n_predict,omitempty"`
+	Temperature float64 `json:"temperature"`
+	Stream      bool    `json:"stream"`
+	Grammar     string  `json:"grammar,omitempty"`
+	JSONSchema  *Schema `json:"json_schema,omitempty"`
+}
+
+type llamaCPPResponse struct {
+	Content         string `json:"content"`
+	Model           string `json:"model"`
+	Stop            bool   `json:"stop"`
+	StoppedLimit    bool   `json:"stopped_limit"`
+	TokensEvaluated int64  `json:"tokens_evaluated"`
+	TokensPredicted int64  `json:"tokens_predicted"`
+}
+
+func (l llamaCPPResponse) response(stream bool) Response {
+	finishReason := ""
+	switch {
+	case l.StoppedLimit:
+		finishReason = "length"
+	case l.Stop:
+		finishReason = "stop"
+	}
+	return singleChoice(l.Model, l.Content, finishReason, l.TokensEvaluated, l.TokensPredicted, stream)
+}
+
+func (l LlamaCPP) endpoint(path string) string {
+	endpoint := l.Host
+	endpoint.Path = path
+	return endpoint.String()
+}
+
+func (l LlamaCPP) Infer(request *Request) (Response, error) {
+	template := l.Template
+	if template == nil {
+		template = AlpacaTemplate
+	}
+	body := llamaCPPRequest{
+		Prompt:      template(request.Messages),
+		NPredict:    request.MaxTokens,
+		Temperature: request.Temperature,
+		Stream:      request.Stream,
+		Grammar:     request.Grammar,
+	}
+	if body.Grammar == "" {
+		body.JSONSchema = request.JSONSchema
+		if body.JSONSchema == nil && request.ResponseFormat != nil && request.ResponseFormat.JSONSchema != nil {
+			body.JSONSchema = request.ResponseFormat.JSONSchema.Schema
+		}
+	}
+
+	resp, err := postJSON(l.endpoint("/completion"), body, nil)
+	if err != nil {
+		return Response{}, fmt.Errorf("failed to make inference request: %w", err)
+	}
+
+	if request.Stream {
+		response, err := streamChunks(resp.Body, request, func(line []byte) (Response, bool, error) {
+			var chunk llamaCPPResponse
+			if err := json.Unmarshal(line, &chunk); err != nil {
+				return Response{}, false, err
+			}
+			return chunk.response(true), chunk.Stop, nil
+		})
+		if err != nil {
+			return Response{}, fmt.Errorf("failed to handle streamed response: %w", err)
+		}
+		return response, nil
+	}
+
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return Response{}, fmt.Errorf("failed to read response body: %w", err)
+	}
+	var response llamaCPPResponse
+	if err := json.Unmarshal(data, &response); err != nil {
+		return Response{}, fmt.Errorf("failed to unmarshal response body: %w", err)
+	}
+	return response.response(false), nil
+}
+
+// AvailableModels returns the model loaded by the server from its OpenAI compatible /v1/models endpoint.
+func (l LlamaCPP) AvailableModels() ([]string, error) {
+	var models AvailableModels
+	if err := getJSON(l.endpoint("/v1/models"), &models); err != nil {
+		return nil, err
+	}
+
+	var modelIDs []string
+	for _, model := range models.Data {
+		modelIDs = append(modelIDs, model.ID)
+	}
+	return modelIDs, nil
+}
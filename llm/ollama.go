@@ -0,0 +1,122 @@
+package llm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+)
+
+// Ollama uses the native /api/chat endpoint of Ollama, e.g. Ollama{Host: url.URL{Scheme: "http", Host: "localhost:11434"}}.
+// A Request.ResponseFormat is sent as the format, either "json" or the schema.
+type Ollama struct {
+	Host  url.URL
+	Model string // used when the request doesn't have one
+}
+
+func LocalOllama(model string) Ollama {
+	return Ollama{Host: url.URL{Scheme: "http", Host: "localhost:11434"}, Model: model}
+}
+
+type ollamaRequest struct {
+	Model    string         `json:"model"`
+	Messages []Message      `json:"messages"`
+	Stream   bool           `json:"stream"`
+	Format   any            `json:"format,omitempty"`
+	Options  map[string]any `json:"options,omitempty"`
+}
+
+type ollamaResponse struct {
+	Model           string  `json:"model"`
+	Message         Message `json:"message"`
+	Done            bool    `json:"done"`
+	DoneReason      string  `json:"done_reason"`
+	PromptEvalCount int64   `json:"prompt_eval_count"`
+	EvalCount       int64   `json:"eval_count"`
+}
+
+func (o ollamaResponse) response(stream bool) Response {
+	return singleChoice(o.Model, o.Message.Content, o.DoneReason, o.PromptEvalCount, o.EvalCount, stream)
+}
+
+func (o Ollama) endpoint(path string) string {
+	endpoint := o.Host
+	endpoint.Path = path
+	return endpoint.String()
+}
+
+// model returns the model of the request, or the default Model.
+func (o Ollama) model(request *Request) string {
+	if request.Model == "" {
+		return o.Model
+	}
+	return request.Model
+}
+
+func (o Ollama) Infer(request *Request) (Response, error) {
+	body := ollamaRequest{
+		Model:    o.model(request),
+		Messages: request.Messages,
+		Stream:   request.Stream,
+		Options:  map[string]any{"temperature": request.Temperature},
+	}
+	if request.MaxTokens > 0 {
+		body.Options["num_predict"] = request.MaxTokens
+	}
+	switch {
+	case request.ResponseFormat != nil && request.ResponseFormat.JSONSchema != nil:
+		body.Format = request.ResponseFormat.JSONSchema.Schema
+	case request.JSONSchema != nil:
+		body.Format = request.JSONSchema
+	case request.ResponseFormat != nil && request.ResponseFormat.Type == ResponseFormatJSONObject:
+		body.Format = "json"
+	}
+
+	resp, err := postJSON(o.endpoint("/api/chat"), body, nil)
+	if err != nil {
+		return Response{}, fmt.Errorf("failed to make inference request: %w", err)
+	}
+
+	if request.Stream {
+		response, err := streamChunks(resp.Body, request, func(line []byte) (Response, bool, error) {
+			var chunk ollamaResponse
+			if err := json.Unmarshal(line, &chunk); err != nil {
+				return Response{}, false, err
+			}
+			return chunk.response(true), chunk.Done, nil
+		})
+		if err != nil {
+			return Response{}, fmt.Errorf("failed to handle streamed response: %w", err)
+		}
+		return response, nil
+	}
+
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return Response{}, fmt.Errorf("failed to read response body: %w", err)
+	}
+	var response ollamaResponse
+	if err := json.Unmarshal(data, &response); err != nil {
+		return Response{}, fmt.Errorf("failed to unmarshal response body: %w", err)
+	}
+	return response.response(false), nil
+}
+
+// AvailableModels returns the name of every model pulled in Ollama.
+func (o Ollama) AvailableModels() ([]string, error) {
+	var tags struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	if err := getJSON(o.endpoint("/api/tags"), &tags); err != nil {
+		return nil, err
+	}
+
+	var models []string
+	for _, model := range tags.Models {
+		models = append(models, model.Name)
+	}
+	return models, nil
+}
@@ -179,12 +179,17 @@ type Datum struct {
 
 type Permission struct{}
 
+// AvailableModels lists the models from the /models endpoint next to the chat completions endpoint.
 func (c Config) AvailableModels() ([]string, error) {
-	resp, err := http.Get(c.Endpoint.String())
+	endpoint := c.Endpoint
+	endpoint.Path = strings.TrimSuffix(strings.TrimSuffix(endpoint.Path, "/completions"), "/chat") + "/models"
+	resp, err := http.Get(endpoint.String())
 	if err != nil {
 		return nil, fmt.Errorf("failed to make request: %w", err)
 	}
 
+	defer resp.Body.Close()
+
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("request failed with status code %d", resp.StatusCode)
 	}
@@ -0,0 +1,346 @@
+package llm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+
+	"github.com/ellypaws/inkbunny-sd/utils"
+)
+
+// defaultTemplate is the system prompt of DefaultSystem, followed by the few-shot examples if there are any.
+const defaultTemplate = `{{.System}}
+{{- if .Examples}}
+
+Here are examples of descriptions and the JSON to output for them:
+{{- range .Examples}}
+
+Description:
+{{.Text}}
+JSON:
+{{.JSON}}
+{{- end}}
+{{- end}}`
+
+// Templates is the registry used by Prompter. It starts with the "default" template,
+// and more can be loaded with Templates.LoadDir.
+var Templates = mustTemplateRegistry()
+
+// Template is a named system prompt written with text/template and executed with TemplateData.
+// The Version defaults to a hash of the Text, and can be used as the Cache.Version.
+// A template with an Artist or Format is chosen by TemplateRegistry.For for that artist or format.
+type Template struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	Artist  string `json:"artist,omitempty"` // e.g. "AutoSnep"
+	Format  string `json:"format,omitempty"` // a utils.Format, e.g. "Description"
+	Text    string `json:"text"`
+
+	tmpl *texttemplate.Template
+}
+
+// TemplateData is what a Template is executed with.
+// System is the content of DefaultSystem, so that a template can extend the default prompt.
+type TemplateData struct {
+	System      string
+	Description string
+	Artist      string
+	Format      utils.Format
+	Examples    []Example
+}
+
+// Render executes the template and returns it as a system Message.
+func (t *Template) Render(data TemplateData) (Message, error) {
+	var b strings.Builder
+	if err := t.tmpl.Execute(&b, data); err != nil {
+		return Message{}, fmt.Errorf("error executing template %s: %w", t.Name, err)
+	}
+	return Message{Role: SystemRole, Content: b.String()}, nil
+}
+
+// textVersion is the version of a text that doesn't have one.
+func textVersion(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:6])
+}
+
+// TemplateRegistry holds the templates by name, and is safe for concurrent use.
+type TemplateRegistry struct {
+	mu        sync.RWMutex
+	templates []*Template
+}
+
+func mustTemplateRegistry() *TemplateRegistry {
+	var r TemplateRegistry
+	if err := r.Add(Template{Name: "default", Text: defaultTemplate}); err != nil {
+		panic(err)
+	}
+	return &r
+}
+
+// Load reads a JSON array of templates. A template with the same name as an existing one replaces it.
+func (r *TemplateRegistry) Load(reader io.Reader) error {
+	var templates []Template
+	if err := json.NewDecoder(reader).Decode(&templates); err != nil {
+		return fmt.Errorf("error decoding templates: %w", err)
+	}
+	for _, t := range templates {
+		if err := r.Add(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadFile reads a JSON file with Load, or any other file as the text of a template named after the file,
+// e.g. "autosnep.tmpl" is the template "autosnep".
+func (r *TemplateRegistry) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if filepath.Ext(path) == ".json" {
+		return r.Load(f)
+	}
+	text, err := io.ReadAll(f)
+	if err != nil {
+		return fmt.Errorf("error reading template %s: %w", path, err)
+	}
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	return r.Add(Template{Name: name, Text: string(text)})
+}
+
+// LoadDir loads every .json and .tmpl file in the directory with LoadFile.
+func (r *TemplateRegistry) LoadDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		switch filepath.Ext(entry.Name()) {
+		case ".json", ".tmpl":
+			if err := r.LoadFile(filepath.Join(dir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Add parses the template and registers it.
+func (r *TemplateRegistry) Add(t Template) error {
+	if t.Name == "" {
+		return errors.New("template is missing a name")
+	}
+	tmpl, err := texttemplate.New(t.Name).Parse(t.Text)
+	if err != nil {
+		return fmt.Errorf("error parsing template %s: %w", t.Name, err)
+	}
+	t.tmpl = tmpl
+	if t.Version == "" {
+		t.Version = textVersion(t.Text)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if i := slices.IndexFunc(r.templates, func(existing *Template) bool { return existing.Name == t.Name }); i >= 0 {
+		r.templates[i] = &t
+	} else {
+		r.templates = append(r.templates, &t)
+	}
+	return nil
+}
+
+// Get returns the template with the name.
+func (r *TemplateRegistry) Get(name string) (*Template, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, t := range r.templates {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// Names returns the name of every template.
+func (r *TemplateRegistry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, len(r.templates))
+	for i, t := range r.templates {
+		names[i] = t.Name
+	}
+	return names
+}
+
+// For returns the template of the artist if there is one, then the template of the format, then the "default" template.
+func (r *TemplateRegistry) For(artist string, format utils.Format) *Template {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var byFormat, fallback *Template
+	for _, t := range r.templates {
+		switch {
+		case artist != "" && strings.EqualFold(t.Artist, artist):
+			return t
+		case byFormat == nil && format != utils.FormatUnknown && strings.EqualFold(t.Format, string(format)):
+			byFormat = t
+		case t.Name == "default":
+			fallback = t
+		}
+	}
+	if byFormat != nil {
+		return byFormat
+	}
+	return fallback
+}
+
+// Example is a description and the JSON expected for it, from a txt/json pair in the format of llm/data.
+type Example struct {
+	Name string `json:"name"`
+	Text string `json:"text"`
+	JSON string `json:"json"`
+
+	words map[string]bool
+}
+
+// Examples are the few-shot examples to pick from with Similar.
+type Examples []Example
+
+// LoadExamples reads the pairs of name.txt and name.json in the directory of fsys, e.g. os.DirFS("llm/data").
+// A text file without a json file is skipped.
+func LoadExamples(fsys fs.FS) (Examples, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	var examples Examples
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".txt" {
+			continue
+		}
+		name := strings.TrimSuffix(entry.Name(), ".txt")
+		response, err := fs.ReadFile(fsys, name+".json")
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		text, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		examples = append(examples, Example{Name: name, Text: string(text), JSON: string(response), words: utils.Words(string(text))})
+	}
+	return examples, nil
+}
+
+// Similar returns the examples most similar to the description, by the Jaccard similarity of their words,
+// for as long as they fit in the budget of tokens. Examples without any word in common are never returned.
+func (e Examples) Similar(description string, budget int) []Example {
+	type scored struct {
+		example Example
+		score   float64
+	}
+	target := utils.Words(description)
+	var candidates []scored
+	for _, example := range e {
+		if example.words == nil {
+			example.words = utils.Words(example.Text)
+		}
+		if score := utils.Jaccard(target, example.words); score > 0 {
+			candidates = append(candidates, scored{example, score})
+		}
+	}
+	slices.SortStableFunc(candidates, func(a, b scored) int {
+		switch {
+		case a.score > b.score:
+			return -1
+		case a.score < b.score:
+			return 1
+		}
+		return strings.Compare(a.example.Name, b.example.Name)
+	})
+
+	var examples []Example
+	for _, c := range candidates {
+		tokens := utils.EstimateTokens(c.example.Text) + utils.EstimateTokens(c.example.JSON)
+		if tokens > budget {
+			continue
+		}
+		budget -= tokens
+		examples = append(examples, c.example)
+	}
+	return examples
+}
+
+// Prompter builds the requests of descriptions with the template for the artist or format,
+// and the Examples most similar to the description within the Budget.
+// The examples are rendered in the system prompt, or sent as user and assistant turns with AsMessages.
+type Prompter struct {
+	Templates  *TemplateRegistry // defaults to Templates
+	Examples   Examples
+	Budget     int // tokens of the examples, defaults to 1024
+	AsMessages bool
+}
+
+// Request returns the request of the description. Use BatchRequest for a Batch.
+func (p Prompter) Request(description, artist string, format utils.Format) (*Request, error) {
+	registry := p.Templates
+	if registry == nil {
+		registry = Templates
+	}
+	t := registry.For(artist, format)
+	if t == nil {
+		return nil, errors.New("no template for the request")
+	}
+	budget := p.Budget
+	if budget <= 0 {
+		budget = 1024
+	}
+
+	examples := p.Examples.Similar(description, budget)
+	data := TemplateData{System: DefaultSystem.Content, Description: description, Artist: artist, Format: format}
+	if !p.AsMessages {
+		data.Examples = examples
+	}
+	system, err := t.Render(data)
+	if err != nil {
+		return nil, err
+	}
+
+	request := DefaultRequest(description)
+	request.Messages = []Message{system}
+	if p.AsMessages {
+		for _, example := range examples {
+			request.Messages = append(request.Messages, UserMessage(example.Text), Message{Role: AssistantRole, Content: example.JSON})
+		}
+	}
+	request.Messages = append(request.Messages, UserMessage(description))
+	return request, nil
+}
+
+// BatchRequest returns a Batch.Request that builds the request of each description with Request,
+// falling back to DefaultRequest if the template fails to render.
+func (p Prompter) BatchRequest(artist string, format utils.Format) func(string) *Request {
+	return func(description string) *Request {
+		request, err := p.Request(description, artist, format)
+		if err != nil {
+			return DefaultRequest(description)
+		}
+		return request
+	}
+}
@@ -0,0 +1,146 @@
+package llm
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/ellypaws/inkbunny-sd/utils"
+)
+
+var exampleFS = fstest.MapFS{
+	"cat.txt":    {Data: []byte("a cat sitting on a chair, steps 20")},
+	"cat.json":   {Data: []byte(`{"prompt": "a cat sitting on a chair", "steps": 20}`)},
+	"dog.txt":    {Data: []byte("a dog running in a field")},
+	"dog.json":   {Data: []byte(`{"prompt": "a dog running in a field"}`)},
+	"house.txt":  {Data: []byte("watercolor house")},
+	"house.json": {Data: []byte(`{"prompt": "watercolor house"}`)},
+	"lone.txt":   {Data: []byte("a cat without a response")},
+}
+
+func TestExamples(t *testing.T) {
+	examples, err := LoadExamples(exampleFS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(examples) != 3 {
+		t.Fatalf("Expected 3 pairs, got %d", len(examples))
+	}
+
+	similar := examples.Similar("a black cat on a chair", 1024)
+	if len(similar) != 2 || similar[0].Name != "cat" || similar[1].Name != "dog" {
+		t.Errorf("Expected cat then dog, got %+v", similar)
+	}
+
+	if similar := examples.Similar("a black cat on a chair", 20); len(similar) != 1 || similar[0].Name != "dog" {
+		t.Errorf("Expected only dog to fit in the budget, got %+v", similar)
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	var registry TemplateRegistry
+	if err := registry.Add(Template{Name: "default", Text: defaultTemplate}); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"artists.json": `[
+			{"name": "autosnep", "artist": "AutoSnep", "text": "{{.System}}\nThe PNG text chunks are from {{.Artist}}."},
+			{"name": "infotext", "format": "A1111 infotext", "text": "Parse the {{.Format}}: {{.Description}}"}
+		]`,
+		"plain.tmpl": `{{.System}}`,
+		"notes.txt":  `not a template`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := registry.LoadDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if names := registry.Names(); len(names) != 4 {
+		t.Errorf("Expected 4 templates, got %v", names)
+	}
+	if version := registry.For("", utils.FormatUnknown).Version; version != textVersion(defaultTemplate) {
+		t.Errorf("Expected the version to be the hash of the text, got %s", version)
+	}
+
+	tests := []struct {
+		artist string
+		format utils.Format
+		want   string
+	}{
+		{"autosnep", utils.FormatInfotext, "autosnep"},
+		{"", utils.FormatInfotext, "infotext"},
+		{"someone", utils.FormatDescription, "default"},
+	}
+	for _, test := range tests {
+		if got := registry.For(test.artist, test.format).Name; got != test.want {
+			t.Errorf("For(%q, %q) = %s, want %s", test.artist, test.format, got, test.want)
+		}
+	}
+
+	infotext, ok := registry.Get("infotext")
+	if !ok {
+		t.Fatal("Expected the infotext template")
+	}
+	message, err := infotext.Render(TemplateData{Description: "steps: 20", Format: utils.FormatInfotext})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Role != SystemRole || message.Content != "Parse the A1111 infotext: steps: 20" {
+		t.Errorf("Unexpected message %+v", message)
+	}
+
+	if err := registry.Add(Template{Name: "broken", Text: "{{.System"}); err == nil {
+		t.Error("Expected an error for a template that doesn't parse")
+	}
+}
+
+func TestPrompter(t *testing.T) {
+	examples, err := LoadExamples(exampleFS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := Prompter{}.Request("a cat", "", utils.FormatUnknown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.Messages[0] != DefaultSystem || len(request.Messages) != 2 {
+		t.Errorf("Expected the default template without examples to be DefaultSystem, got %+v", request.Messages)
+	}
+
+	request, err = Prompter{Examples: examples}.Request("a cat on a chair", "", utils.FormatUnknown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(request.Messages[0].Content, `{"prompt": "a cat sitting on a chair", "steps": 20}`) {
+		t.Errorf("Expected the example in the system prompt, got %s", request.Messages[0].Content)
+	}
+
+	request, err = Prompter{Examples: examples, AsMessages: true}.Request("a cat on a chair", "", utils.FormatUnknown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(request.Messages) != 6 || request.Messages[1].Content != "a cat sitting on a chair, steps 20" || request.Messages[2].Role != AssistantRole {
+		t.Errorf("Expected the examples as turns, got %+v", request.Messages)
+	}
+	if last := request.Messages[len(request.Messages)-1]; last.Content != "a cat on a chair" {
+		t.Errorf("Expected the description last, got %+v", last)
+	}
+
+	var batch Batch
+	batch.Request = Prompter{Examples: examples}.BatchRequest("", utils.FormatUnknown)
+	if request := batch.Request("a cat on a chair"); !strings.Contains(request.Messages[0].Content, "a cat sitting on a chair") {
+		t.Errorf("Expected the batch request to use the template, got %+v", request.Messages)
+	}
+
+	if version := Templates.For("", utils.FormatUnknown).Version; version != textVersion(defaultTemplate) {
+		t.Errorf("Expected the default template to be versioned by its text, got %s", version)
+	}
+}
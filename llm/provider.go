@@ -0,0 +1,142 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Provider is an LLM backend. Config is the OpenAI compatible provider, while Ollama and LlamaCPP use the native APIs.
+// A Provider streams through Request.StreamChannel when Request.Stream is set, and closes the channel when done.
+type Provider interface {
+	Infer(request *Request) (Response, error)
+	AvailableModels() ([]string, error)
+}
+
+var (
+	_ Provider = Config{}
+	_ Provider = Ollama{}
+	_ Provider = LlamaCPP{}
+	_ Provider = (*Cache)(nil)
+)
+
+// postJSON makes a POST request with the body as JSON, and returns the response if the status is OK.
+func postJSON(endpoint string, body any, header http.Header) (*http.Response, error) {
+	requestBytes, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request data: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(requestBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make request: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("inference request failed with status code %d", resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// getJSON decodes the JSON of a GET request into v.
+func getJSON(endpoint string, v any) error {
+	resp, err := http.Get(endpoint)
+	if err != nil {
+		return fmt.Errorf("failed to make request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("request failed with status code %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to unmarshal response body: %w", err)
+	}
+	return nil
+}
+
+// streamChunks reads a stream of JSON chunks, either as newline delimited JSON or as server-sent events,
+// converts each one to a Response with chunk, and sends it through the channel of the request.
+// The returned Response has the content of every chunk as its message.
+func streamChunks(body io.ReadCloser, request *Request, chunk func(line []byte) (Response, bool, error)) (Response, error) {
+	defer body.Close()
+	if request.StreamChannel == nil {
+		return Response{}, errors.New("streaming request requires a channel")
+	}
+	defer close(request.StreamChannel)
+
+	var (
+		content strings.Builder
+		last    Response
+		chunks  int
+	)
+	reader := bufio.NewReader(body)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return Response{}, fmt.Errorf("failed to read line: %w", err)
+		}
+		line = bytes.TrimSpace(bytes.TrimPrefix(bytes.TrimSpace(line), []byte("data:")))
+		if len(line) > 0 && !bytes.Equal(line, []byte("[DONE]")) {
+			r, done, chunkErr := chunk(line)
+			if chunkErr != nil {
+				return Response{}, fmt.Errorf("failed to unmarshal response: %w", chunkErr)
+			}
+			request.StreamChannel <- &r
+			if len(r.Choices) > 0 {
+				content.WriteString(r.Choices[0].Delta.Content)
+			}
+			last, chunks = r, chunks+1
+			if done {
+				break
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+
+	if chunks == 0 {
+		return Response{}, errors.New("no responses received")
+	}
+	if len(last.Choices) == 0 {
+		last.Choices = []Choice{{}}
+	}
+	last.Choices[0].Message = Message{Role: AssistantRole, Content: content.String()}
+	return last, nil
+}
+
+// singleChoice is the Response of a backend that only returns one completion.
+func singleChoice(model, content, finishReason string, promptTokens, completionTokens int64, stream bool) Response {
+	choice := Choice{FinishReason: finishReason}
+	if stream {
+		choice.Delta = Message{Role: AssistantRole, Content: content}
+	} else {
+		choice.Message = Message{Role: AssistantRole, Content: content}
+	}
+	return Response{
+		Object:  "chat.completion",
+		Model:   model,
+		Choices: []Choice{choice},
+		Usage: Usage{
+			PromptTokens:     promptTokens,
+			CompletionTokens: completionTokens,
+			TotalTokens:      promptTokens + completionTokens,
+		},
+	}
+}
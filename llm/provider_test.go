@@ -0,0 +1,132 @@
+package llm
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func serve(t *testing.T, handler http.HandlerFunc) url.URL {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	host, _ := url.Parse(server.URL)
+	return *host
+}
+
+func TestOllama(t *testing.T) {
+	var sent ollamaRequest
+	host := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/tags":
+			fmt.Fprint(w, `{"models": [{"name": "llama3:8b"}, {"name": "qwen2.5:7b"}]}`)
+		case "/api/chat":
+			json.NewDecoder(r.Body).Decode(&sent)
+			if sent.Stream {
+				fmt.Fprintln(w, `{"model": "llama3:8b", "message": {"role": "assistant", "content": "{\"steps\":"}, "done": false}`)
+				fmt.Fprintln(w, `{"model": "llama3:8b", "message": {"role": "assistant", "content": " 20}"}, "done": true, "done_reason": "stop", "eval_count": 5}`)
+				return
+			}
+			fmt.Fprint(w, `{"model": "llama3:8b", "message": {"role": "assistant", "content": "{}"}, "done": true, "prompt_eval_count": 10, "eval_count": 2}`)
+		}
+	})
+	ollama := Ollama{Host: host, Model: "llama3:8b"}
+
+	models, err := ollama.AvailableModels()
+	if err != nil || len(models) != 2 || models[1] != "qwen2.5:7b" {
+		t.Fatalf("Unexpected models %v: %v", models, err)
+	}
+
+	response, err := ollama.Infer(DefaultRequest("a cat").WithResponseFormat("", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent.Format != "json" || sent.Model != "llama3:8b" || response.Choices[0].Message.Content != "{}" || response.Usage.TotalTokens != 12 {
+		t.Errorf("Unexpected request %+v or response %+v", sent, response)
+	}
+
+	request := StructuredRequest("a cat")
+	request.Stream = true
+	request.StreamChannel = make(chan *Response, 8)
+	response, err = ollama.Infer(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sent.Format.(map[string]any); !ok {
+		t.Errorf("Expected the schema as the format, got %v", sent.Format)
+	}
+	if response.Choices[0].Message.Content != `{"steps": 20}` || len(request.StreamChannel) != 2 {
+		t.Errorf("Unexpected streamed response %+v", response)
+	}
+}
+
+func TestLlamaCPP(t *testing.T) {
+	var sent llamaCPPRequest
+	host := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/models":
+			fmt.Fprint(w, `{"object": "list", "data": [{"id": "model.gguf"}]}`)
+		case "/completion":
+			json.NewDecoder(r.Body).Decode(&sent)
+			if sent.Stream {
+				fmt.Fprint(w, "data: {\"content\": \"{\\\"steps\\\":\", \"stop\": false}\n\n")
+				fmt.Fprint(w, "data: {\"content\": \" 20}\", \"stop\": true, \"tokens_predicted\": 4}\n\n")
+				return
+			}
+			fmt.Fprint(w, `{"content": "{}", "stop": true, "tokens_evaluated": 100, "tokens_predicted": 2}`)
+		}
+	})
+	llama := LlamaCPP{Host: host}
+
+	models, err := llama.AvailableModels()
+	if err != nil || len(models) != 1 || models[0] != "model.gguf" {
+		t.Fatalf("Unexpected models %v: %v", models, err)
+	}
+
+	request := DefaultRequest("a cat")
+	request.Grammar = TextToImageGrammar
+	response, err := llama.Infer(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent.Grammar != TextToImageGrammar || sent.NPredict != request.MaxTokens || response.Choices[0].FinishReason != "stop" {
+		t.Errorf("Unexpected request %+v or response %+v", sent, response)
+	}
+	if want := AlpacaTemplate(request.Messages); sent.Prompt != want {
+		t.Errorf("Expected the messages in the Alpaca template, got %q", sent.Prompt)
+	}
+
+	request = StructuredRequest("a cat")
+	request.Stream = true
+	request.StreamChannel = make(chan *Response, 8)
+	response, err = llama.Infer(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent.JSONSchema == nil || response.Choices[0].Message.Content != `{"steps": 20}` {
+		t.Errorf("Unexpected streamed request %+v or response %+v", sent, response)
+	}
+}
+
+func TestOpenAI(t *testing.T) {
+	host := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/models" {
+			fmt.Fprint(w, `{"object": "list", "data": [{"id": "gpt-4o-mini"}]}`)
+		}
+	})
+
+	config := OpenAI(host.String(), "key")
+	if config.Endpoint.Path != "/v1/chat/completions" || config.Host != host.Host {
+		t.Errorf("Unexpected config %+v", config)
+	}
+	models, err := config.AvailableModels()
+	if err != nil || len(models) != 1 || models[0] != "gpt-4o-mini" {
+		t.Errorf("Unexpected models %v: %v", models, err)
+	}
+	if config := OpenAI("localhost:1234", ""); config.Endpoint.String() != "http://localhost:1234/v1/chat/completions" {
+		t.Errorf("Unexpected endpoint %s", config.Endpoint.String())
+	}
+}
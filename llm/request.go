@@ -32,7 +32,12 @@ type Request struct {
 	Temperature   float64        `json:"temperature"`
 	MaxTokens     int64          `json:"max_tokens"`
 	Stream        bool           `json:"stream"`
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
 	StreamChannel chan *Response `json:"-"`
+
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+	JSONSchema     *Schema         `json:"json_schema,omitempty"` // llama.cpp server
+	Grammar        string          `json:"grammar,omitempty"`     // llama.cpp server, a GBNF grammar such as TextToImageGrammar
 }
 
 type Message struct {
@@ -70,4 +75,5 @@ type Usage struct {
 	PromptTokens     int64 `json:"prompt_tokens"`
 	CompletionTokens int64 `json:"completion_tokens"`
 	TotalTokens      int64 `json:"total_tokens"`
+	Cached           bool  `json:"cached,omitempty"` // the response was served by a Cache
 }
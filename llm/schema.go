@@ -0,0 +1,205 @@
+package llm
+
+import (
+	_ "embed"
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"github.com/ellypaws/inkbunny-sd/entities"
+)
+
+type ResponseFormatType string
+
+const (
+	ResponseFormatText       ResponseFormatType = "text"
+	ResponseFormatJSONObject ResponseFormatType = "json_object"
+	ResponseFormatJSONSchema ResponseFormatType = "json_schema"
+)
+
+// ResponseFormat is the OpenAI response_format of a Request.
+// With ResponseFormatJSONObject the model only outputs JSON, and with ResponseFormatJSONSchema it follows the schema.
+type ResponseFormat struct {
+	Type       ResponseFormatType `json:"type"`
+	JSONSchema *JSONSchema        `json:"json_schema,omitempty"`
+}
+
+type JSONSchema struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description,omitempty"`
+	Schema      *Schema `json:"schema"`
+	Strict      bool    `json:"strict,omitempty"`
+}
+
+// Schema is a JSON schema. Type is either a string or a list of types, e.g. ["string", "null"].
+type Schema struct {
+	Type                 any                `json:"type,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AdditionalProperties any                `json:"additionalProperties,omitempty"`
+	Enum                 []any              `json:"enum,omitempty"`
+}
+
+// SchemaOf returns the JSON schema of the value using reflection on its json tags.
+// Structs don't allow additional properties, pointers are nullable, and maps are objects of their element.
+func SchemaOf(v any) *Schema {
+	return schemaOf(reflect.TypeOf(v), make(map[reflect.Type]bool))
+}
+
+var rawMessage = reflect.TypeOf(json.RawMessage{})
+
+func schemaOf(t reflect.Type, seen map[reflect.Type]bool) *Schema {
+	if t == nil || t == rawMessage {
+		return &Schema{}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		s := schemaOf(t.Elem(), seen)
+		if typ, ok := s.Type.(string); ok {
+			s.Type = []string{typ, "null"}
+		}
+		return s
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: schemaOf(t.Elem(), seen)}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: schemaOf(t.Elem(), seen)}
+	case reflect.Struct:
+		if seen[t] {
+			// A recursive type can't be expanded, so it's left as any object
+			return &Schema{Type: "object"}
+		}
+		seen[t] = true
+		defer delete(seen, t)
+
+		s := &Schema{Type: "object", Properties: make(map[string]*Schema), AdditionalProperties: false}
+		addFields(s, t, seen)
+		return s
+	default:
+		return &Schema{}
+	}
+}
+
+func addFields(s *Schema, t reflect.Type, seen map[reflect.Type]bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" || !f.IsExported() && !f.Anonymous {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			addFields(s, f.Type, seen)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		s.Properties[name] = schemaOf(f.Type, seen)
+		if !strings.Contains(options, "omitempty") {
+			s.Required = append(s.Required, name)
+		}
+	}
+}
+
+// Pick returns a copy of the object schema with only the properties at the paths, e.g. "override_settings.sd_model_checkpoint".
+// The picked properties are required, so that a constrained model writes each of them.
+func (s *Schema) Pick(paths ...string) *Schema {
+	out := *s
+	out.Properties = make(map[string]*Schema)
+	out.Required = nil
+
+	nested := make(map[string][]string)
+	var order []string
+	for _, path := range paths {
+		name, rest, ok := strings.Cut(path, ".")
+		property, exists := s.Properties[name]
+		if !exists {
+			continue
+		}
+		if _, picked := nested[name]; !picked {
+			order = append(order, name)
+			nested[name] = nil
+		}
+		if ok {
+			nested[name] = append(nested[name], rest)
+		} else {
+			out.Properties[name] = property
+		}
+	}
+	for _, name := range order {
+		if rest := nested[name]; len(rest) > 0 && out.Properties[name] == nil {
+			out.Properties[name] = s.Properties[name].Pick(rest...)
+		}
+		out.Required = append(out.Required, name)
+	}
+	return &out
+}
+
+// textToImageFields are the fields asked for in the template of DefaultSystem.
+var textToImageFields = []string{
+	"steps", "width", "height", "seed", "n_iter", "batch_size",
+	"prompt", "negative_prompt", "sampler_name",
+	"override_settings.sd_model_checkpoint", "override_settings.sd_checkpoint_hash",
+	"cfg_scale", "comments", "denoising_strength",
+	"enable_hr", "hr_resize_x", "hr_resize_y", "hr_scale", "hr_second_pass_steps", "hr_upscaler",
+}
+
+// textToImageDescriptions are the comments of the template, so that a schema-constrained model gets the same hints.
+var textToImageDescriptions = map[string]string{
+	"n_iter":               "Also known as batch count",
+	"prompt":               "The positive prompt. Keep loras as is, e.g. <lora:MODELNAME:float>",
+	"negative_prompt":      "The negative prompt. Keep loras as is, e.g. <lora:MODELNAME:float>",
+	"cfg_scale":            "Not to be confused with CFG Rescale",
+	"comments":             "Put everything in the description from the input under \"description\"",
+	"hr_scale":             "Use 2 if not present",
+	"hr_second_pass_steps": "Use the same value as steps if not present",
+}
+
+// TextToImageSchema is the schema of the entities.TextToImageRequest fields in the template of DefaultSystem.
+var TextToImageSchema = textToImageSchema()
+
+func textToImageSchema() *Schema {
+	s := SchemaOf(entities.TextToImageRequest{}).Pick(textToImageFields...)
+	for name, description := range textToImageDescriptions {
+		s.Properties[name].Description = description
+	}
+	settings := s.Properties["override_settings"]
+	settings.Properties["sd_model_checkpoint"].Description = "Also known as model"
+	settings.Properties["sd_checkpoint_hash"].Description = "Also known as model hash"
+	return s
+}
+
+// TextToImageGrammar is a GBNF grammar of the template of DefaultSystem for llama.cpp compatible servers.
+//
+//go:embed schemas/schema.gbnf
+var TextToImageGrammar string
+
+// WithResponseFormat sets the response_format of the request, or json_object if the schema is nil.
+// Only the standard response_format is set, as OpenAI rejects unknown parameters. LlamaCPP sends its schema as the json_schema.
+func (r *Request) WithResponseFormat(name string, schema *Schema) *Request {
+	if schema == nil {
+		r.ResponseFormat = &ResponseFormat{Type: ResponseFormatJSONObject}
+		return r
+	}
+	r.ResponseFormat = &ResponseFormat{
+		Type:       ResponseFormatJSONSchema,
+		JSONSchema: &JSONSchema{Name: name, Schema: schema},
+	}
+	return r
+}
+
+// StructuredRequest is DefaultRequest constrained to TextToImageSchema, so that the model can't write comments or prose.
+func StructuredRequest(content string) *Request {
+	return DefaultRequest(content).WithResponseFormat("text_to_image_request", TextToImageSchema)
+}
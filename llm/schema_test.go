@@ -0,0 +1,77 @@
+package llm
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSchemaOf(t *testing.T) {
+	type node struct {
+		Name     string            `json:"name"`
+		Weight   *float64          `json:"weight,omitempty"`
+		Tags     []string          `json:"tags,omitempty"`
+		Extra    map[string]int    `json:"extra,omitempty"`
+		Children []node            `json:"children,omitempty"`
+		Raw      json.RawMessage   `json:"raw,omitempty"`
+		Ignored  string            `json:"-"`
+		Labels   map[string]string `json:"labels"`
+	}
+
+	s := SchemaOf(node{})
+	if s.Type != "object" || s.AdditionalProperties != false {
+		t.Fatalf("Expected a closed object, got %+v", s)
+	}
+	if _, ok := s.Properties["Ignored"]; ok {
+		t.Error("Expected the ignored field to be skipped")
+	}
+	if !slices.Equal(s.Required, []string{"name", "labels"}) {
+		t.Errorf("Expected the fields without omitempty to be required, got %v", s.Required)
+	}
+	if types, ok := s.Properties["weight"].Type.([]string); !ok || !slices.Equal(types, []string{"number", "null"}) {
+		t.Errorf("Expected a nullable number, got %v", s.Properties["weight"].Type)
+	}
+	if s.Properties["tags"].Items.Type != "string" || s.Properties["extra"].AdditionalProperties.(*Schema).Type != "integer" {
+		t.Errorf("Unexpected array or map schema %+v %+v", s.Properties["tags"], s.Properties["extra"])
+	}
+	if children := s.Properties["children"].Items; children.Type != "object" || children.Properties != nil {
+		t.Errorf("Expected a recursive type to be any object, got %+v", children)
+	}
+}
+
+func TestStructuredRequest(t *testing.T) {
+	request := StructuredRequest("Steps: 20")
+	if request.ResponseFormat == nil || request.ResponseFormat.Type != ResponseFormatJSONSchema || request.ResponseFormat.JSONSchema.Schema != TextToImageSchema {
+		t.Fatalf("Expected a json_schema response format, got %+v", request.ResponseFormat)
+	}
+
+	schema := TextToImageSchema
+	if len(schema.Properties) != len(schema.Required) || len(schema.Properties) != 19 {
+		t.Errorf("Expected every picked field to be required, got %d properties and %v", len(schema.Properties), schema.Required)
+	}
+	settings := schema.Properties["override_settings"]
+	if len(settings.Properties) != 2 || settings.Properties["sd_model_checkpoint"].Description == "" {
+		t.Errorf("Unexpected override_settings schema %+v", settings)
+	}
+
+	data, err := request.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{`"response_format":{"type":"json_schema"`, `"additionalProperties":false`, `"json_schema":{"name":"text_to_image_request"`} {
+		if !strings.Contains(string(data), expected) {
+			t.Errorf("Expected %s in %s", expected, data)
+		}
+	}
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(data, &keys); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := keys["json_schema"]; ok {
+		t.Error("Expected no top-level json_schema in a request sent to OpenAI compatible servers")
+	}
+	if !strings.Contains(TextToImageGrammar, "root ::=") {
+		t.Error("Expected the embedded grammar")
+	}
+}
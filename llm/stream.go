@@ -0,0 +1,243 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iter"
+	"net/http"
+	"strings"
+)
+
+// StreamOptions are the stream_options of a Request. IncludeUsage makes the server send a last chunk with the Usage.
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// Delta is a chunk of a streamed response from Config.Stream.
+// FinishReason is only set on the last chunk of a choice, and Usage only on the usage chunk.
+type Delta struct {
+	Index        int64           `json:"index"`
+	Model        string          `json:"model,omitempty"`
+	Role         Role            `json:"role,omitempty"`
+	Content      string          `json:"content,omitempty"`
+	ToolCalls    []ToolCallDelta `json:"tool_calls,omitempty"`
+	FinishReason string          `json:"finish_reason,omitempty"`
+	Usage        *Usage          `json:"usage,omitempty"`
+}
+
+// ToolCallDelta is a part of a tool call. The arguments of the calls with the same Index are concatenated.
+type ToolCallDelta struct {
+	Index    int64  `json:"index"`
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Function struct {
+		Name      string `json:"name,omitempty"`
+		Arguments string `json:"arguments,omitempty"`
+	} `json:"function"`
+}
+
+type streamChunk struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Index int64 `json:"index"`
+		Delta struct {
+			Role      Role            `json:"role"`
+			Content   string          `json:"content"`
+			ToolCalls []ToolCallDelta `json:"tool_calls"`
+		} `json:"delta"`
+		FinishReason *string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *Usage `json:"usage"`
+}
+
+// Stream makes a streaming request and yields each Delta as it arrives, without Request.StreamChannel.
+// The iteration stops when the server sends [DONE], when the caller stops ranging, or when the context is done,
+// in which case the context error is yielded.
+//
+//	for delta, err := range config.Stream(ctx, request) {
+//		if err != nil {
+//			return err
+//		}
+//		fmt.Print(delta.Content)
+//	}
+func (c Config) Stream(ctx context.Context, request *Request) iter.Seq2[Delta, error] {
+	return func(yield func(Delta, error) bool) {
+		r := *request
+		r.Stream = true
+		r.StreamChannel = nil
+		if r.StreamOptions == nil {
+			r.StreamOptions = &StreamOptions{IncludeUsage: true}
+		}
+
+		requestBytes, err := json.Marshal(&r)
+		if err != nil {
+			yield(Delta{}, fmt.Errorf("failed to marshal request data: %w", err))
+			return
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.Endpoint.String(), bytes.NewReader(requestBytes))
+		if err != nil {
+			yield(Delta{}, fmt.Errorf("failed to create request: %w", err))
+			return
+		}
+		req.Header.Add("Authorization", "Bearer "+c.APIKey)
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("Accept", "text/event-stream")
+
+		client := &http.Client{}
+		resp, err := client.Do(req)
+		if err != nil {
+			yield(Delta{}, contextError(ctx, fmt.Errorf("failed to make request: %w", err)))
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			yield(Delta{}, fmt.Errorf("inference request failed with status code %d", resp.StatusCode))
+			return
+		}
+
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if !bytes.HasPrefix(line, []byte("data:")) {
+				continue
+			}
+			line = bytes.TrimSpace(bytes.TrimPrefix(line, []byte("data:")))
+			if bytes.Equal(line, []byte("[DONE]")) {
+				return
+			}
+
+			var chunk streamChunk
+			if err := json.Unmarshal(line, &chunk); err != nil {
+				yield(Delta{}, fmt.Errorf("failed to unmarshal response: %w", err))
+				return
+			}
+			for _, choice := range chunk.Choices {
+				delta := Delta{
+					Index:     choice.Index,
+					Model:     chunk.Model,
+					Role:      choice.Delta.Role,
+					Content:   choice.Delta.Content,
+					ToolCalls: choice.Delta.ToolCalls,
+				}
+				if choice.FinishReason != nil {
+					delta.FinishReason = *choice.FinishReason
+				}
+				if !yield(delta, nil) {
+					return
+				}
+			}
+			if chunk.Usage != nil {
+				if !yield(Delta{Model: chunk.Model, Usage: chunk.Usage}, nil) {
+					return
+				}
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			yield(Delta{}, contextError(ctx, fmt.Errorf("failed to read line: %w", err)))
+			return
+		}
+		if err := ctx.Err(); err != nil {
+			yield(Delta{}, err)
+		}
+	}
+}
+
+// contextError returns the error of the context if it's done, as it's the reason the request failed.
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// ToolCall is a complete tool call built from its ToolCallDelta parts by CollectStream.
+type ToolCall struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// StreamResult is a streamed response built by CollectStream.
+type StreamResult struct {
+	Response
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+}
+
+// CollectStream builds the full response of a stream from Config.Stream.
+// The content of each choice is concatenated, and the tool call parts are joined by their index.
+// If the stream fails, the response so far is returned with the error.
+func CollectStream(stream iter.Seq2[Delta, error]) (StreamResult, error) {
+	var (
+		result   StreamResult
+		contents = make(map[int64]*strings.Builder)
+		calls    = make(map[int64]*ToolCall)
+		order    []int64
+	)
+	choice := func(index int64) *Choice {
+		for int64(len(result.Choices)) <= index {
+			result.Choices = append(result.Choices, Choice{Index: int64(len(result.Choices))})
+		}
+		return &result.Choices[index]
+	}
+
+	var streamErr error
+	for delta, err := range stream {
+		if err != nil {
+			streamErr = err
+			break
+		}
+		if delta.Model != "" {
+			result.Model = delta.Model
+		}
+		if delta.Usage != nil {
+			result.Usage = *delta.Usage
+			continue
+		}
+
+		c := choice(delta.Index)
+		if delta.Role != "" {
+			c.Message.Role = delta.Role
+		}
+		if delta.FinishReason != "" {
+			c.FinishReason = delta.FinishReason
+		}
+		if contents[delta.Index] == nil {
+			contents[delta.Index] = new(strings.Builder)
+		}
+		contents[delta.Index].WriteString(delta.Content)
+
+		for _, part := range delta.ToolCalls {
+			call, ok := calls[part.Index]
+			if !ok {
+				call = &ToolCall{}
+				calls[part.Index] = call
+				order = append(order, part.Index)
+			}
+			if part.ID != "" {
+				call.ID = part.ID
+			}
+			if part.Type != "" {
+				call.Type = part.Type
+			}
+			call.Name += part.Function.Name
+			call.Arguments += part.Function.Arguments
+		}
+	}
+
+	for index, content := range contents {
+		choice(index).Message.Content = content.String()
+	}
+	for _, index := range order {
+		result.ToolCalls = append(result.ToolCalls, *calls[index])
+	}
+	if streamErr == nil && len(result.Choices) == 0 {
+		streamErr = errors.New("no responses received")
+	}
+	return result, streamErr
+}
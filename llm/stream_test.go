@@ -0,0 +1,81 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestStreamDeltas(t *testing.T) {
+	host := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		for _, chunk := range []string{
+			`{"model": "m", "choices": [{"index": 0, "delta": {"role": "assistant", "content": "{\"steps\":"}, "finish_reason": null}]}`,
+			`{"model": "m", "choices": [{"index": 0, "delta": {"tool_calls": [{"index": 0, "id": "call_1", "type": "function", "function": {"name": "extract", "arguments": "{\"a\""}}]}}]}`,
+			`{"model": "m", "choices": [{"index": 0, "delta": {"content": " 20}", "tool_calls": [{"index": 0, "function": {"arguments": ": 1}"}}]}, "finish_reason": "stop"}]}`,
+			`{"model": "m", "choices": [], "usage": {"prompt_tokens": 10, "completion_tokens": 4, "total_tokens": 14}}`,
+			`[DONE]`,
+		} {
+			fmt.Fprintf(w, "data: %s\n\n", chunk)
+		}
+	})
+	config := OpenAI(host.String(), "")
+
+	var deltas int
+	for delta, err := range config.Stream(context.Background(), DefaultRequest("a cat")) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		deltas++
+		if delta.Content != "" {
+			break
+		}
+	}
+	if deltas != 1 {
+		t.Errorf("Expected the iteration to stop when the caller breaks, got %d deltas", deltas)
+	}
+
+	result, err := CollectStream(config.Stream(context.Background(), DefaultRequest("a cat")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Choices[0].Message.Content != `{"steps": 20}` || result.Choices[0].FinishReason != "stop" || result.Choices[0].Message.Role != AssistantRole {
+		t.Errorf("Unexpected choice %+v", result.Choices[0])
+	}
+	if result.Usage.TotalTokens != 14 || result.Model != "m" {
+		t.Errorf("Unexpected usage %+v", result.Usage)
+	}
+	if len(result.ToolCalls) != 1 || result.ToolCalls[0].ID != "call_1" || result.ToolCalls[0].Arguments != `{"a": 1}` {
+		t.Errorf("Unexpected tool calls %+v", result.ToolCalls)
+	}
+}
+
+func TestStreamCancel(t *testing.T) {
+	host := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "data: {\"choices\": [{\"index\": 0, \"delta\": {\"content\": \"a\"}}]}\n\n")
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	config := OpenAI(host.String(), "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var err error
+	for delta, e := range config.Stream(ctx, DefaultRequest("a cat")) {
+		if e != nil {
+			err = e
+			break
+		}
+		if delta.Content == "a" {
+			cancel()
+		}
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the stream to stop with context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,340 @@
+package sd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Architecture is the base model of a checkpoint or the model a LoRA was trained on.
+type Architecture string
+
+const (
+	ArchUnknown     Architecture = ""
+	ArchSD15        Architecture = "SD1.5"
+	ArchSD2         Architecture = "SD2"
+	ArchSDXL        Architecture = "SDXL"
+	ArchPony        Architecture = "Pony"        // SDXL based
+	ArchIllustrious Architecture = "Illustrious" // SDXL based
+	ArchSD3         Architecture = "SD3"
+	ArchFlux        Architecture = "Flux"
+)
+
+// Base returns the architecture the model is built on, e.g. ArchSDXL for ArchPony.
+func (a Architecture) Base() Architecture {
+	switch a {
+	case ArchPony, ArchIllustrious:
+		return ArchSDXL
+	}
+	return a
+}
+
+// NetworkType is the kind of LoRA. It's empty for a checkpoint.
+type NetworkType string
+
+const (
+	NetworkLoRA  NetworkType = "LoRA"
+	NetworkLoCon NetworkType = "LoCon" // a LoRA that also has the convolution layers
+	NetworkLoHa  NetworkType = "LoHa"
+	NetworkLoKr  NetworkType = "LoKr"
+	NetworkDoRA  NetworkType = "DoRA"
+)
+
+// ModelInfo is what Classify found from the tensor keys, their shapes and the metadata.
+// Rank and Alpha are only set for a LoRA. Alpha is 0 if it's only stored as a tensor, which ClassifySafetensors reads.
+type ModelInfo struct {
+	Architecture Architecture `json:"architecture"`
+	Network      NetworkType  `json:"network,omitempty"`
+	Rank         int          `json:"rank,omitempty"`
+	Alpha        float64      `json:"alpha,omitempty"`
+	TriggerWords []string     `json:"trigger_words,omitempty"`
+}
+
+// ClassifySafetensors reads the header of the file and classifies it, reading the alpha tensor of a LoRA if needed.
+func ClassifySafetensors(path string) (ModelInfo, error) {
+	header, err := ReadSafetensorsHeader(path)
+	if err != nil {
+		return ModelInfo{}, err
+	}
+	info := header.Classify()
+	if info.Network != "" && info.Alpha == 0 {
+		if alpha, err := readAlpha(path, header); err == nil {
+			info.Alpha = alpha
+		}
+	}
+	return info, nil
+}
+
+// Classify detects the architecture and network type from the tensor keys and the shape of the cross attention.
+// Pony and Illustrious can't be told apart from SDXL by their tensors, so they are detected from the metadata.
+func (h *SafetensorsHeader) Classify() ModelInfo {
+	keys := make([]string, 0, len(h.Tensors))
+	for key := range h.Tensors {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	info := ModelInfo{Architecture: h.architecture(keys), Network: network(keys)}
+	if info.Architecture == ArchSDXL {
+		info.Architecture = h.sdxlFinetune()
+	}
+	if info.Network != "" {
+		info.Rank, info.Alpha = h.rank(keys)
+		info.TriggerWords = h.triggerWords()
+	}
+	return info
+}
+
+func containsAny(keys []string, substrings ...string) bool {
+	return slices.ContainsFunc(keys, func(key string) bool {
+		return slices.ContainsFunc(substrings, func(s string) bool { return strings.Contains(key, s) })
+	})
+}
+
+// contextDim is the input size of the keys of the cross attention, which is the size of the text embeddings:
+// 768 for SD1.5, 1024 for SD2 and 2048 for SDXL.
+func (h *SafetensorsHeader) contextDim(keys []string) int64 {
+	for _, key := range keys {
+		if !strings.Contains(key, "attn2") || !strings.Contains(key, "to_k") {
+			continue
+		}
+		shape := h.Tensors[key].Shape
+		switch {
+		case strings.HasSuffix(key, "attn2.to_k.weight"),
+			strings.HasSuffix(key, "lora_down.weight"),
+			strings.HasSuffix(key, "lora.down.weight"),
+			strings.HasSuffix(key, "lora_A.weight"),
+			strings.HasSuffix(key, "hada_w1_b"):
+			if len(shape) >= 2 {
+				return shape[1]
+			}
+		}
+	}
+	return 0
+}
+
+func (h *SafetensorsHeader) architecture(keys []string) Architecture {
+	switch {
+	case containsAny(keys, "double_blocks", "single_blocks", "single_transformer_blocks"):
+		return ArchFlux
+	case containsAny(keys, "joint_blocks", "add_k_proj"):
+		return ArchSD3
+	}
+
+	switch h.contextDim(keys) {
+	case 2048:
+		return ArchSDXL
+	case 1024:
+		return ArchSD2
+	case 768:
+		return ArchSD15
+	}
+
+	switch {
+	case containsAny(keys, "conditioner.embedders", "label_emb", "lora_te1_", "lora_te2_", "text_encoder_2"):
+		return ArchSDXL
+	case containsAny(keys, "cond_stage_model.model.") || h.Metadata["ss_v2"] == "True":
+		return ArchSD2
+	case containsAny(keys, "cond_stage_model.transformer", "lora_te_", "lora_unet_down_blocks"):
+		return ArchSD15
+	}
+	return ArchUnknown
+}
+
+// sdxlFinetune looks for Pony or Illustrious in the model names of the metadata.
+func (h *SafetensorsHeader) sdxlFinetune() Architecture {
+	for _, key := range []string{"modelspec.architecture", "modelspec.title", "ss_sd_model_name", "ss_base_model_version"} {
+		value := strings.ToLower(h.Metadata[key])
+		switch {
+		case strings.Contains(value, "pony"):
+			return ArchPony
+		case strings.Contains(value, "illustrious"), strings.Contains(value, "noobai"):
+			return ArchIllustrious
+		}
+	}
+	return ArchSDXL
+}
+
+func network(keys []string) NetworkType {
+	switch {
+	case containsAny(keys, "dora_scale"):
+		return NetworkDoRA
+	case containsAny(keys, "hada_w1_a"):
+		return NetworkLoHa
+	case containsAny(keys, "lokr_w1"):
+		return NetworkLoKr
+	case !containsAny(keys, "lora_down", "lora.down", "lora_A"):
+		return ""
+	}
+	for _, key := range keys {
+		if isLoraDown(key) && slices.ContainsFunc(convLayers, func(layer string) bool { return strings.Contains(key, layer) }) {
+			return NetworkLoCon
+		}
+	}
+	return NetworkLoRA
+}
+
+// convLayers are the names of the convolution layers of the UNet in the diffusers and SGM naming, which only a LoCon trains.
+var convLayers = []string{"resnets", "samplers", "conv", "in_layers", "out_layers", "skip_connection", "_op."}
+
+func isLoraDown(key string) bool {
+	return strings.HasSuffix(key, "lora_down.weight") || strings.HasSuffix(key, "lora.down.weight") || strings.HasSuffix(key, "lora_A.weight")
+}
+
+// rank returns the ss_network_dim and ss_network_alpha of the metadata,
+// or the rank from the shape of the first down projection.
+func (h *SafetensorsHeader) rank(keys []string) (int, float64) {
+	rank, _ := strconv.Atoi(h.Metadata["ss_network_dim"])
+	alpha, _ := strconv.ParseFloat(h.Metadata["ss_network_alpha"], 64)
+	if rank > 0 {
+		return rank, alpha
+	}
+	for _, key := range keys {
+		shape := h.Tensors[key].Shape
+		switch {
+		case isLoraDown(key) && len(shape) > 0:
+			return int(shape[0]), alpha
+		case strings.HasSuffix(key, "hada_w1_a") && len(shape) > 1:
+			return int(shape[1]), alpha
+		}
+	}
+	return 0, alpha
+}
+
+// triggerWords returns the modelspec.trigger_phrase, or the tags that are in every caption of a dataset directory.
+// Without the image count of a directory, its most frequent tag is used.
+func (h *SafetensorsHeader) triggerWords() []string {
+	if phrase := h.Metadata["modelspec.trigger_phrase"]; phrase != "" {
+		var words []string
+		for _, word := range strings.Split(phrase, ",") {
+			if word = strings.TrimSpace(word); word != "" {
+				words = append(words, word)
+			}
+		}
+		return words
+	}
+
+	metadata, err := h.LoraMetadata()
+	if err != nil {
+		return nil
+	}
+	var words []string
+	for dir, tags := range metadata.SsTagFrequency {
+		type tagCount struct {
+			tag   string
+			count int
+		}
+		var counts []tagCount
+		for tag, count := range tags {
+			counts = append(counts, tagCount{strings.TrimSpace(tag), count})
+		}
+		slices.SortFunc(counts, func(a, b tagCount) int {
+			if a.count != b.count {
+				return b.count - a.count
+			}
+			return strings.Compare(a.tag, b.tag)
+		})
+		if len(counts) == 0 {
+			continue
+		}
+
+		images := metadata.SsDatasetDirs[dir].ImgCount
+		if images == 0 {
+			counts = counts[:1]
+		}
+		for _, c := range counts {
+			if images > 0 && c.count < images {
+				break
+			}
+			if !slices.Contains(words, c.tag) {
+				words = append(words, c.tag)
+			}
+		}
+	}
+	slices.Sort(words)
+	return words
+}
+
+// readAlpha reads the value of the first alpha tensor of a LoRA. At most 8 bytes are read, the size of an F64.
+func readAlpha(path string, header *SafetensorsHeader) (float64, error) {
+	var name string
+	for key := range header.Tensors {
+		if strings.HasSuffix(key, ".alpha") && (name == "" || key < name) {
+			name = key
+		}
+	}
+	if name == "" {
+		return 0, errors.New("no alpha tensor")
+	}
+	tensor := header.Tensors[name]
+
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	start, end := tensor.DataOffsets[0], tensor.DataOffsets[1]
+	if start < 0 || end < start {
+		return 0, fmt.Errorf("%w: alpha tensor %s has offsets %v", ErrInvalidOffsets, name, tensor.DataOffsets)
+	}
+	data := make([]byte, min(end-start, 8))
+	if _, err := file.ReadAt(data, 8+int64(header.Size)+start); err != nil && !errors.Is(err, io.EOF) {
+		return 0, err
+	}
+	return decodeScalar(tensor.DType, data)
+}
+
+func decodeScalar(dtype string, data []byte) (float64, error) {
+	switch {
+	case dtype == "F64" && len(data) >= 8:
+		return math.Float64frombits(binary.LittleEndian.Uint64(data)), nil
+	case dtype == "F32" && len(data) >= 4:
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(data))), nil
+	case dtype == "BF16" && len(data) >= 2:
+		return float64(math.Float32frombits(uint32(binary.LittleEndian.Uint16(data)) << 16)), nil
+	case dtype == "F16" && len(data) >= 2:
+		return float16(binary.LittleEndian.Uint16(data)), nil
+	}
+	return 0, fmt.Errorf("unsupported scalar of %s with %d bytes", dtype, len(data))
+}
+
+// float16 converts IEEE 754 half precision bits.
+func float16(bits uint16) float64 {
+	sign := 1.0
+	if bits&0x8000 != 0 {
+		sign = -1
+	}
+	exponent := int(bits>>10) & 0x1f
+	fraction := float64(bits & 0x3ff)
+	switch exponent {
+	case 0:
+		return sign * fraction / 1024 * math.Pow(2, -14)
+	case 0x1f:
+		if fraction != 0 {
+			return math.NaN()
+		}
+		return math.Inf(int(sign))
+	}
+	return sign * (1 + fraction/1024) * math.Pow(2, float64(exponent-15))
+}
+
+var ErrArchitectureMismatch = errors.New("architecture mismatch")
+
+// CheckCompatibility returns ErrArchitectureMismatch if the LoRA was trained on a different base than the checkpoint,
+// such as an SDXL LoRA on an SD1.5 checkpoint. Pony and Illustrious are compatible with SDXL, and unknown architectures are never flagged.
+func CheckCompatibility(lora, checkpoint ModelInfo) error {
+	if lora.Architecture == ArchUnknown || checkpoint.Architecture == ArchUnknown {
+		return nil
+	}
+	if lora.Architecture.Base() != checkpoint.Architecture.Base() {
+		return fmt.Errorf("%w: %s %s on a %s checkpoint", ErrArchitectureMismatch, lora.Architecture, lora.Network, checkpoint.Architecture)
+	}
+	return nil
+}
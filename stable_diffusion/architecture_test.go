@@ -0,0 +1,119 @@
+package sd
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		want    Architecture
+		network NetworkType
+		rank    int
+	}{
+		{
+			name: "SD1.5 checkpoint",
+			header: `{"model.diffusion_model.input_blocks.1.1.transformer_blocks.0.attn2.to_k.weight": {"dtype": "F16", "shape": [320, 768], "data_offsets": [0, 0]},
+				"cond_stage_model.transformer.text_model.embeddings.position_ids": {"dtype": "I64", "shape": [1, 77], "data_offsets": [0, 0]}}`,
+			want: ArchSD15,
+		},
+		{
+			name:   "SD2 checkpoint",
+			header: `{"model.diffusion_model.input_blocks.1.1.transformer_blocks.0.attn2.to_k.weight": {"dtype": "F16", "shape": [320, 1024], "data_offsets": [0, 0]}}`,
+			want:   ArchSD2,
+		},
+		{
+			name: "Pony checkpoint",
+			header: `{"__metadata__": {"modelspec.title": "Pony Diffusion V6 XL"},
+				"conditioner.embedders.1.model.ln_final.weight": {"dtype": "F16", "shape": [1280], "data_offsets": [0, 0]}}`,
+			want: ArchPony,
+		},
+		{
+			name:   "Flux checkpoint",
+			header: `{"double_blocks.0.img_attn.qkv.weight": {"dtype": "BF16", "shape": [9216, 3072], "data_offsets": [0, 0]}}`,
+			want:   ArchFlux,
+		},
+		{
+			name:   "SD3 checkpoint",
+			header: `{"model.diffusion_model.joint_blocks.0.x_block.attn.qkv.weight": {"dtype": "F16", "shape": [4608, 1536], "data_offsets": [0, 0]}}`,
+			want:   ArchSD3,
+		},
+		{
+			name: "SD1.5 LoRA",
+			header: `{"lora_unet_down_blocks_0_attentions_0_transformer_blocks_0_attn2_to_k.lora_down.weight": {"dtype": "F16", "shape": [16, 768], "data_offsets": [0, 0]},
+				"lora_unet_down_blocks_0_attentions_0_transformer_blocks_0_attn2_to_k.lora_up.weight": {"dtype": "F16", "shape": [320, 16], "data_offsets": [0, 0]}}`,
+			want: ArchSD15, network: NetworkLoRA, rank: 16,
+		},
+		{
+			name: "SDXL LoCon",
+			header: `{"__metadata__": {"ss_network_dim": "32", "ss_network_alpha": "16", "ss_base_model_version": "sdxl_base_v1-0"},
+				"lora_te1_text_model_encoder_layers_0_mlp_fc1.lora_down.weight": {"dtype": "F16", "shape": [32, 768], "data_offsets": [0, 0]},
+				"lora_unet_input_blocks_1_0_in_layers_2.lora_down.weight": {"dtype": "F16", "shape": [32, 320, 3, 3], "data_offsets": [0, 0]}}`,
+			want: ArchSDXL, network: NetworkLoCon, rank: 32,
+		},
+		{
+			name:   "SDXL LoHa",
+			header: `{"lora_unet_input_blocks_4_1_transformer_blocks_0_attn2_to_k.hada_w1_a": {"dtype": "F16", "shape": [640, 8], "data_offsets": [0, 0]}, "lora_unet_input_blocks_4_1_transformer_blocks_0_attn2_to_k.hada_w1_b": {"dtype": "F16", "shape": [8, 2048], "data_offsets": [0, 0]}}`,
+			want:   ArchSDXL, network: NetworkLoHa, rank: 8,
+		},
+		{
+			name:   "Flux LoKr",
+			header: `{"lora_unet_single_blocks_0_linear1.lokr_w1": {"dtype": "BF16", "shape": [4, 4], "data_offsets": [0, 0]}}`,
+			want:   ArchFlux, network: NetworkLoKr,
+		},
+		{
+			name: "Illustrious DoRA",
+			header: `{"__metadata__": {"ss_sd_model_name": "illustriousXL_v01.safetensors"},
+				"lora_te2_text_model_encoder_layers_0_mlp_fc1.lora_down.weight": {"dtype": "F16", "shape": [4, 1280], "data_offsets": [0, 0]},
+				"lora_te2_text_model_encoder_layers_0_mlp_fc1.dora_scale": {"dtype": "F16", "shape": [1, 1280], "data_offsets": [0, 0]}}`,
+			want: ArchIllustrious, network: NetworkDoRA, rank: 4,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			info, err := ClassifySafetensors(writeSafetensors(t, test.header, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Architecture != test.want || info.Network != test.network || info.Rank != test.rank {
+				t.Errorf("Expected %s %s rank %d, got %+v", test.want, test.network, test.rank, info)
+			}
+		})
+	}
+}
+
+func TestClassifySafetensors(t *testing.T) {
+	path := writeSafetensors(t, `{
+		"__metadata__": {
+			"ss_tag_frequency": "{\"10_fluffy\": {\"fluffy\": 20, \"solo\": 12, \" 1girl\": 20}}",
+			"ss_dataset_dirs": "{\"10_fluffy\": {\"n_repeats\": 10, \"img_count\": 20}}"
+		},
+		"lora_unet_down_blocks_0_attentions_0_transformer_blocks_0_attn2_to_k.alpha": {"dtype": "F16", "shape": [], "data_offsets": [0, 2]},
+		"lora_unet_down_blocks_0_attentions_0_transformer_blocks_0_attn2_to_k.lora_down.weight": {"dtype": "F16", "shape": [8, 768], "data_offsets": [2, 2]}
+	}`, []byte{0x00, 0x4c}) // 16 as a half float
+
+	info, err := ClassifySafetensors(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Architecture != ArchSD15 || info.Rank != 8 || info.Alpha != 16 {
+		t.Errorf("Expected an SD1.5 LoRA of rank 8 and alpha 16, got %+v", info)
+	}
+	if !slices.Equal(info.TriggerWords, []string{"1girl", "fluffy"}) {
+		t.Errorf("Expected the tags of every image as trigger words, got %v", info.TriggerWords)
+	}
+
+	checkpoint := ModelInfo{Architecture: ArchSD15}
+	if err := CheckCompatibility(ModelInfo{Architecture: ArchSDXL, Network: NetworkLoRA}, checkpoint); !errors.Is(err, ErrArchitectureMismatch) {
+		t.Errorf("Expected an SDXL LoRA on an SD1.5 checkpoint to mismatch, got %v", err)
+	}
+	if err := CheckCompatibility(ModelInfo{Architecture: ArchPony}, ModelInfo{Architecture: ArchSDXL}); err != nil {
+		t.Errorf("Expected a Pony LoRA to be compatible with SDXL, got %v", err)
+	}
+	if err := CheckCompatibility(info, ModelInfo{}); err != nil {
+		t.Errorf("Expected an unknown checkpoint not to be flagged, got %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+package sd
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ellypaws/inkbunny-sd/entities"
+)
+
+// maxHeaderSize is the largest safetensors header that is read, the same limit as the safetensors library.
+const maxHeaderSize = 100 * 1024 * 1024
+
+var (
+	ErrHeaderTooLarge = errors.New("safetensors header is too large")
+	ErrInvalidOffsets = errors.New("invalid tensor data offsets")
+)
+
+// Tensor is an entry of the tensor index of a safetensors file.
+// DataOffsets are the start and end of the tensor, relative to the end of the header.
+type Tensor struct {
+	DType       string   `json:"dtype"`
+	Shape       []int64  `json:"shape"`
+	DataOffsets [2]int64 `json:"data_offsets"`
+}
+
+// SafetensorsHeader is the JSON header of a safetensors file.
+// Size is the length of the header, so the tensor data starts at 8 + Size.
+type SafetensorsHeader struct {
+	Size     uint64
+	Tensors  map[string]Tensor
+	Metadata map[string]string // the __metadata__ of the header
+}
+
+// ReadSafetensorsHeader reads the header of a safetensors file without reading the tensors.
+func ReadSafetensorsHeader(path string) (*SafetensorsHeader, error) {
+	if path == "" {
+		return nil, ErrEmptyPath
+	}
+	if !strings.HasSuffix(path, ".safetensors") {
+		return nil, ErrNotSafeTensor
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	header, err := ParseSafetensorsHeader(file)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data := info.Size() - 8 - int64(header.Size)
+	for name, tensor := range header.Tensors {
+		if tensor.DataOffsets[1] > data {
+			return nil, fmt.Errorf("%w: tensor %s ends at %d past the %d bytes of data", ErrInvalidOffsets, name, tensor.DataOffsets[1], data)
+		}
+	}
+	return header, nil
+}
+
+// ParseSafetensorsHeader reads the 8-byte little-endian length and the JSON header that follows it.
+// The data offsets of each tensor are checked to be in order, but only ReadSafetensorsHeader knows the size of the file
+// to check that they're within it.
+func ParseSafetensorsHeader(r io.Reader) (*SafetensorsHeader, error) {
+	var length [8]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, fmt.Errorf("error reading header length: %w", err)
+	}
+	size := binary.LittleEndian.Uint64(length[:])
+	if size > maxHeaderSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrHeaderTooLarge, size)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("error reading header: %w", err)
+	}
+
+	var entries map[string]json.RawMessage
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNotSafeTensor, err)
+	}
+
+	header := &SafetensorsHeader{Size: size, Tensors: make(map[string]Tensor, len(entries))}
+	for name, entry := range entries {
+		if name == "__metadata__" {
+			if err := json.Unmarshal(entry, &header.Metadata); err != nil {
+				return nil, fmt.Errorf("error decoding __metadata__: %w", err)
+			}
+			continue
+		}
+		var tensor Tensor
+		if err := json.Unmarshal(entry, &tensor); err != nil {
+			return nil, fmt.Errorf("error decoding tensor %s: %w", name, err)
+		}
+		if start, end := tensor.DataOffsets[0], tensor.DataOffsets[1]; start < 0 || end < start {
+			return nil, fmt.Errorf("%w: tensor %s has offsets %v", ErrInvalidOffsets, name, tensor.DataOffsets)
+		}
+		header.Tensors[name] = tensor
+	}
+	return header, nil
+}
+
+// LoraMetadata decodes the ss_* keys of kohya-ss in the __metadata__ into entities.Metadata,
+// the same as the metadata of a lora from the WebUI.
+func (h *SafetensorsHeader) LoraMetadata() (entities.Metadata, error) {
+	var metadata entities.Metadata
+	if len(h.Metadata) == 0 {
+		return metadata, nil
+	}
+	data, err := json.Marshal(h.Metadata)
+	if err != nil {
+		return metadata, err
+	}
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return metadata, fmt.Errorf("error decoding metadata: %w", err)
+	}
+	return metadata, nil
+}
+
+// Parameters returns the number of parameters of every tensor.
+func (h *SafetensorsHeader) Parameters() int64 {
+	var total int64
+	for _, tensor := range h.Tensors {
+		count := int64(1)
+		for _, dim := range tensor.Shape {
+			count *= dim
+		}
+		total += count
+	}
+	return total
+}
@@ -0,0 +1,92 @@
+package sd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeSafetensors(t *testing.T, header string, data []byte) string {
+	t.Helper()
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, uint64(len(header)))
+	b.WriteString(header)
+	b.Write(data)
+	path := filepath.Join(t.TempDir(), "lora.safetensors")
+	if err := os.WriteFile(path, b.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadSafetensorsHeader(t *testing.T) {
+	path := writeSafetensors(t, `{
+		"__metadata__": {
+			"ss_output_name": "fluffy",
+			"ss_network_dim": "32",
+			"sshs_model_hash": "0123456789abcdef",
+			"ss_tag_frequency": "{\"10_fluffy\": {\"fluffy\": 20, \"solo\": 12}}",
+			"ss_dataset_dirs": "{\"10_fluffy\": {\"n_repeats\": 10, \"img_count\": 20}}"
+		},
+		"lora_unet_down.alpha": {"dtype": "F16", "shape": [], "data_offsets": [0, 2]},
+		"lora_unet_down.weight": {"dtype": "F16", "shape": [4, 8], "data_offsets": [2, 66]}
+	}`, make([]byte, 66))
+
+	header, err := ReadSafetensorsHeader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(header.Tensors) != 2 || header.Parameters() != 33 {
+		t.Errorf("Expected 2 tensors with 33 parameters, got %d and %d", len(header.Tensors), header.Parameters())
+	}
+	if tensor := header.Tensors["lora_unet_down.weight"]; tensor.DType != "F16" || tensor.DataOffsets != [2]int64{2, 66} {
+		t.Errorf("Unexpected tensor %+v", tensor)
+	}
+
+	metadata, err := header.LoraMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.SsOutputName == nil || *metadata.SsOutputName != "fluffy" || metadata.SsNetworkDim == nil || *metadata.SsNetworkDim != "32" {
+		t.Errorf("Unexpected metadata %+v", metadata)
+	}
+	if metadata.SshsModelHash == nil || *metadata.SshsModelHash != "0123456789abcdef" {
+		t.Errorf("Expected the model hash, got %v", metadata.SshsModelHash)
+	}
+	if metadata.SsTagFrequency["10_fluffy"]["solo"] != 12 {
+		t.Errorf("Expected the tag frequency to be decoded, got %v", metadata.SsTagFrequency)
+	}
+	if dir := metadata.SsDatasetDirs["10_fluffy"]; dir.NRepeats != 10 || dir.ImgCount != 20 {
+		t.Errorf("Expected the dataset dirs to be decoded, got %v", metadata.SsDatasetDirs)
+	}
+}
+
+func TestReadSafetensorsHeaderErrors(t *testing.T) {
+	if _, err := ReadSafetensorsHeader("model.ckpt"); !errors.Is(err, ErrNotSafeTensor) {
+		t.Errorf("Expected ErrNotSafeTensor, got %v", err)
+	}
+
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, uint64(maxHeaderSize+1))
+	if _, err := ParseSafetensorsHeader(&b); !errors.Is(err, ErrHeaderTooLarge) {
+		t.Errorf("Expected ErrHeaderTooLarge, got %v", err)
+	}
+
+	if _, err := ReadSafetensorsHeader(writeSafetensors(t, `not json`, nil)); !errors.Is(err, ErrNotSafeTensor) {
+		t.Errorf("Expected ErrNotSafeTensor for a header that isn't JSON, got %v", err)
+	}
+
+	for _, header := range []string{
+		`{"lora_unet_down.alpha": {"dtype": "F16", "shape": [], "data_offsets": [10, 2]}}`,
+		`{"lora_unet_down.alpha": {"dtype": "F16", "shape": [], "data_offsets": [-2, 2]}}`,
+		`{"lora_unet_down.alpha": {"dtype": "F16", "shape": [], "data_offsets": [0, 1099511627776]}}`,
+	} {
+		path := writeSafetensors(t, header, []byte{0x00, 0x4c})
+		if _, err := ClassifySafetensors(path); !errors.Is(err, ErrInvalidOffsets) {
+			t.Errorf("Expected ErrInvalidOffsets for %s, got %v", header, err)
+		}
+	}
+}
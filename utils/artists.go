@@ -0,0 +1,298 @@
+package utils
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+//go:embed artists.json
+var defaultArtists []byte
+
+// Artists is the registry consulted by the Processor functions and Parse.
+// It starts with the profiles in artists.json, and more can be loaded with Artists.Load.
+var Artists = mustArtistRegistry(defaultArtists)
+
+// ArtistProfile describes the text layout of a prolific uploader.
+// The key pattern starts a new image, skipped lines are ignored,
+// and the filename prefix is prepended to the key of every image.
+type ArtistProfile struct {
+	Name           string              `json:"name"`
+	UserID         int64               `json:"user_id,omitempty"`
+	Usernames      []string            `json:"usernames,omitempty"` // patterns matched against the username
+	Filenames      []string            `json:"filenames,omitempty"` // substrings of dataset file names, e.g. "_druge_"
+	Processor      string              `json:"processor"`           // one of "Common", "Sequential", "AutoSnep", "Cirn0", "Soph" or "RNSDAI"
+	KeyPattern     string              `json:"key_pattern,omitempty"`
+	SkipPatterns   []string            `json:"skip_patterns,omitempty"`
+	FilenamePrefix string              `json:"filename_prefix,omitempty"`
+	Prepend        string              `json:"prepend,omitempty"`
+	PrependIf      string              `json:"prepend_if,omitempty"` // "always", "start" when the text doesn't start with a key, or "missing" when no line is a key
+	Replace        []ArtistReplacement `json:"replace,omitempty"`
+	Transform      string              `json:"transform,omitempty"` // a built-in transform for layouts that need code, e.g. "cirn0"
+
+	usernames []*regexp.Regexp
+	key       *regexp.Regexp
+	skip      []*regexp.Regexp
+	replace   []*regexp.Regexp
+}
+
+type ArtistReplacement struct {
+	Pattern string `json:"pattern"`
+	With    string `json:"with"`
+}
+
+// artistTransforms are the layouts that can't be described by patterns alone.
+var artistTransforms = map[string]func(*Config){
+	"cirn0":       cirn0Transform,
+	"methuzalach": methuzalachTransform,
+	"soph":        sophTransform,
+}
+
+// artistProcessors are the Processor functions a profile can use.
+// Soph and RNSDAI don't return Params, so they are handled by Parse instead.
+var artistProcessors = map[string]Processor{
+	"Common":     Common,
+	"Sequential": Sequential,
+	"AutoSnep":   AutoSnep,
+	"Cirn0":      Cirn0,
+}
+
+func (p *ArtistProfile) compile() error {
+	if p.Name == "" {
+		return errors.New("artist profile is missing a name")
+	}
+	if _, ok := artistProcessors[p.Processor]; !ok && p.Processor != "Soph" && p.Processor != "RNSDAI" {
+		return fmt.Errorf("unknown processor %q for artist %s", p.Processor, p.Name)
+	}
+	switch p.PrependIf {
+	case "", "always", "start", "missing":
+	default:
+		return fmt.Errorf("unknown prepend_if %q for artist %s", p.PrependIf, p.Name)
+	}
+	if _, ok := artistTransforms[p.Transform]; !ok && p.Transform != "" {
+		return fmt.Errorf("unknown transform %q for artist %s", p.Transform, p.Name)
+	}
+
+	compile := func(patterns []string) ([]*regexp.Regexp, error) {
+		var out []*regexp.Regexp
+		for _, pattern := range patterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("error compiling pattern for artist %s: %w", p.Name, err)
+			}
+			out = append(out, re)
+		}
+		return out, nil
+	}
+
+	var err error
+	if p.usernames, err = compile(p.Usernames); err != nil {
+		return err
+	}
+	if p.skip, err = compile(p.SkipPatterns); err != nil {
+		return err
+	}
+	patterns := make([]string, len(p.Replace))
+	for i, r := range p.Replace {
+		patterns[i] = r.Pattern
+	}
+	if p.replace, err = compile(patterns); err != nil {
+		return err
+	}
+	if p.KeyPattern != "" {
+		if p.key, err = regexp.Compile(p.KeyPattern); err != nil {
+			return fmt.Errorf("error compiling key pattern for artist %s: %w", p.Name, err)
+		}
+	}
+	return nil
+}
+
+// GetProcessor returns the Processor of the profile, or nil for Soph and RNSDAI.
+func (p *ArtistProfile) GetProcessor() Processor {
+	return artistProcessors[p.Processor]
+}
+
+// apply sets the conditions of the profile and rewrites the text. It's called by the Processor functions
+// after every option, so the text is already set.
+func (p *ArtistProfile) apply(c *Config) {
+	if p.key != nil {
+		c.KeyCondition = p.key.MatchString
+	}
+	if len(p.skip) > 0 {
+		c.SkipCondition = func(line string) bool {
+			for _, re := range p.skip {
+				if re.MatchString(line) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	if p.FilenamePrefix != "" {
+		c.Filename = p.FilenamePrefix
+	}
+	for i, re := range p.replace {
+		c.Text = re.ReplaceAllLiteralString(c.Text, p.Replace[i].With)
+	}
+	if p.Prepend != "" {
+		switch p.PrependIf {
+		case "always":
+			c.Text = p.Prepend + "\n" + c.Text
+		case "start":
+			if line, _, _ := strings.Cut(c.Text, "\n"); p.key == nil || !p.key.MatchString(line) {
+				c.Text = p.Prepend + "\n" + c.Text
+			}
+		case "missing":
+			if !p.hasKey(c.Text) {
+				c.Text = p.Prepend + "\n" + c.Text
+			}
+		}
+	}
+	if transform, ok := artistTransforms[p.Transform]; ok {
+		transform(c)
+	}
+}
+
+func (p *ArtistProfile) hasKey(text string) bool {
+	if p.key == nil {
+		return false
+	}
+	for _, line := range strings.Split(text, "\n") {
+		if p.key.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// ArtistRegistry holds the artist profiles, and is safe for concurrent use.
+type ArtistRegistry struct {
+	mu       sync.RWMutex
+	profiles []*ArtistProfile
+}
+
+func mustArtistRegistry(data []byte) *ArtistRegistry {
+	var r ArtistRegistry
+	if err := r.Load(strings.NewReader(string(data))); err != nil {
+		panic(err)
+	}
+	return &r
+}
+
+// Load reads a JSON array of profiles. A profile with the same name as an existing one replaces it.
+func (r *ArtistRegistry) Load(reader io.Reader) error {
+	var profiles []*ArtistProfile
+	if err := json.NewDecoder(reader).Decode(&profiles); err != nil {
+		return fmt.Errorf("error decoding artist profiles: %w", err)
+	}
+	for _, p := range profiles {
+		if err := r.Add(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadFile reads the profiles from a JSON file using Load.
+func (r *ArtistRegistry) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return r.Load(f)
+}
+
+// Add compiles and registers the profile.
+func (r *ArtistRegistry) Add(p *ArtistProfile) error {
+	if err := p.compile(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, existing := range r.profiles {
+		if existing.Name == p.Name {
+			r.profiles[i] = p
+			return nil
+		}
+	}
+	r.profiles = append(r.profiles, p)
+	return nil
+}
+
+func (r *ArtistRegistry) find(match func(*ArtistProfile) bool) (*ArtistProfile, bool) {
+	if r == nil {
+		return nil, false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, p := range r.profiles {
+		if match(p) {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// ByName returns the profile with the exact name, e.g. "druge".
+func (r *ArtistRegistry) ByName(name string) (*ArtistProfile, bool) {
+	return r.find(func(p *ArtistProfile) bool { return p.Name == name })
+}
+
+// ByID returns the profile of the Inkbunny user ID.
+func (r *ArtistRegistry) ByID(id int64) (*ArtistProfile, bool) {
+	if id == 0 {
+		return nil, false
+	}
+	return r.find(func(p *ArtistProfile) bool { return p.UserID == id })
+}
+
+// ByUsername returns the first profile with a username pattern matching the username.
+func (r *ArtistRegistry) ByUsername(username string) (*ArtistProfile, bool) {
+	if username == "" {
+		return nil, false
+	}
+	return r.find(func(p *ArtistProfile) bool {
+		for _, re := range p.usernames {
+			if re.MatchString(username) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// ByFilename returns the first profile with a filename substring found in the file name.
+func (r *ArtistRegistry) ByFilename(filename string) (*ArtistProfile, bool) {
+	return r.find(func(p *ArtistProfile) bool {
+		for _, s := range p.Filenames {
+			if strings.Contains(filename, s) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// WithArtist makes the Processor use the layout of the profile.
+func WithArtist(p *ArtistProfile) func(*Config) {
+	return func(c *Config) {
+		c.Artist = p
+	}
+}
+
+// useArtist looks up the profile by name in Artists, for the UseX options.
+// The name is used rather than the user ID, so a loaded profile can change the ID and still replace the default.
+func useArtist(name string) func(*Config) {
+	return func(c *Config) {
+		if p, ok := Artists.ByName(name); ok {
+			c.Artist = p
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Attention is a chunk of prompt text with its emphasis weight.
+// A BREAK keyword is returned as its own chunk with a weight of -1.
+type Attention struct {
+	Text   string
+	Weight float64
+}
+
+const (
+	roundBracketMultiplier  = 1.1
+	squareBracketMultiplier = 1 / 1.1
+)
+
+var (
+	reAttention = regexp.MustCompile(`\\\(|\\\)|\\\[|\\]|\\\\|\\|\(|\[|:\s*([+-]?[.\d]+)\s*\)|\)|]|[^\\()\[\]:]+|:`)
+	reBreak     = regexp.MustCompile(`(?s)\s*\bBREAK\b\s*`)
+)
+
+// ParsePromptAttention parses a prompt into chunks of text with their emphasis weight.
+// It is a port of parse_prompt_attention in
+// https://github.com/AUTOMATIC1111/stable-diffusion-webui/blob/master/modules/prompt_parser.py
+//
+//	"a (cat:1.2) [dog]" -> [["a ", 1], ["cat", 1.2], [" ", 1], ["dog", 0.909]]
+func ParsePromptAttention(text string) []Attention {
+	var (
+		res            []Attention
+		roundBrackets  []int
+		squareBrackets []int
+	)
+
+	multiplyRange := func(start int, multiplier float64) {
+		for p := start; p < len(res); p++ {
+			res[p].Weight *= multiplier
+		}
+	}
+
+	for _, m := range reAttention.FindAllStringSubmatchIndex(text, -1) {
+		token := text[m[0]:m[1]]
+		var weight string
+		if m[2] != -1 {
+			weight = text[m[2]:m[3]]
+		}
+
+		switch {
+		case strings.HasPrefix(token, `\`):
+			res = append(res, Attention{token[1:], 1})
+		case token == "(":
+			roundBrackets = append(roundBrackets, len(res))
+		case token == "[":
+			squareBrackets = append(squareBrackets, len(res))
+		case weight != "" && len(roundBrackets) > 0:
+			w, err := strconv.ParseFloat(weight, 64)
+			if err != nil {
+				w = 1
+			}
+			multiplyRange(roundBrackets[len(roundBrackets)-1], w)
+			roundBrackets = roundBrackets[:len(roundBrackets)-1]
+		case token == ")" && len(roundBrackets) > 0:
+			multiplyRange(roundBrackets[len(roundBrackets)-1], roundBracketMultiplier)
+			roundBrackets = roundBrackets[:len(roundBrackets)-1]
+		case token == "]" && len(squareBrackets) > 0:
+			multiplyRange(squareBrackets[len(squareBrackets)-1], squareBracketMultiplier)
+			squareBrackets = squareBrackets[:len(squareBrackets)-1]
+		default:
+			for i, part := range reBreak.Split(token, -1) {
+				if i > 0 {
+					res = append(res, Attention{"BREAK", -1})
+				}
+				res = append(res, Attention{part, 1})
+			}
+		}
+	}
+
+	for _, pos := range roundBrackets {
+		multiplyRange(pos, roundBracketMultiplier)
+	}
+
+	for _, pos := range squareBrackets {
+		multiplyRange(pos, squareBracketMultiplier)
+	}
+
+	if len(res) == 0 {
+		return []Attention{{"", 1}}
+	}
+
+	// merge runs of identical weights
+	for i := 0; i+1 < len(res); {
+		if res[i].Weight == res[i+1].Weight {
+			res[i].Text += res[i+1].Text
+			res = append(res[:i+1], res[i+2:]...)
+		} else {
+			i++
+		}
+	}
+
+	return res
+}
+
+// UsesEmphasis reports whether any of the prompts has a weight other than 1 outside of BREAK keywords.
+// The webui uses this to assume "Emphasis: Original" when the infotext doesn't specify it.
+func UsesEmphasis(prompts ...string) bool {
+	for _, prompt := range prompts {
+		for _, attention := range ParsePromptAttention(prompt) {
+			if attention.Weight != 1 && attention.Text != "BREAK" {
+				return true
+			}
+		}
+	}
+	return false
+}
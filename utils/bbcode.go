@@ -0,0 +1,223 @@
+package utils
+
+import (
+	"regexp"
+	"strings"
+)
+
+// BBNode is a node of an Inkbunny BBCode document parsed by ParseBBCode.
+// Text nodes have an empty Tag, and the document itself has the tag "root".
+// Start and End are the byte offsets of the node in the description, including its tags.
+type BBNode struct {
+	Tag      string    `json:"tag,omitempty"`
+	Value    string    `json:"value,omitempty"` // the argument of [url=...], [q=...] or [color=...]
+	Text     string    `json:"text,omitempty"`  // only set for text nodes
+	Start    int       `json:"start"`
+	End      int       `json:"end"`
+	Children []*BBNode `json:"children,omitempty"`
+}
+
+// bbTags are the tags recognized by ParseBBCode. Anything else in brackets, like the [dog:cat:0.5] of a prompt, stays text.
+var bbTags = map[string]bool{
+	"b": true, "i": true, "u": true, "s": true, "t": true,
+	"q": true, "quote": true, "spoiler": true, "code": true,
+	"url": true, "color": true, "size": true,
+	"left": true, "center": true, "right": true,
+	"icon": true, "iconname": true, "name": true,
+}
+
+// bbBlocks are the tags an artist uses to delimit a prompt.
+var bbBlocks = map[string]bool{"q": true, "quote": true, "spoiler": true, "code": true}
+
+// bbHeaders are the tags used as a header before a section.
+var bbHeaders = map[string]bool{"b": true, "u": true, "t": true}
+
+var bbTag = regexp.MustCompile(`^\[(/?)([a-zA-Z]+)(?:=([^\]\n]*))?\]`)
+
+var (
+	positiveHeader = regexp.MustCompile(`(?i)^\s*(?:positive |pos )?prompts?\s*:?\s*$`)
+	negativeHeader = regexp.MustCompile(`(?i)^\s*neg(?:ative)?(?: prompts?)?\s*:?\s*$`)
+)
+
+// ParseBBCode tokenizes an Inkbunny description into a tree.
+// Unclosed tags are closed at the end of their parent, stray closing tags are kept as text,
+// and the content of [code] isn't parsed.
+func ParseBBCode(s string) *BBNode {
+	root := &BBNode{Tag: "root", End: len(s)}
+	stack := []*BBNode{root}
+
+	textStart := 0
+	flush := func(end int) {
+		if end > textStart {
+			top := stack[len(stack)-1]
+			top.Children = append(top.Children, &BBNode{Text: s[textStart:end], Start: textStart, End: end})
+		}
+	}
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '[' {
+			continue
+		}
+		m := bbTag.FindStringSubmatch(s[i:])
+		if m == nil {
+			continue
+		}
+		closing, tag, value := m[1] == "/", strings.ToLower(m[2]), m[3]
+		if !bbTags[tag] {
+			continue
+		}
+
+		if !closing {
+			flush(i)
+			node := &BBNode{Tag: tag, Value: value, Start: i}
+			top := stack[len(stack)-1]
+			top.Children = append(top.Children, node)
+			i += len(m[0]) - 1
+			textStart = i + 1
+
+			if tag == "code" {
+				end := strings.Index(strings.ToLower(s[textStart:]), "[/code]")
+				if end < 0 {
+					end = len(s) - textStart
+				}
+				node.Children = []*BBNode{{Text: s[textStart : textStart+end], Start: textStart, End: textStart + end}}
+				i = min(textStart+end+len("[/code]"), len(s)) - 1
+				node.End = i + 1
+				textStart = i + 1
+				continue
+			}
+			stack = append(stack, node)
+			continue
+		}
+
+		open := -1
+		for j := len(stack) - 1; j > 0; j-- {
+			if stack[j].Tag == tag {
+				open = j
+				break
+			}
+		}
+		if open < 0 {
+			continue
+		}
+		flush(i)
+		end := i + len(m[0])
+		for j := len(stack) - 1; j >= open; j-- {
+			stack[j].End = end
+		}
+		stack = stack[:open]
+		i = end - 1
+		textStart = end
+	}
+	flush(len(s))
+	for _, node := range stack[1:] {
+		node.End = len(s)
+	}
+
+	return root
+}
+
+// PlainText returns the text of the node and its children without any tags.
+func (n *BBNode) PlainText() string {
+	if n == nil {
+		return ""
+	}
+	if n.Tag == "" {
+		return n.Text
+	}
+	var b strings.Builder
+	for _, child := range n.Children {
+		b.WriteString(child.PlainText())
+	}
+	return b.String()
+}
+
+// Walk visits the node and its children in document order. Returning false skips the children.
+func (n *BBNode) Walk(visit func(node, parent *BBNode) bool) {
+	n.walk(nil, visit)
+}
+
+func (n *BBNode) walk(parent *BBNode, visit func(node, parent *BBNode) bool) {
+	if !visit(n, parent) {
+		return
+	}
+	for _, child := range n.Children {
+		child.walk(n, visit)
+	}
+}
+
+// Find returns every node with the tag in document order.
+func (n *BBNode) Find(tag string) []*BBNode {
+	var nodes []*BBNode
+	n.Walk(func(node, _ *BBNode) bool {
+		if node.Tag == tag {
+			nodes = append(nodes, node)
+		}
+		return true
+	})
+	return nodes
+}
+
+// Section returns the content after the first bold, underlined or title header matching the pattern.
+// If the header is followed by a quote, spoiler or code block, the block is the section,
+// e.g. "[b]Positive prompt[/b] [q]a cat[/q]". Otherwise, it's the text up to the next header in the same parent
+// or the next parameter key like "Negative prompt:" or "Steps:", e.g. "[q][b]Positive prompt:[/b] a cat[/q]".
+func (n *BBNode) Section(header *regexp.Regexp) (string, bool) {
+	section, _, ok := n.section(header)
+	return section, ok
+}
+
+// sectionEnd is a parameter key that ends a section without a block, as an infotext often follows the prompt.
+var sectionEnd = regexp.MustCompile(`(?i)\b(?:negative prompt|steps|sampler|schedule type|cfg scale|seed|size|model hash|model|clip skip|denoising strength)\s*:`)
+
+// section is Section that also reports whether the section is delimited,
+// either by the block after the header or by the block the header is in.
+func (n *BBNode) section(header *regexp.Regexp) (string, bool, bool) {
+	var (
+		parent *BBNode
+		index  = -1
+	)
+	n.Walk(func(node, p *BBNode) bool {
+		if index >= 0 {
+			return false
+		}
+		if p != nil && bbHeaders[node.Tag] && header.MatchString(Locales.Normalize(node.PlainText())) {
+			for i, child := range p.Children {
+				if child == node {
+					parent, index = p, i
+				}
+			}
+			return false
+		}
+		return true
+	})
+	if index < 0 {
+		return "", false, false
+	}
+
+	siblings := parent.Children[index+1:]
+	for _, sibling := range siblings {
+		if sibling.Tag == "" && strings.Trim(sibling.Text, " \t\r\n:-") == "" {
+			continue
+		}
+		if bbBlocks[sibling.Tag] {
+			section := strings.TrimSpace(sibling.PlainText())
+			return section, true, section != ""
+		}
+		break
+	}
+
+	var b strings.Builder
+	for _, sibling := range siblings {
+		if bbHeaders[sibling.Tag] && strings.TrimSpace(sibling.PlainText()) != "" {
+			break
+		}
+		b.WriteString(sibling.PlainText())
+	}
+	section := strings.TrimLeft(strings.TrimSpace(b.String()), ":-")
+	if loc := sectionEnd.FindStringIndex(section); loc != nil {
+		section = section[:loc[0]]
+	}
+	section = strings.TrimSpace(section)
+	return section, bbBlocks[parent.Tag], section != ""
+}
@@ -0,0 +1,311 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Sample is a training pair of the dataset. Artist decides the split of the sample, so that
+// every sample of an artist is in the same split. A sample without an Artist is split by its Name.
+// Description is the text of the Input without the file name, and is what duplicates are found by.
+type Sample struct {
+	Name        string `json:"name"`
+	Artist      string `json:"artist,omitempty"`
+	Instruction string `json:"instruction"`
+	Input       string `json:"input"`
+	Description string `json:"description,omitempty"` // the Input is used when empty
+	Response    string `json:"response"`
+}
+
+// datasetInstruction is the instruction of commonInstruction without its header.
+var datasetInstruction = strings.TrimSpace(strings.TrimPrefix(commonInstruction, "###Instruction: \n"))
+
+// DatasetSamples pairs the text and json files the same way as ParseDataset.
+// The files of an artist with a profile are split into a sample per image, and the artist is the name of the profile.
+// Other files use the username of an Inkbunny file name like "1234567_username_title.txt" as the artist,
+// and have no Artist if it isn't one. A text file without a json file has an empty Response.
+func DatasetSamples(text, json NameContent) []Sample {
+	var samples []Sample
+	input := func(name, s string) string {
+		return `The file name is: "` + name + "\"\n\n" + s
+	}
+	for name, content := range text {
+		// Because some artists already have standardized txt files, opt to split each file separately
+		if profile, ok := Artists.ByFilename(name); ok && profile.GetProcessor() != nil {
+			inputResponse := MapParams(profile.GetProcessor(), WithBytes(content), WithArtist(profile))
+			if inputResponse != nil {
+				for name, s := range inputResponse {
+					if s.Input == "" {
+						continue
+					}
+					samples = append(samples, Sample{
+						Name:        name,
+						Artist:      profile.Name,
+						Instruction: datasetInstruction,
+						Input:       input(name, s.Input),
+						Description: s.Input,
+						Response:    string(s.Response),
+					})
+				}
+				continue
+			}
+		}
+		samples = append(samples, Sample{
+			Name:        name,
+			Artist:      filenameArtist(name),
+			Instruction: datasetInstruction,
+			Input:       input(name, string(content)),
+			Description: string(content),
+			Response:    string(json[name]),
+		})
+	}
+	slices.SortFunc(samples, func(a, b Sample) int { return strings.Compare(a.Name, b.Name) })
+	return samples
+}
+
+// inkbunnyFilename is the name Inkbunny gives a file, which starts with the submission ID and the username.
+var inkbunnyFilename = regexp.MustCompile(`^\d+_([a-zA-Z0-9]+)_`)
+
+// filenameArtist returns the lowercase username of an Inkbunny file name, or "" if it isn't one.
+func filenameArtist(name string) string {
+	if m := inkbunnyFilename.FindStringSubmatch(filepath.Base(name)); m != nil {
+		return strings.ToLower(m[1])
+	}
+	return ""
+}
+
+// ExportFormat is the file format written by ExportDataset.
+type ExportFormat string
+
+const (
+	ExportChat       ExportFormat = "chat"       // JSONL of OpenAI {"messages": [...]}
+	ExportShareGPT   ExportFormat = "sharegpt"   // JSONL of {"conversations": [{"from": "human", "value": ...}]}
+	ExportAlpaca     ExportFormat = "alpaca"     // a JSON array of {"instruction", "input", "output"}
+	ExportCompletion ExportFormat = "completion" // JSONL of {"prompt", "completion"} in the ### Input/### Response format
+)
+
+// Splits are the fractions of the artists in each split. They are normalized to sum to 1.
+type Splits struct {
+	Train      float64 `json:"train"`
+	Validation float64 `json:"validation"`
+	Test       float64 `json:"test"`
+}
+
+var DefaultSplits = Splits{Train: 0.8, Validation: 0.1, Test: 0.1}
+
+// ExportOptions configures ExportDataset.
+// Duplicates is the Jaccard similarity of the words of two inputs above which the later sample is dropped,
+// where 0 only drops exact duplicates. The token lengths are estimated at four characters per token.
+type ExportOptions struct {
+	Format     ExportFormat
+	Splits     Splits  // defaults to DefaultSplits
+	Seed       string  // changes which artists go to which split
+	Duplicates float64 // e.g. 0.9
+	MinTokens  int     // zero is no minimum
+	MaxTokens  int     // zero is no maximum
+}
+
+// ManifestFile is a file written by ExportDataset.
+type ManifestFile struct {
+	Name    string `json:"name"`
+	Split   string `json:"split"`
+	Samples int    `json:"samples"`
+	Bytes   int    `json:"bytes"`
+	SHA256  string `json:"sha256"`
+}
+
+// Manifest is written by ExportDataset as manifest.json, with the counts of every step.
+type Manifest struct {
+	Format     ExportFormat   `json:"format"`
+	Splits     Splits         `json:"splits"`
+	Seed       string         `json:"seed,omitempty"`
+	Samples    int            `json:"samples"`
+	Empty      int            `json:"empty"`      // samples without a response
+	Duplicates int            `json:"duplicates"` // exact or near duplicates
+	Filtered   int            `json:"filtered"`   // outside of the token limits
+	Files      []ManifestFile `json:"files"`
+}
+
+var ErrUnknownExportFormat = errors.New("unknown export format")
+
+// ExportDataset writes the samples to dir as train, validation and test files in the format, and a manifest.json.
+// Samples without a response, duplicates and samples outside of the token limits are dropped first.
+// The split of an artist is decided by a hash of the seed and the artist, so it doesn't change between runs.
+func ExportDataset(dir string, samples []Sample, options ExportOptions) (Manifest, error) {
+	encode, ext, err := exportEncoder(options.Format)
+	if err != nil {
+		return Manifest{}, err
+	}
+	splits := options.Splits
+	if splits == (Splits{}) {
+		splits = DefaultSplits
+	}
+	manifest := Manifest{Format: options.Format, Splits: splits, Seed: options.Seed, Samples: len(samples)}
+
+	var kept []Sample
+	var seen []map[string]bool
+	exact := make(map[string]bool)
+	for _, s := range samples {
+		if strings.TrimSpace(s.Response) == "" {
+			manifest.Empty++
+			continue
+		}
+		tokens := EstimateTokens(s.Input) + EstimateTokens(s.Response)
+		if tokens < options.MinTokens || options.MaxTokens > 0 && tokens > options.MaxTokens {
+			manifest.Filtered++
+			continue
+		}
+		sum := sha256.Sum256([]byte(s.description()))
+		if exact[string(sum[:])] {
+			manifest.Duplicates++
+			continue
+		}
+		words := Words(s.description())
+		if options.Duplicates > 0 && slices.ContainsFunc(seen, func(other map[string]bool) bool {
+			return Jaccard(words, other) >= options.Duplicates
+		}) {
+			manifest.Duplicates++
+			continue
+		}
+		exact[string(sum[:])] = true
+		seen = append(seen, words)
+		kept = append(kept, s)
+	}
+
+	split := make(map[string][]Sample)
+	for _, s := range kept {
+		name := splits.of(options.Seed, s.artist())
+		split[name] = append(split[name], s)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return Manifest{}, err
+	}
+	for _, name := range []string{"train", "validation", "test"} {
+		data, err := encode(split[name])
+		if err != nil {
+			return Manifest{}, fmt.Errorf("error encoding %s split: %w", name, err)
+		}
+		file := name + ext
+		if err := os.WriteFile(filepath.Join(dir, file), data, 0o644); err != nil {
+			return Manifest{}, err
+		}
+		sum := sha256.Sum256(data)
+		manifest.Files = append(manifest.Files, ManifestFile{
+			Name:    file,
+			Split:   name,
+			Samples: len(split[name]),
+			Bytes:   len(data),
+			SHA256:  hex.EncodeToString(sum[:]),
+		})
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return Manifest{}, err
+	}
+	return manifest, os.WriteFile(filepath.Join(dir, "manifest.json"), data, 0o644)
+}
+
+func (s Sample) artist() string {
+	if s.Artist != "" {
+		return s.Artist
+	}
+	return s.Name
+}
+
+func (s Sample) description() string {
+	if s.Description != "" {
+		return s.Description
+	}
+	return s.Input
+}
+
+// of returns the split of the artist from a hash of the seed and the artist.
+func (s Splits) of(seed, artist string) string {
+	sum := sha256.Sum256([]byte(seed + "\x00" + artist))
+	total := s.Train + s.Validation + s.Test
+	point := float64(binary.BigEndian.Uint64(sum[:8])) / (1 << 64) * total
+	switch {
+	case point < s.Train:
+		return "train"
+	case point < s.Train+s.Validation:
+		return "validation"
+	default:
+		return "test"
+	}
+}
+
+func exportEncoder(format ExportFormat) (func([]Sample) ([]byte, error), string, error) {
+	type message struct {
+		Role    string `json:"role"`
+		Content string `json:"content"`
+	}
+	type turn struct {
+		From  string `json:"from"`
+		Value string `json:"value"`
+	}
+	switch format {
+	case ExportChat:
+		return jsonLines(func(s Sample) any {
+			return map[string][]message{"messages": {
+				{Role: "system", Content: s.Instruction},
+				{Role: "user", Content: s.Input},
+				{Role: "assistant", Content: s.Response},
+			}}
+		}), ".jsonl", nil
+	case ExportShareGPT:
+		return jsonLines(func(s Sample) any {
+			return map[string][]turn{"conversations": {
+				{From: "system", Value: s.Instruction},
+				{From: "human", Value: s.Input},
+				{From: "gpt", Value: s.Response},
+			}}
+		}), ".jsonl", nil
+	case ExportCompletion:
+		return jsonLines(func(s Sample) any {
+			return map[string]string{
+				"prompt":     "###Instruction: \n" + s.Instruction + "\n\n### Input:\n" + s.Input + "\n\n### Response:\n",
+				"completion": s.Response,
+			}
+		}), ".jsonl", nil
+	case ExportAlpaca:
+		return func(samples []Sample) ([]byte, error) {
+			type alpaca struct {
+				Instruction string `json:"instruction"`
+				Input       string `json:"input"`
+				Output      string `json:"output"`
+			}
+			out := make([]alpaca, len(samples))
+			for i, s := range samples {
+				out[i] = alpaca{Instruction: s.Instruction, Input: s.Input, Output: s.Response}
+			}
+			return json.MarshalIndent(out, "", "  ")
+		}, ".json", nil
+	}
+	return nil, "", fmt.Errorf("%w: %q", ErrUnknownExportFormat, format)
+}
+
+func jsonLines(line func(Sample) any) func([]Sample) ([]byte, error) {
+	return func(samples []Sample) ([]byte, error) {
+		var b bytes.Buffer
+		encoder := json.NewEncoder(&b)
+		encoder.SetEscapeHTML(false)
+		for _, s := range samples {
+			if err := encoder.Encode(line(s)); err != nil {
+				return nil, err
+			}
+		}
+		return b.Bytes(), nil
+	}
+}
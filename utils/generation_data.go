@@ -0,0 +1,183 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+
+	"github.com/ellypaws/inkbunny-sd/entities"
+)
+
+// GenerationData is the kind of metadata found by DetectGenerationData.
+type GenerationData string
+
+const (
+	GenerationDataUnknown     GenerationData = ""
+	GenerationDataFooocus     GenerationData = "Fooocus"
+	GenerationDataFooocusLog  GenerationData = "Fooocus log.html"
+	GenerationDataSwarmUI     GenerationData = "SwarmUI"
+	GenerationDataCivitai     GenerationData = "Civitai"
+	GenerationDataCivitaiText GenerationData = "Civitai infotext"
+)
+
+// DetectGenerationData sniffs the blob for the Fooocus, SwarmUI and Civitai formats.
+// JSON is recognized by its keys, log.html by its table rows,
+// and the Civitai copy-paste block by its "Civitai resources" key.
+func DetectGenerationData(blob []byte) GenerationData {
+	blob = bytes.TrimSpace(blob)
+	if len(blob) == 0 {
+		return GenerationDataUnknown
+	}
+
+	if blob[0] == '{' {
+		var keys map[string]json.RawMessage
+		if err := json.Unmarshal(blob, &keys); err != nil {
+			return GenerationDataUnknown
+		}
+		has := func(key string) bool {
+			_, ok := keys[key]
+			return ok
+		}
+		switch {
+		case has("sui_image_params"):
+			return GenerationDataSwarmUI
+		case string(keys["metadata_scheme"]) == `"fooocus"`,
+			has("guidance_scale") && has("sharpness"),
+			has("performance") && has("styles"):
+			return GenerationDataFooocus
+		case has("civitaiResources"),
+			has("resources") && (has("cfgScale") || has("negativePrompt")):
+			return GenerationDataCivitai
+		}
+		return GenerationDataUnknown
+	}
+
+	switch {
+	case bytes.Contains(blob, []byte(`<td class='key'>`)), bytes.Contains(blob, []byte(`<td class="key">`)):
+		return GenerationDataFooocusLog
+	case bytes.Contains(blob, []byte("Civitai resources: ")), bytes.Contains(blob, []byte("Civitai metadata: ")):
+		return GenerationDataCivitaiText
+	}
+
+	return GenerationDataUnknown
+}
+
+// GenerationDataHeuristics routes the blob to the Fooocus, SwarmUI or Civitai parser using DetectGenerationData.
+func GenerationDataHeuristics(blob []byte) (entities.TextToImageRequest, error) {
+	switch kind := DetectGenerationData(blob); kind {
+	case GenerationDataFooocus:
+		fooocus, err := entities.UnmarshalFooocus(blob)
+		if err != nil {
+			return entities.TextToImageRequest{}, fmt.Errorf("error parsing %s metadata: %w", kind, err)
+		}
+		return *fooocus.Convert(), nil
+	case GenerationDataFooocusLog:
+		fooocus, err := entities.UnmarshalFooocusLog(blob)
+		if err != nil {
+			return entities.TextToImageRequest{}, fmt.Errorf("error parsing %s: %w", kind, err)
+		}
+		return *fooocus.Convert(), nil
+	case GenerationDataSwarmUI:
+		swarm, err := entities.UnmarshalSwarmUI(blob)
+		if err != nil {
+			return entities.TextToImageRequest{}, fmt.Errorf("error parsing %s metadata: %w", kind, err)
+		}
+		return *swarm.Convert(), nil
+	case GenerationDataCivitai:
+		civitai, err := entities.UnmarshalCivitai(blob)
+		if err != nil {
+			return entities.TextToImageRequest{}, fmt.Errorf("error parsing %s metadata: %w", kind, err)
+		}
+		return *civitai.Convert(), nil
+	case GenerationDataCivitaiText:
+		return CivitaiHeuristics(string(blob))
+	default:
+		return entities.TextToImageRequest{}, errors.New("unknown generation data")
+	}
+}
+
+// CivitaiHeuristics parses the generation data copied from Civitai.
+// It is an infotext with the JSON "Civitai resources: [...]" and "Civitai metadata: {...}" keys,
+// which are cut out before the rest is parsed by ParameterHeuristics.
+func CivitaiHeuristics(parameters string) (entities.TextToImageRequest, error) {
+	var civitai entities.Civitai
+
+	resources, parameters := cutJSONKey(parameters, "Civitai resources: ")
+	if resources != "" {
+		if err := json.Unmarshal([]byte(resources), &civitai.CivitaiResources); err != nil {
+			return entities.TextToImageRequest{}, fmt.Errorf("error parsing Civitai resources: %w", err)
+		}
+	}
+	_, parameters = cutJSONKey(parameters, "Civitai metadata: ")
+
+	request, err := ParameterHeuristics(parameters)
+	if err != nil {
+		return request, err
+	}
+
+	if comments := civitai.Convert().Comments; len(comments) > 0 {
+		if request.Comments == nil {
+			request.Comments = make(map[string]string)
+		}
+		maps.Copy(request.Comments, comments)
+	}
+
+	return request, nil
+}
+
+// cutJSONKey removes the key and its JSON value from the infotext, along with the preceding ", ".
+// It returns the JSON value and the rest of the text.
+func cutJSONKey(s, key string) (string, string) {
+	start := strings.Index(s, key)
+	if start < 0 {
+		return "", s
+	}
+	value := start + len(key)
+	end := jsonEnd(s[value:])
+	if end < 0 {
+		return "", s
+	}
+	end += value
+
+	before := strings.TrimSuffix(s[:start], ", ")
+	after := s[end:]
+	if before == "" || strings.HasSuffix(before, "\n") {
+		after = strings.TrimPrefix(after, ", ")
+	}
+	return s[value:end], before + after
+}
+
+// jsonEnd returns the index after the object or array at the start of s, or -1 if it isn't closed.
+func jsonEnd(s string) int {
+	if s == "" || (s[0] != '[' && s[0] != '{') {
+		return -1
+	}
+	var (
+		depth    int
+		inString bool
+		escaped  bool
+	)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case escaped:
+			escaped = false
+		case inString && c == '\\':
+			escaped = true
+		case c == '"':
+			inString = !inString
+		case inString:
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return -1
+}
@@ -1,15 +1,18 @@
 package utils
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/ellypaws/inkbunny-sd/entities"
 	"math"
+	"regexp"
 	"strconv"
 	"strings"
 )
 
 func DescriptionHeuristics(description string) (entities.TextToImageRequest, error) {
+	tree := ParseBBCode(description)
 	description = CleanText(description)
 
 	if description := ParametersStart.FindString(description); description != "" {
@@ -55,6 +58,15 @@ func DescriptionHeuristics(description string) (entities.TextToImageRequest, err
 
 	request.Prompt = ExtractPositivePrompt(description)
 	request.NegativePrompt = ExtractNegativePrompt(description)
+
+	// A prompt delimited by BBCode, e.g. "[b]Positive prompt[/b] [q]...[/q]", is more precise than the regex,
+	// while the text after a header is only a fallback for when the regex found nothing.
+	if prompt, delimited, ok := tree.section(positiveHeader); ok && (delimited || request.Prompt == "") {
+		request.Prompt = prompt
+	}
+	if negative, delimited, ok := tree.section(negativeHeader); ok && (delimited || request.NegativePrompt == "") {
+		request.NegativePrompt = negative
+	}
 	return request, nil
 }
 
@@ -64,10 +76,8 @@ func RNSDAIHeuristics(description string) (entities.TextToImageRequest, error) {
 	var request entities.TextToImageRequest
 
 	fieldsToSet := map[string]any{
-		"model":    &request.OverrideSettings.SDModelCheckpoint,
-		"seed":     &request.Seed,
-		"prompt":   &request.Prompt,
-		"negative": &request.NegativePrompt,
+		"model": &request.OverrideSettings.SDModelCheckpoint,
+		"seed":  &request.Seed,
 	}
 
 	err := ResultsToFields(results, fieldsToSet)
@@ -75,6 +85,15 @@ func RNSDAIHeuristics(description string) (entities.TextToImageRequest, error) {
 		return request, err
 	}
 
+	// The prompts are in a quote after a bold header, e.g. "[q][b]Positive prompt:[/b]\n...\n[/q]"
+	tree := ParseBBCode(description)
+	if prompt, ok := tree.Section(positiveHeader); ok {
+		request.Prompt = prompt
+	}
+	if negative, ok := tree.Section(negativeHeader); ok {
+		request.NegativePrompt = negative
+	}
+
 	return request, nil
 }
 
@@ -100,59 +119,76 @@ func ParameterHeuristics(parameters string) (entities.TextToImageRequest, error)
 	positive, negative := GetPrompts(lines[:len(lines)-1])
 
 	// Extract key value pairs
-	results := ExtractDefaultKeys(parameters, DefaultResults())
-
-	if sizes, ok := results["Size"]; ok {
-		for i, size := range strings.Split(sizes, "x") {
-			switch i {
-			case 0:
-				results["Width"] = size
-			case 1:
-				results["Height"] = size
-			}
-		}
+	results := ExtractKeys(parameters)
+	splitImageSizes(results)
+
+	version := ParseInfotextVersion(results["Version"], results["App"])
+	if version.WebUI == WebUIA1111 && !strings.HasPrefix(version.Raw, "v") {
+		results["Version"] = "v" + version.Raw
 	}
 
 	restoreOldHiresFixParams(results, false)
+	infotextBackcompat(results, version, positive.String())
+
+	if _, ok := results["Emphasis"]; !ok && version.WebUI != WebUISDNext && UsesEmphasis(positive.String(), negative.String()) {
+		results["Emphasis"] = "Original"
+	}
 
-	if version, ok := results["Version"]; ok {
-		if !strings.HasPrefix(version, "v") {
-			results["Version"] = "v" + version
+	for key, value := range DefaultResults() {
+		if _, ok := results[key]; !ok {
+			results[key] = value
 		}
-		// Not used for now and should manually add a "Schedule type" if version of local Stable Diffusion is >= 1.7.0
-		// semver is still not in standard go library, avoid using it for now
-		// Check if the version is less than 1.7.0 then set "Downcast to fp16" to true'
-		//if semver.Compare(version, "v1.7.0-225") < 0 {
-		//	results["Downcast to fp16"] = "True"
-		//} else {
-		//	if sampler, ok := results["Sampler"]; ok {
-		//		for _, schedulers := range []string{
-		//			"Uniform",
-		//			"Karras",
-		//			"Exponential",
-		//			"Polyexponential",
-		//			"SGM Uniform",
-		//		} {
-		//			if strings.HasSuffix(sampler, schedulers) {
-		//				results["Sampler"] = strings.TrimSuffix(sampler, schedulers)
-		//				results["Schedule type"] = schedulers
-		//				break
-		//			}
-		//		}
-		//	}
-		//}
 	}
 
+	results["Width"] = results["Size-1"]
+	results["Height"] = results["Size-2"]
+
 	var request entities.TextToImageRequest
 	err := ResultsToFields(results, TextToImageFields(&request))
 	if err != nil {
 		return request, err
 	}
 
+	err = ScriptHeuristics(results, &request.Scripts)
+	if err != nil {
+		return request, err
+	}
+
+	switch request.OverrideSettings.Emphasis {
+	case "Original", "No norm":
+		request.OverrideSettings.EnableEmphasis = true
+	}
+
+	// The webui only ticks hires fix when pasting if these are present
+	_, upscale := results["Hires upscale"]
+	_, upscaler := results["Hires upscaler"]
+	_, resize := results["Hires resize-1"]
+	request.EnableHr = results["Denoising strength"] != "" && (upscale || upscaler || resize)
+
 	if hypernet, ok := results["Hypernet"]; ok {
 		positive.WriteString(fmt.Sprintf("<hypernet:%s:%s>", hypernet, results["Hypernet strength"]))
 	}
 
+	hashHeuristics(results, &request)
+
+	request.Prompt = positive.String()
+	request.NegativePrompt = negative.String()
+
+	// Fallback
+	clean := CleanText(parameters)
+	if request.Prompt == "" {
+		request.Prompt = ExtractPositivePrompt(clean)
+	}
+
+	if request.NegativePrompt == "" {
+		request.NegativePrompt = ExtractNegativePrompt(clean)
+	}
+
+	return request, nil
+}
+
+// hashHeuristics fills LoraHashes and TIHashes from the quoted "Lora hashes" and "TI hashes" keys.
+func hashHeuristics(results ExtractResult, request *entities.TextToImageRequest) {
 	if loras, ok := results["Lora hashes"]; ok {
 		loras = strings.Trim(loras, `"`)
 		for _, lora := range strings.Split(loras, ", ") {
@@ -178,21 +214,64 @@ func ParameterHeuristics(parameters string) (entities.TextToImageRequest, error)
 			}
 		}
 	}
+}
 
-	request.Prompt = positive.String()
-	request.NegativePrompt = negative.String()
+// MergeExtraGenerationParams merges Info.ExtraGenerationParams from a webui response back into the request.
+// The keys are the same as the infotext, so the same mapping as ParameterHeuristics is used.
+// Scripts found in the extra params replace the ones already in the request.
+func MergeExtraGenerationParams(request *entities.TextToImageRequest, params *entities.ExtraGenerationParams) error {
+	if request == nil || params == nil {
+		return nil
+	}
 
-	// Fallback
-	clean := CleanText(parameters)
-	if request.Prompt == "" {
-		request.Prompt = ExtractPositivePrompt(clean)
+	results := make(ExtractResult)
+	for key, value := range params.Map() {
+		switch v := value.(type) {
+		case string:
+			results[key] = v
+		case bool:
+			results[key] = strconv.FormatBool(v)
+		case int:
+			results[key] = strconv.Itoa(v)
+		case float64:
+			results[key] = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			b, err := json.Marshal(v)
+			if err != nil {
+				return fmt.Errorf("error marshalling %s: %w", key, err)
+			}
+			results[key] = string(b)
+		}
 	}
+	splitImageSizes(results)
 
-	if request.NegativePrompt == "" {
-		request.NegativePrompt = ExtractNegativePrompt(clean)
+	err := ResultsToFields(results, TextToImageFields(request))
+	if err != nil {
+		return err
 	}
 
-	return request, nil
+	var scripts entities.Scripts
+	err = ScriptHeuristics(results, &scripts)
+	if err != nil {
+		return err
+	}
+	if scripts.ADetailer != nil {
+		request.ADetailer = scripts.ADetailer
+	}
+	if scripts.ControlNet != nil {
+		request.ControlNet = scripts.ControlNet
+	}
+	if scripts.RegionalPrompter != nil {
+		request.RegionalPrompter = scripts.RegionalPrompter
+	}
+
+	hashHeuristics(results, request)
+
+	if params.HiresUpscale != 0 || params.HiresUpscaler != "" || params.HiresResize != "" {
+		request.EnableHr = true
+	}
+
+	return nil
 }
 
 // DefaultResults returns the default key-value pairs for the parameters.
@@ -225,19 +304,6 @@ func DefaultResults() ExtractResult {
 	//	positive.WriteString(fmt.Sprintf("<hypernet:%s:%s>", hypernet, results["Hypernet strength"]))
 	//}
 
-	//promptAttention := parsePromptAttention(request.Prompt) + parsePromptAttention(request.NegativePrompt)
-
-	//var promptUsesEmphasis [][]string
-	//for _, p := range promptAttention {
-	//	if p[1] == 1.0 || p[0] == "BREAK" {
-	//		promptUsesEmphasis = append(promptUsesEmphasis, p)
-	//	}
-	//}
-
-	//if _, ok := results["Emphasis"]; !ok && promptUsesEmphasis {
-	//	results["Emphasis"] = "Original"
-	//}
-
 	return results
 }
 
@@ -272,19 +338,6 @@ func AllDefaultResults() ExtractResult {
 	//	positive.WriteString(fmt.Sprintf("<hypernet:%s:%s>", hypernet, results["Hypernet strength"]))
 	//}
 
-	//promptAttention := parsePromptAttention(request.Prompt) + parsePromptAttention(request.NegativePrompt)
-
-	//var promptUsesEmphasis [][]string
-	//for _, p := range promptAttention {
-	//	if p[1] == 1.0 || p[0] == "BREAK" {
-	//		promptUsesEmphasis = append(promptUsesEmphasis, p)
-	//	}
-	//}
-
-	//if _, ok := results["Emphasis"]; !ok && promptUsesEmphasis {
-	//	results["Emphasis"] = "Original"
-	//}
-
 	return results
 }
 
@@ -324,68 +377,56 @@ func TextToImageFields(request *entities.TextToImageRequest) map[string]any {
 		return nil
 	}
 	return map[string]any{
-		"Steps":                 &request.Steps,
-		"Sampler":               &request.SamplerName,
-		"CFG scale":             &request.CFGScale,
-		"Seed":                  &request.Seed,
-		"Denoising strength":    &request.DenoisingStrength,
-		"Width":                 &request.Width,
-		"Height":                &request.Height,
-		"Model":                 &request.OverrideSettings.SDModelCheckpoint,
-		"baseModel":             &request.OverrideSettings.SDModelCheckpoint,
-		"Model hash":            &request.OverrideSettings.SDCheckpointHash,
-		"VAE":                   &request.OverrideSettings.SDVae,
-		"VAE hash":              &request.OverrideSettings.SDVaeExplanation,
-		"Hires upscale":         &request.HrScale,
-		"Hires steps":           &request.HrSecondPassSteps,
-		"Hires upscaler":        &request.HrUpscaler,
-		"Clip skip":             &request.OverrideSettings.CLIPStopAtLastLayers,
-		"Hires resize-1":        &request.HrResizeX,
-		"Hires resize-2":        &request.HrResizeY,
-		"Hires sampler":         &request.HrSamplerName,
-		"Hires checkpoint":      &request.HrCheckpointName,
-		"Hires prompt":          &request.HrPrompt,
-		"Hires negative prompt": &request.HrNegativePrompt,
-		"RNG":                   &request.OverrideSettings.RandnSource,
-		"KScheduler":            &request.OverrideSettings.KSchedType,
-		"Schedule type":         &request.Scheduler, // For 1.8.0 and above
-		"Schedule max sigma":    &request.OverrideSettings.SigmaMax,
-		"Schedule min sigma":    &request.OverrideSettings.SigmaMin,
-		"Schedule rho":          &request.OverrideSettings.Rho,
-		"VAE Encoder":           &request.OverrideSettings.SDVaeEncodeMethod,
-		"VAE Decoder":           &request.OverrideSettings.SDVaeDecodeMethod,
-		"Downcast to fp16":      &request.OverrideSettings.DowncastAlphasCumprodToFP16,
+		"Steps":                            &request.Steps,
+		"Sampler":                          &request.SamplerName,
+		"CFG scale":                        &request.CFGScale,
+		"Seed":                             &request.Seed,
+		"Denoising strength":               &request.DenoisingStrength,
+		"Width":                            &request.Width,
+		"Height":                           &request.Height,
+		"Model":                            &request.OverrideSettings.SDModelCheckpoint,
+		"baseModel":                        &request.OverrideSettings.SDModelCheckpoint,
+		"Model hash":                       &request.OverrideSettings.SDCheckpointHash,
+		"VAE":                              &request.OverrideSettings.SDVae,
+		"VAE hash":                         &request.OverrideSettings.SDVaeExplanation,
+		"Hires upscale":                    &request.HrScale,
+		"Hires steps":                      &request.HrSecondPassSteps,
+		"Hires upscaler":                   &request.HrUpscaler,
+		"Clip skip":                        &request.OverrideSettings.CLIPStopAtLastLayers,
+		"Hires resize-1":                   &request.HrResizeX,
+		"Hires resize-2":                   &request.HrResizeY,
+		"Hires sampler":                    &request.HrSamplerName,
+		"Hires checkpoint":                 &request.HrCheckpointName,
+		"Hires prompt":                     &request.HrPrompt,
+		"Hires negative prompt":            &request.HrNegativePrompt,
+		"RNG":                              &request.OverrideSettings.RandnSource,
+		"KScheduler":                       &request.OverrideSettings.KSchedType,
+		"Schedule type":                    &request.Scheduler, // For 1.8.0 and above
+		"Schedule max sigma":               &request.OverrideSettings.SigmaMax,
+		"Schedule min sigma":               &request.OverrideSettings.SigmaMin,
+		"Schedule rho":                     &request.OverrideSettings.Rho,
+		"VAE Encoder":                      &request.OverrideSettings.SDVaeEncodeMethod,
+		"VAE Decoder":                      &request.OverrideSettings.SDVaeDecodeMethod,
+		"Downcast to fp16":                 &request.OverrideSettings.DowncastAlphasCumprodToFP16,
+		"Downcast alphas_cumprod":          &request.OverrideSettings.DowncastAlphasCumprodToFP16,
+		"Old prompt editing timelines":     &request.OverrideSettings.UseOldScheduling,
+		"Pad conds v0":                     &request.OverrideSettings.PadCondUncondV0,
+		"Emphasis":                         &request.OverrideSettings.Emphasis,
+		"Refiner":                          &request.RefinerCheckpoint,
+		"Refiner switch at":                &request.RefinerSwitchAt,
+		"Refiner switch by sampling steps": &request.OverrideSettings.RefinerSwitchBySampleSteps,
 		//"FP8 weight":                       &request.OverrideSettings.DisableWeightsAutoSwap,       // TODO: this is a bool, but FP8 weight is a string e.g. "Disable"
 		//"Cache FP16 weight for LoRA":       &request.OverrideSettings.SDVaeCheckpointCache,         // TODO: this is a float64, but Cache FP16 weight for LoRA is a bool e.g. False
-		//"Emphasis":                         &request.OverrideSettings.EnableEmphasis,               // TODO: this is a string, but Emphasis is a bool e.g. "Original"
-		//"Emphasis":                         &request.OverrideSettings.UseOldEmphasisImplementation, // TODO: this is a string, but Emphasis is a bool e.g. "Original"
-		//"Refiner switch by sampling steps": &request.OverrideSettings.HiresFixRefinerPass,          // TODO: this is a string, but Refiner switch by sampling steps is a bool e.g. False
 	}
 }
 
-// Deprecated: not yet implemented in callers
-// restoreOldHiresFixParams restores the old hires fix parameters if the new hires fix parameters are not present.
-// Set use is true if the new hires fix parameters should be used, false if the old hires fix parameters should be used.
+// restoreOldHiresFixParams converts the old "First pass size" hires fix parameters into width, height and hires resize.
+// Set use to true to emulate the "use_old_hires_fix_width_height" option, where the hires resize becomes the size.
+// It follows restore_old_hires_fix_params in modules/infotext_utils.py and expects sizes split by splitImageSizes.
 func restoreOldHiresFixParams(results ExtractResult, use bool) {
-	var firstpassWidth, firstpassHeight int
-
-	fieldsToSet := map[string]any{
-		"First pass size-1": &firstpassWidth,
-		"First pass size-2": &firstpassHeight,
-	}
-	if err := ResultsToFields(results, fieldsToSet); err != nil {
-		return
-	}
-
 	if use {
-		var hiresWidth, hiresHeight int
-		fieldsToSet = map[string]any{
-			"Hires resize-1": &hiresWidth,
-			"Hires resize-2": &hiresHeight,
-		}
-		if err := ResultsToFields(results, fieldsToSet); err != nil {
-			return
-		}
+		hiresWidth, _ := strconv.Atoi(results["Hires resize-1"])
+		hiresHeight, _ := strconv.Atoi(results["Hires resize-2"])
 
 		if hiresWidth != 0 && hiresHeight != 0 {
 			results["Size-1"] = strconv.Itoa(hiresWidth)
@@ -394,12 +435,22 @@ func restoreOldHiresFixParams(results ExtractResult, use bool) {
 		}
 	}
 
-	if firstpassWidth == 0 || firstpassHeight == 0 {
+	firstpassWidthString, okWidth := results["First pass size-1"]
+	firstpassHeightString, okHeight := results["First pass size-2"]
+	if !okWidth || !okHeight {
 		return
 	}
 
-	width, _ := strconv.Atoi(results["Size-1"])
-	height, _ := strconv.Atoi(results["Size-2"])
+	firstpassWidth, _ := strconv.Atoi(firstpassWidthString)
+	firstpassHeight, _ := strconv.Atoi(firstpassHeightString)
+
+	width, height := 512, 512
+	if w, err := strconv.Atoi(results["Size-1"]); err == nil {
+		width = w
+	}
+	if h, err := strconv.Atoi(results["Size-2"]); err == nil {
+		height = h
+	}
 
 	if firstpassWidth == 0 || firstpassHeight == 0 {
 		firstpassWidth, firstpassHeight = oldHiresFixFirstPassDimensions(width, height)
@@ -415,7 +466,68 @@ func oldHiresFixFirstPassDimensions(width int, height int) (int, int) {
 	desiredPixelCount := 512 * 512
 	actualPixelCount := width * height
 	scale := math.Sqrt(float64(desiredPixelCount) / float64(actualPixelCount))
-	width = int(math.Ceil(scale*float64(width/64)) * 64)
-	height = int(math.Ceil(scale*float64(height/64)) * 64)
+	width = int(math.Ceil(scale*float64(width)/64) * 64)
+	height = int(math.Ceil(scale*float64(height)/64) * 64)
 	return width, height
 }
+
+var imageSize = regexp.MustCompile(`^(\d+)x(\d+)$`)
+
+// splitImageSizes splits every "WxH" value into "Key-1" and "Key-2" the same way the webui does,
+// e.g. "Size: 768x1024" becomes "Size-1: 768" and "Size-2: 1024", and "Hires resize" becomes "Hires resize-1" and "Hires resize-2".
+func splitImageSizes(results ExtractResult) {
+	for key, value := range results {
+		if match := imageSize.FindStringSubmatch(strings.TrimSpace(value)); match != nil {
+			results[key+"-1"] = match[1]
+			results[key+"-2"] = match[2]
+		}
+	}
+}
+
+// scheduleTypes are the schedulers that used to be part of the sampler name before 1.9.0, e.g. "DPM++ 2M Karras".
+// "SGM Uniform" has to come before "Uniform".
+var scheduleTypes = []string{
+	"Karras",
+	"Exponential",
+	"Polyexponential",
+	"SGM Uniform",
+	"Uniform",
+}
+
+// infotextBackcompat sets the backwards compatibility options the webui enables when pasting an older infotext,
+// following backcompat in modules/infotext_versions.py. Forge is compared using the AUTOMATIC1111 version it's based on.
+// SD.Next versions are commit hashes and its samplers are named differently, so nothing is changed for it.
+func infotextBackcompat(results ExtractResult, version InfotextVersion, prompt string) {
+	if version.WebUI == WebUISDNext {
+		return
+	}
+
+	if version.Before(v160) && strings.Contains(prompt, "[") {
+		results["Old prompt editing timelines"] = "True"
+	}
+
+	if version.Before(v160) && (results["Sampler"] == "DDIM" || results["Sampler"] == "PLMS") {
+		results["Pad conds v0"] = "True"
+	}
+
+	if version.Before(v170TerminalS) {
+		results["Downcast alphas_cumprod"] = "True"
+	}
+
+	if version.Before(v180) && results["Refiner"] != "" {
+		results["Refiner switch by sampling steps"] = "True"
+	}
+
+	// Before 1.9.0 the schedule type was part of the sampler name, e.g. "DPM++ 2M Karras"
+	if _, ok := results["Schedule type"]; ok || (version.Known && !version.Before(v190)) {
+		return
+	}
+	sampler := results["Sampler"]
+	for _, scheduler := range scheduleTypes {
+		if strings.HasSuffix(sampler, " "+scheduler) {
+			results["Sampler"] = strings.TrimSuffix(sampler, " "+scheduler)
+			results["Schedule type"] = scheduler
+			break
+		}
+	}
+}
@@ -6,87 +6,23 @@ import (
 	"github.com/ellypaws/inkbunny-sd/entities"
 	"io"
 	"os"
-	"strings"
 )
 
 type NameContent map[string][]byte
 
 // ParseDataset takes in a map of text and json files and returns a map of the combined data
-// It uses the commonInstruction as a base and appends the input and response to it following completeSample
+// It uses the commonInstruction as a base and appends the input and response of each DatasetSamples following completeSample
 func ParseDataset(text, json NameContent) map[string][]byte {
 	var dataset = make(map[string][]byte)
-	for name, input := range text {
+	for _, sample := range DatasetSamples(text, json) {
 		var out bytes.Buffer
 		out.WriteString(commonInstruction)
 		out.WriteString("### Input:\n")
-		out.WriteString(`The file name is: "`)
-
-		// Because some artists already have standardized txt files, opt to split each file separately
-		autoSnep := strings.Contains(name, "_AutoSnep_")
-		druge := strings.Contains(name, "_druge_")
-		aiBean := strings.Contains(name, "_AIBean_")
-		artieDragon := strings.Contains(name, "_artiedragon_")
-		picker52578 := strings.Contains(name, "_picker52578_")
-		fairyGarden := strings.Contains(name, "_fairygarden_")
-		if autoSnep || druge || aiBean || artieDragon || picker52578 || fairyGarden {
-			var inputResponse map[string]InputResponse
-			switch {
-			case autoSnep:
-				inputResponse = MapParams(AutoSnep, WithBytes(input))
-			case druge:
-				inputResponse = MapParams(Common, WithBytes(input), UseDruge())
-			case aiBean:
-				inputResponse = MapParams(Common, WithBytes(input), UseAIBean())
-			case artieDragon:
-				inputResponse = MapParams(Common, WithBytes(input), UseArtie())
-			case picker52578:
-				inputResponse = MapParams(
-					Common,
-					WithBytes(input),
-					WithFilename("picker52578_"),
-					WithKeyCondition(func(line string) bool { return strings.HasPrefix(line, "File Name") }))
-			case fairyGarden:
-				inputResponse = MapParams(
-					Common,
-					// prepend "photo 1" to the input in case it's missing
-					WithBytes(bytes.Join([][]byte{[]byte("photo 1"), input}, []byte("\n"))),
-					UseFairyGarden())
-			}
-			if inputResponse != nil {
-				out := out.Bytes()
-				for name, s := range inputResponse {
-					var multi bytes.Buffer
-					multi.Write(out)
-					multi.WriteString(name)
-					multi.WriteString("\"\n\n")
-
-					if s.Input == "" {
-						continue
-					}
-
-					multi.WriteString(s.Input)
-
-					multi.WriteString("\n\n")
-					multi.WriteString("### Response:\n")
-
-					multi.Write(s.Response)
-					dataset[name] = multi.Bytes()
-				}
-				continue
-			}
-		}
-
-		out.WriteString(name)
-		out.WriteString("\"\n\n")
-
-		out.Write(input)
-
+		out.WriteString(sample.Input)
 		out.WriteString("\n\n")
 		out.WriteString("### Response:\n")
-		if j, ok := json[name]; ok {
-			out.Write(j)
-		}
-		dataset[name] = out.Bytes()
+		out.WriteString(sample.Response)
+		dataset[sample.Name] = out.Bytes()
 	}
 	return dataset
 }
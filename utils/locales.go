@@ -0,0 +1,197 @@
+package utils
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+//go:embed locales.json
+var defaultLocales []byte
+
+// Locales is the registry used by ExtractAll and the prompt extractors to translate parameter keys to English.
+// It starts with the packs in locales.json, and more languages can be loaded with Locales.Load.
+var Locales = mustLocaleRegistry(defaultLocales)
+
+// localeKeys are the English keys that Patterns and the prompt extractors look for.
+var localeKeys = map[string]bool{
+	"prompt":             true,
+	"positive prompt":    true,
+	"negative prompt":    true,
+	"steps":              true,
+	"sampler":            true,
+	"cfg scale":          true,
+	"seed":               true,
+	"size":               true,
+	"model":              true,
+	"model hash":         true,
+	"denoising strength": true,
+	"clip skip":          true,
+}
+
+// LocalePack maps each English key to the labels used for it in a language,
+// e.g. "negative prompt": ["ネガティブプロンプト"] for "ja".
+type LocalePack struct {
+	Language string              `json:"language"`
+	Keys     map[string][]string `json:"keys"`
+}
+
+// LocaleRegistry holds the locale packs, and is safe for concurrent use.
+type LocaleRegistry struct {
+	mu    sync.RWMutex
+	packs []LocalePack
+
+	aliases map[string]string // lowercased alias to English key
+	words   *regexp.Regexp    // aliases written with spaces between words, e.g. "pasos"
+	scripts *regexp.Regexp    // aliases in scripts without spaces, e.g. "ステップ"
+}
+
+func mustLocaleRegistry(data []byte) *LocaleRegistry {
+	var r LocaleRegistry
+	if err := r.Load(strings.NewReader(string(data))); err != nil {
+		panic(err)
+	}
+	return &r
+}
+
+// Load reads a JSON array of locale packs. A pack with the same language as an existing one replaces it.
+func (r *LocaleRegistry) Load(reader io.Reader) error {
+	var packs []LocalePack
+	if err := json.NewDecoder(reader).Decode(&packs); err != nil {
+		return fmt.Errorf("error decoding locale packs: %w", err)
+	}
+	for _, p := range packs {
+		if err := r.Add(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadFile reads the packs from a JSON file using Load.
+func (r *LocaleRegistry) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return r.Load(f)
+}
+
+// Add registers the pack and rebuilds the aliases.
+func (r *LocaleRegistry) Add(p LocalePack) error {
+	if p.Language == "" {
+		return errors.New("locale pack is missing a language")
+	}
+	for key := range p.Keys {
+		if !localeKeys[key] {
+			return fmt.Errorf("unknown key %q in locale %s", key, p.Language)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if i := slices.IndexFunc(r.packs, func(existing LocalePack) bool { return existing.Language == p.Language }); i >= 0 {
+		r.packs[i] = p
+	} else {
+		r.packs = append(r.packs, p)
+	}
+	r.compile()
+	return nil
+}
+
+// Languages returns the language of every pack.
+func (r *LocaleRegistry) Languages() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	languages := make([]string, len(r.packs))
+	for i, p := range r.packs {
+		languages[i] = p.Language
+	}
+	return languages
+}
+
+func (r *LocaleRegistry) compile() {
+	r.aliases = make(map[string]string)
+	var words, scripts []string
+	for _, p := range r.packs {
+		for key, aliases := range p.Keys {
+			for _, alias := range aliases {
+				alias = strings.ToLower(strings.TrimSpace(alias))
+				if alias == "" {
+					continue
+				}
+				if _, ok := r.aliases[alias]; ok {
+					continue
+				}
+				r.aliases[alias] = key
+				if first, _ := utf8.DecodeRuneInString(alias); unicode.In(first, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) {
+					scripts = append(scripts, regexp.QuoteMeta(alias))
+				} else {
+					words = append(words, regexp.QuoteMeta(alias))
+				}
+			}
+		}
+	}
+
+	// Longer aliases first, so that "negative prompt" isn't matched as "prompt"
+	longest := func(a, b string) int { return len(b) - len(a) }
+	slices.SortFunc(words, longest)
+	slices.SortFunc(scripts, longest)
+
+	r.words, r.scripts = nil, nil
+	if len(words) > 0 {
+		r.words = regexp.MustCompile(`(?im)` + keyPosition + `(` + strings.Join(words, "|") + `)(\s*[:：]|[ \t]*$)`)
+	}
+	if len(scripts) > 0 {
+		r.scripts = regexp.MustCompile(`(?im)` + keyPosition + `(` + strings.Join(scripts, "|") + `)(\s*[:：]|[ \t]*$)`)
+	}
+}
+
+// keyPosition is where a key can start: the start of a line after any bullets or markup,
+// or after the separator of the previous key, e.g. "Steps: 20, Seed: 1".
+const keyPosition = `(^[^\p{L}\p{N}\n]*|[,，、;；][ \t]*)`
+
+// Normalize replaces every known label followed by a colon, or alone on its line, with its English key.
+// Only labels in a key position are replaced, so the same words inside a prompt are kept.
+// Full-width colons after a label are replaced with ": ", e.g. "ステップ：20" becomes "steps: 20".
+func (r *LocaleRegistry) Normalize(s string) string {
+	if r == nil {
+		return s
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, re := range []*regexp.Regexp{r.scripts, r.words} {
+		if re == nil {
+			continue
+		}
+		s = re.ReplaceAllStringFunc(s, func(match string) string {
+			m := re.FindStringSubmatch(match)
+			key, ok := r.aliases[strings.ToLower(m[2])]
+			if !ok {
+				return match
+			}
+			switch strings.TrimSpace(m[3]) {
+			case "":
+				if strings.ContainsAny(m[1], ",，、;；") {
+					return match // a label without a colon is only a key when it's alone on its line
+				}
+				return m[1] + key + m[3]
+			case "：":
+				return m[1] + key + ": "
+			default:
+				return m[1] + key + ":"
+			}
+		})
+	}
+	return s
+}
@@ -0,0 +1,246 @@
+package utils
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"path"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ellypaws/inkbunny-sd/entities"
+	"github.com/ellypaws/inkbunny/api"
+)
+
+// Page is the section of a multi-image description or text file that belongs to one file of the submission.
+// Number is the 1-based page number from headers like "Image 3:", "Page 2 -" or "#4", or 0 if the header is a filename.
+type Page struct {
+	Number   int    `json:"number,omitempty"`
+	Filename string `json:"filename,omitempty"`
+	Header   string `json:"header"`
+	Text     string `json:"text"`
+}
+
+var (
+	pageNumber   = regexp.MustCompile(`(?i)^\s*(?:image|page|picture|pic|img|part)\s*#?\s*(\d+)\s*(?:[:.)\-–—]|$)\s*`)
+	pageHash     = regexp.MustCompile(`^\s*#(\d+)\s*(?:[:.)\-–—]\s*|$)`)
+	pageFilename = regexp.MustCompile(`(?i)^\s*([^\s:/\\][^:/\\]*?\.(?:png|jpe?g|webp|gif))\s*:?\s*$`)
+)
+
+// SplitPages splits a description or text file at every line that starts a page, such as
+// "Image 3:", "Page 2 -", "#4" or a filename like "image_003.png".
+// The text before the first page is the header, and holds the parameters shared by every page.
+// If there are less than two pages, the whole text is returned as the header.
+func SplitPages(text string) (header string, pages []Page) {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+
+	var (
+		headerLines []string
+		current     *Page
+		body        []string
+	)
+	flush := func() {
+		if current != nil {
+			current.Text = strings.TrimSpace(strings.Join(body, "\n"))
+			pages = append(pages, *current)
+		}
+		body = nil
+	}
+
+	for _, line := range lines {
+		page, rest, ok := pageHeader(line)
+		if !ok {
+			if current == nil {
+				headerLines = append(headerLines, line)
+			} else {
+				body = append(body, line)
+			}
+			continue
+		}
+		flush()
+		current = &page
+		if rest != "" {
+			body = append(body, rest)
+		}
+	}
+	flush()
+
+	if len(pages) < 2 {
+		return text, nil
+	}
+	return strings.TrimSpace(strings.Join(headerLines, "\n")), pages
+}
+
+// pageHeader returns the page started by the line, and the rest of the line after the header.
+// BBCode around the header, e.g. "[b]Image 3:[/b]", is ignored.
+func pageHeader(line string) (Page, string, bool) {
+	plain := ParseBBCode(line).PlainText()
+	for _, r := range []*regexp.Regexp{pageNumber, pageHash} {
+		m := r.FindStringSubmatch(plain)
+		if m == nil {
+			continue
+		}
+		number, err := strconv.Atoi(m[1])
+		if err != nil || number == 0 {
+			continue
+		}
+		return Page{Number: number, Header: strings.TrimSpace(m[0])}, strings.TrimSpace(plain[len(m[0]):]), true
+	}
+	if m := pageFilename.FindStringSubmatch(plain); m != nil {
+		return Page{Filename: m[1], Header: strings.TrimSpace(plain)}, "", true
+	}
+	return Page{}, "", false
+}
+
+// PageHeuristics returns a request for each of the files of a submission, in the same order as files.
+// Each page of the text is matched to a file by filename, or else by its number among the images,
+// or else by its position. Fields missing from a page are inherited from the header of the text.
+// Files that aren't images, like the text file itself, are nil.
+// Images without a page get the request of the header if it has a prompt.
+// A page that fails to parse leaves its file nil, and the errors are joined while the other requests are still returned.
+func PageHeuristics(text string, files []api.File) ([]*entities.TextToImageRequest, error) {
+	header, pages := SplitPages(text)
+
+	var errs []error
+	shared, err := DescriptionHeuristics(header)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("error parsing shared parameters: %w", err))
+		shared = entities.TextToImageRequest{}
+	}
+	images := imageFiles(files)
+	requests := make([]*entities.TextToImageRequest, len(files))
+	failed := make(map[int]bool)
+	for i, page := range pages {
+		index := pageFile(page, i, files, images)
+		if index < 0 || requests[index] != nil || failed[index] {
+			continue
+		}
+		request, err := DescriptionHeuristics(page.Text)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error parsing %s: %w", page.Header, err))
+			failed[index] = true
+			continue
+		}
+		inheritFields(reflect.ValueOf(&request).Elem(), reflect.ValueOf(&shared).Elem())
+		requests[index] = &request
+	}
+
+	if shared.Prompt == "" {
+		return requests, errors.Join(errs...)
+	}
+	for _, index := range images {
+		if requests[index] == nil && !failed[index] {
+			request := deepCopy(reflect.ValueOf(shared)).Interface().(entities.TextToImageRequest)
+			requests[index] = &request
+		}
+	}
+	return requests, errors.Join(errs...)
+}
+
+// imageFiles returns the index of every image in files, sorted by their order in the submission.
+func imageFiles(files []api.File) []int {
+	var images []int
+	for i, file := range files {
+		if strings.HasPrefix(file.MimeType, "image") || file.MimeType == "" && pageFilename.MatchString(file.FileName) {
+			images = append(images, i)
+		}
+	}
+	slices.SortStableFunc(images, func(a, b int) int {
+		return cmp.Compare(files[a].SubmissionFileOrder, files[b].SubmissionFileOrder)
+	})
+	return images
+}
+
+// pageFile returns the index in files of the page at position i, or -1.
+func pageFile(page Page, i int, files []api.File, images []int) int {
+	if page.Filename != "" {
+		name := strings.ToLower(strings.TrimSuffix(page.Filename, path.Ext(page.Filename)))
+		for _, index := range images {
+			file := files[index]
+			if strings.ToLower(strings.TrimSuffix(file.FileName, path.Ext(file.FileName))) == name {
+				return index
+			}
+		}
+	}
+	if page.Number > 0 && page.Number <= len(images) {
+		return images[page.Number-1]
+	}
+	if i < len(images) {
+		return images[i]
+	}
+	return -1
+}
+
+// inheritFields sets every zero field of dst to a copy of the field of src, including the fields of nested structs.
+func inheritFields(dst, src reflect.Value) {
+	for i := 0; i < dst.NumField(); i++ {
+		if !dst.Type().Field(i).IsExported() {
+			continue
+		}
+		d, s := dst.Field(i), src.Field(i)
+		if d.Kind() == reflect.Struct {
+			inheritFields(d, s)
+			continue
+		}
+		if d.IsZero() && !s.IsZero() {
+			d.Set(deepCopy(s))
+		}
+	}
+}
+
+// deepCopy copies the pointers, maps and slices of v, so that the pages don't share them with the header.
+func deepCopy(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type().Elem())
+		c.Elem().Set(deepCopy(v.Elem()))
+		return c
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type()).Elem()
+		c.Set(deepCopy(v.Elem()))
+		return c
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		for iter := v.MapRange(); iter.Next(); {
+			c.SetMapIndex(iter.Key(), deepCopy(iter.Value()))
+		}
+		return c
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := range v.Len() {
+			c.Index(i).Set(deepCopy(v.Index(i)))
+		}
+		return c
+	case reflect.Array:
+		c := reflect.New(v.Type()).Elem()
+		for i := range v.Len() {
+			c.Index(i).Set(deepCopy(v.Index(i)))
+		}
+		return c
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+		for i := range v.NumField() {
+			if v.Type().Field(i).IsExported() {
+				c.Field(i).Set(deepCopy(v.Field(i)))
+			}
+		}
+		return c
+	}
+	return v
+}
@@ -0,0 +1,380 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/ellypaws/inkbunny-sd/entities"
+	"github.com/ellypaws/inkbunny-sd/entities/comfyui"
+)
+
+// Format is the metadata format matched by Parse.
+type Format string
+
+const (
+	FormatUnknown         Format = ""
+	FormatInfotext        Format = "A1111 infotext"
+	FormatSequential      Format = "Sequential infotext"
+	FormatDescription     Format = "Description"
+	FormatComfyUIAPI      Format = "ComfyUI API"
+	FormatComfyUIWorkflow Format = "ComfyUI workflow"
+	FormatCubFest         Format = "CubFest"
+	FormatInvokeAI        Format = "InvokeAI"
+	FormatEasyDiffusion   Format = "EasyDiffusion"
+	FormatAutoSnep        Format = "AutoSnep"
+	FormatCirn0           Format = "Cirn0"
+	FormatSoph            Format = "Soph"
+	FormatRNSDAI          Format = "RNSDAI"
+	FormatArtist          Format = "Artist layout"
+
+	FormatFooocus     = Format(GenerationDataFooocus)
+	FormatFooocusLog  = Format(GenerationDataFooocusLog)
+	FormatSwarmUI     = Format(GenerationDataSwarmUI)
+	FormatCivitai     = Format(GenerationDataCivitai)
+	FormatCivitaiText = Format(GenerationDataCivitaiText)
+)
+
+// Hints are what the caller already knows about the blob.
+// Format skips the detection entirely, while ArtistID or Username selects the profile of a known artist in Artists.
+type Hints struct {
+	Filename string
+	ArtistID int64
+	Username string
+	Format   Format
+}
+
+func (h Hints) artist() (*ArtistProfile, bool) {
+	if p, ok := Artists.ByID(h.ArtistID); ok {
+		return p, true
+	}
+	return Artists.ByUsername(h.Username)
+}
+
+// ParseResult is every request found by Parse, along with the Format that matched.
+// Confidence is 1 when the format was given in Hints, otherwise it's how sure DetectFormat was.
+// Provenance has the same keys as Requests, with the Evidence of each field.
+type ParseResult struct {
+	Requests   map[string]entities.TextToImageRequest
+	Provenance map[string]entities.Provenance
+	Format     Format
+	Confidence float64
+	Repairs    []Repair // the fixes RepairJSON made to a JSON blob that wasn't valid
+	Errors     []error  // the files that failed to parse, while the others are in Requests
+}
+
+var (
+	autoSnepChunks = regexp.MustCompile(`(?m)^  PNG text chunks:\s*$`)
+	cirn0Section   = regexp.MustCompile(`(?m)^===`)
+	stepsLine      = regexp.MustCompile(`(?mi)^steps: ?\d`)
+)
+
+// Parse sniffs the format of the blob and dispatches it to the matching parser.
+// If the detected parser fails, the regex heuristics of DescriptionHeuristics are used as a last resort.
+func Parse(blob []byte, hints Hints) (ParseResult, error) {
+	// A hand-edited JSON file is repaired before detection so that it isn't parsed as a description.
+	// The repair is only kept if it's one of the JSON formats, as a prompt can start with a brace too.
+	var repairs []Repair
+	if trimmed := bytes.TrimSpace(blob); len(trimmed) > 0 && trimmed[0] == '{' && !json.Valid(trimmed) {
+		if repaired, fixes, err := RepairJSON(trimmed); err == nil {
+			if format, _ := detectJSON(repaired); format != FormatUnknown || DetectGenerationData(repaired) != GenerationDataUnknown {
+				blob, repairs = repaired, fixes
+			}
+		}
+	}
+
+	format, confidence := hints.Format, 1.0
+	if format == FormatUnknown {
+		format, confidence = DetectFormat(blob, hints)
+	}
+
+	result, err := parseFormat(blob, format, hints)
+	if err == nil && len(result.requests) == 0 {
+		err = errors.New("no requests found")
+	}
+	if err != nil {
+		if hints.Format != FormatUnknown || format == FormatDescription {
+			return ParseResult{Format: format}, fmt.Errorf("error parsing %s: %w", format, err)
+		}
+		fallback, fallbackErr := parseFormat(blob, FormatDescription, hints)
+		if fallbackErr != nil || len(fallback.requests) == 0 {
+			return ParseResult{Format: format}, fmt.Errorf("error parsing %s: %w", format, err)
+		}
+		return ParseResult{
+			Requests:   fallback.requests,
+			Provenance: fallback.provenance,
+			Format:     FormatDescription,
+			Confidence: 0.2,
+			Repairs:    repairs,
+		}, nil
+	}
+
+	return ParseResult{
+		Requests:   result.requests,
+		Provenance: result.provenance,
+		Format:     format,
+		Confidence: confidence,
+		Repairs:    repairs,
+		Errors:     result.errs,
+	}, nil
+}
+
+// DetectFormat returns the most likely Format of the blob and how confident the guess is, from 0 to 1.
+// JSON is recognized by its shape keys, and text by its headers, indentation and "Steps:" lines.
+func DetectFormat(blob []byte, hints Hints) (Format, float64) {
+	trimmed := bytes.TrimSpace(blob)
+	if len(trimmed) == 0 {
+		return FormatUnknown, 0
+	}
+
+	if kind := DetectGenerationData(trimmed); kind != GenerationDataUnknown {
+		return Format(kind), 0.95
+	}
+
+	if trimmed[0] == '{' && json.Valid(trimmed) {
+		return detectJSON(trimmed)
+	}
+
+	if profile, ok := hints.artist(); ok {
+		switch profile.Processor {
+		case "RNSDAI":
+			return FormatRNSDAI, 0.85
+		case "Soph":
+			return FormatSoph, 0.85
+		case "Cirn0":
+			return FormatCirn0, 0.85
+		case "AutoSnep":
+			return FormatAutoSnep, 0.9
+		default:
+			return FormatArtist, 0.85
+		}
+	}
+
+	text := string(trimmed)
+	switch {
+	case SophStartKey.MatchString(text) && SophStartInvokeAI.MatchString(text):
+		return FormatSoph, 0.85
+	case autoSnepChunks.MatchString(text):
+		return FormatAutoSnep, 0.9
+	case cirn0Section.MatchString(text) && seedLine.MatchString(text):
+		return FormatCirn0, 0.7
+	}
+
+	switch steps := len(stepsLine.FindAllStringIndex(text, -1)); {
+	case steps == 1 && stepsLine.MatchString(lastLine(text)):
+		if strings.Contains(strings.ToLower(text), "negative prompt:") {
+			return FormatInfotext, 0.95
+		}
+		return FormatInfotext, 0.85
+	case steps > 1:
+		return FormatSequential, 0.75
+	case ParametersStart.MatchString(text):
+		return FormatDescription, 0.6
+	}
+
+	return FormatDescription, 0.3
+}
+
+// detectJSON recognizes the JSON formats by their keys.
+// ComfyUI API and CubFest are maps of objects, so the keys of each value are checked as well.
+func detectJSON(blob []byte) (Format, float64) {
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(blob, &keys); err != nil {
+		return FormatUnknown, 0
+	}
+	has := func(key string) bool {
+		_, ok := keys[key]
+		return ok
+	}
+
+	switch {
+	case has("nodes") && (has("links") || has("last_node_id")):
+		return FormatComfyUIWorkflow, 0.95
+	case has("generation_mode"), has("app_version") && has("positive_prompt"):
+		return FormatInvokeAI, 0.9
+	case has("num_inference_steps"), has("use_stable_diffusion_model"):
+		return FormatEasyDiffusion, 0.9
+	}
+
+	var comfyNodes, cubFest int
+	for _, value := range keys {
+		var node map[string]json.RawMessage
+		if err := json.Unmarshal(value, &node); err != nil {
+			continue
+		}
+		if _, ok := node["class_type"]; ok {
+			comfyNodes++
+		}
+		if _, ok := node["sampler_parameters"]; ok {
+			cubFest++
+		}
+	}
+
+	switch {
+	case comfyNodes > 0 && comfyNodes == len(keys):
+		return FormatComfyUIAPI, 0.95
+	case comfyNodes > 0:
+		return FormatComfyUIAPI, 0.7
+	case cubFest > 0:
+		return FormatCubFest, 0.9
+	}
+
+	return FormatUnknown, 0
+}
+
+type parsed struct {
+	requests   map[string]entities.TextToImageRequest
+	provenance map[string]entities.Provenance
+	errs       []error
+}
+
+func parseFormat(blob []byte, format Format, hints Hints) (parsed, error) {
+	single := func(request *entities.TextToImageRequest, provenance entities.Provenance, err error) (parsed, error) {
+		if err != nil && !errors.Is(err, IncompleteParameters) {
+			return parsed{}, err
+		}
+		if request == nil {
+			return parsed{}, errors.New("no request found")
+		}
+		return parsed{
+			requests:   map[string]entities.TextToImageRequest{hints.Filename: *request},
+			provenance: map[string]entities.Provenance{hints.Filename: provenance},
+		}, nil
+	}
+	converted := func(request *entities.TextToImageRequest, source entities.Source, confidence float64) (parsed, error) {
+		return single(request, ConvertedProvenance(request, source, jsonPaths[format], confidence), nil)
+	}
+	params := func(p Params, err error) (parsed, error) {
+		if err != nil {
+			return parsed{}, err
+		}
+		requests, errs := parseParams(p)
+		if len(requests) == 0 && len(errs) > 0 {
+			return parsed{}, errors.Join(errs...)
+		}
+		out := parsed{requests: requests, provenance: make(map[string]entities.Provenance), errs: errs}
+		for key, request := range out.requests {
+			out.provenance[key] = chunkProvenance(p[key], &request)
+		}
+		return out, nil
+	}
+	text := string(blob)
+
+	switch format {
+	case FormatFooocus, FormatFooocusLog, FormatSwarmUI, FormatCivitai:
+		request, err := GenerationDataHeuristics(blob)
+		if err != nil {
+			return parsed{}, err
+		}
+		return converted(&request, entities.SourceJSON, ConfidenceJSON)
+	case FormatCivitaiText:
+		request, err := GenerationDataHeuristics(blob)
+		return single(&request, infotextProvenance(text, &request), err)
+	case FormatInfotext:
+		request, provenance, err := ParameterHeuristicsProvenance(text)
+		if errors.Is(err, IncompleteParameters) {
+			provenance = ConvertedProvenance(&request, entities.SourceInfotext, nil, ConfidenceDefault)
+		}
+		return single(&request, provenance, err)
+	case FormatDescription:
+		request, provenance, err := DescriptionHeuristicsProvenance(text)
+		if err == nil && request.Prompt == "" && request.Steps == 0 && request.Seed == 0 {
+			err = errors.New("no parameters found in description")
+		}
+		return single(&request, provenance, err)
+	case FormatRNSDAI:
+		request, err := RNSDAIHeuristics(text)
+		if err != nil {
+			return parsed{}, err
+		}
+		return converted(&request, entities.SourceRegex, ConfidenceRegex)
+	case FormatSequential:
+		return params(Sequential(WithString(text), WithFilename(hints.Filename)))
+	case FormatAutoSnep:
+		return params(AutoSnep(WithString(text), WithFilename(hints.Filename)))
+	case FormatCirn0:
+		if seedLine.MatchString(text) {
+			return params(Cirn0(WithString(text), WithFilename(hints.Filename)))
+		}
+		return params(Common(WithString(text), WithFilename(hints.Filename), UseCirn0()))
+	case FormatSoph:
+		if SophStartKey.MatchString(text) {
+			requests, err := Soph(WithString(text), WithFilename(hints.Filename))
+			if err != nil {
+				return parsed{}, err
+			}
+			out := parsed{requests: requests, provenance: make(map[string]entities.Provenance)}
+			for key, request := range requests {
+				out.provenance[key] = ConvertedProvenance(&request, entities.SourceJSON, jsonPaths[FormatSoph], ConfidenceJSON)
+			}
+			return out, nil
+		}
+		return params(Common(WithString(text), WithFilename(hints.Filename), UseSoph()))
+	case FormatArtist:
+		profile, ok := hints.artist()
+		if !ok || profile.GetProcessor() == nil {
+			return parsed{}, fmt.Errorf("no artist profile for %d %q", hints.ArtistID, hints.Username)
+		}
+		return params(profile.GetProcessor()(WithString(text), WithFilename(hints.Filename), WithArtist(profile)))
+	case FormatComfyUIAPI:
+		api, err := comfyui.UnmarshalIsolatedComfyApi(blob)
+		if err != nil && len(api) == 0 {
+			return parsed{}, err
+		}
+		request := api.Convert()
+		return single(request, ComfyUIProvenance(api, request), nil)
+	case FormatComfyUIWorkflow:
+		workflow, err := comfyui.UnmarshalIsolatedComfyUI(blob)
+		if err != nil && len(workflow.Nodes) == 0 {
+			return parsed{}, err
+		}
+		return converted(workflow.Convert(), entities.SourceComfyUI, ConfidenceComfyUI)
+	case FormatCubFest:
+		cubFest, err := comfyui.UnmarshalCubFestAIDate(blob)
+		if err != nil {
+			return parsed{}, err
+		}
+		out := parsed{
+			requests:   make(map[string]entities.TextToImageRequest, len(cubFest)),
+			provenance: make(map[string]entities.Provenance, len(cubFest)),
+		}
+		for key, image := range cubFest {
+			request := image.Convert()
+			out.requests[hints.Filename+key] = request
+			paths := underPath(jsonPaths[format], key)
+			if image.SamplerParameters.CkptName != "" {
+				paths["override_settings.sd_model_checkpoint"] = fmt.Sprintf("$[%q].sampler_parameters.ckpt_name", key)
+			}
+			if image.SamplerParameters.VaeName != "" {
+				paths["override_settings.sd_vae"] = fmt.Sprintf("$[%q].sampler_parameters.vae_name", key)
+			}
+			out.provenance[hints.Filename+key] = ConvertedProvenance(&request, entities.SourceJSON, paths, ConfidenceJSON)
+		}
+		return out, nil
+	case FormatInvokeAI:
+		invokeAI, err := entities.UnmarshalInvokeAI(blob)
+		if err != nil {
+			return parsed{}, err
+		}
+		return converted(invokeAI.Convert(), entities.SourceJSON, ConfidenceJSON)
+	case FormatEasyDiffusion:
+		easyDiffusion, err := entities.UnmarshalEasyDiffusion(blob)
+		if err != nil {
+			return parsed{}, err
+		}
+		return converted(easyDiffusion.Convert(), entities.SourceJSON, ConfidenceJSON)
+	default:
+		return parsed{}, errors.New("unknown format")
+	}
+}
+
+func lastLine(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.LastIndexByte(s, '\n'); i >= 0 {
+		return s[i+1:]
+	}
+	return s
+}
@@ -5,6 +5,7 @@ import (
 )
 
 func ExtractPositivePrompt(s string) string {
+	s = Locales.Normalize(s)
 	result := Extract(s, positivePattern)
 
 	if result == "" {
@@ -23,6 +24,7 @@ func ExtractPositivePrompt(s string) string {
 }
 
 func ExtractNegativePrompt(s string) string {
+	s = Locales.Normalize(s)
 	result := Extract(s, negativePattern)
 
 	if result == "" {
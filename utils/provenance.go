@@ -0,0 +1,507 @@
+package utils
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/ellypaws/inkbunny-sd/entities"
+	"github.com/ellypaws/inkbunny-sd/entities/comfyui"
+)
+
+// The confidence given to each kind of evidence.
+const (
+	ConfidenceInfotext = 0.95
+	ConfidenceJSON     = 0.9
+	ConfidenceComfyUI  = 0.85
+	ConfidenceRegex    = 0.6
+	ConfidenceLLM      = 0.4
+	ConfidenceDefault  = 0.2
+)
+
+// patternConfidence overrides ConfidenceRegex for the Patterns that are either very specific or very loose.
+var patternConfidence = map[string]float64{
+	"steps":     0.7,
+	"stepsAlt":  0.4,
+	"cfg":       0.5,
+	"width":     0.7,
+	"height":    0.7,
+	"hash":      0.8,
+	"model":     0.4,
+	"denoising": 0.7,
+}
+
+// infotextAliases are the keys written to the infotext for the keys derived by ParameterHeuristics.
+var infotextAliases = map[string]string{
+	"Width":          "Size",
+	"Height":         "Size",
+	"Size-1":         "Size",
+	"Size-2":         "Size",
+	"Hires resize-1": "Hires resize",
+	"Hires resize-2": "Hires resize",
+}
+
+// ParameterHeuristicsProvenance is ParameterHeuristics that also records the Evidence of each field.
+// Keys read from the text are SourceInfotext with their span, while keys filled in by the version defaults are SourceDefault.
+func ParameterHeuristicsProvenance(parameters string) (entities.TextToImageRequest, entities.Provenance, error) {
+	request, err := ParameterHeuristics(parameters)
+	if err != nil {
+		return request, nil, err
+	}
+	return request, infotextProvenance(parameters, &request), nil
+}
+
+// DescriptionHeuristicsProvenance is DescriptionHeuristics that also records the Evidence of each field.
+// Fields found by Patterns are SourceRegex, with a confidence depending on how loose the pattern is.
+func DescriptionHeuristicsProvenance(description string) (entities.TextToImageRequest, entities.Provenance, error) {
+	request, err := DescriptionHeuristics(description)
+	if err != nil {
+		return request, nil, err
+	}
+
+	clean := CleanText(description)
+	if params := ParametersStart.FindString(clean); params != "" {
+		provenance := infotextProvenance(params, &request)
+		shiftProvenance(provenance, description, params)
+		return request, provenance, nil
+	}
+
+	provenance := make(entities.Provenance)
+	paths := fieldPaths(&request)
+	fields := map[string]any{
+		"steps":     &request.Steps,
+		"stepsAlt":  &request.Steps,
+		"sampler":   &request.SamplerName,
+		"cfg":       &request.CFGScale,
+		"seed":      &request.Seed,
+		"width":     &request.Width,
+		"height":    &request.Height,
+		"hash":      &request.OverrideSettings.SDCheckpointHash,
+		"model":     &request.OverrideSettings.SDModelCheckpoint,
+		"denoising": &request.DenoisingStrength,
+	}
+	for name, ptr := range fields {
+		r, ok := Patterns[name]
+		if !ok {
+			continue
+		}
+		evidence, ok := regexEvidence(clean, name, r)
+		if !ok {
+			continue
+		}
+		evidence.Start, evidence.End = locate(description, evidence.Text)
+		provenance.Add(paths.of(ptr), evidence)
+	}
+
+	for field, text := range map[string]string{"prompt": request.Prompt, "negative_prompt": request.NegativePrompt} {
+		if text == "" {
+			continue
+		}
+		start, end := locate(description, text)
+		provenance.Add(field, entities.Evidence{
+			Source:     entities.SourceRegex,
+			Key:        field,
+			Text:       text,
+			Start:      start,
+			End:        end,
+			Confidence: ConfidenceRegex,
+		})
+	}
+
+	return request, provenance, nil
+}
+
+// ConvertedProvenance records every field that is set in the request as coming from the same source,
+// for converters like the JSON formats or an LLM response where a per-field span isn't available.
+// The Key of each field is its entry in keys, e.g. the JSON path "$.seed" it was converted from,
+// and is left empty for the fields without one, like the comments collected from several keys.
+func ConvertedProvenance(request *entities.TextToImageRequest, source entities.Source, keys map[string]string, confidence float64) entities.Provenance {
+	provenance := make(entities.Provenance)
+	if request == nil {
+		return provenance
+	}
+	for _, field := range setFields(request) {
+		provenance.Add(field, entities.Evidence{
+			Source:     source,
+			Key:        keys[field],
+			Start:      -1,
+			End:        -1,
+			Confidence: confidence,
+		})
+	}
+	return provenance
+}
+
+// jsonPaths are the JSON paths each field of the request is converted from, for the JSON formats.
+var jsonPaths = map[Format]map[string]string{
+	FormatFooocus:    fooocusPaths,
+	FormatFooocusLog: fooocusPaths, // the log.html rows are mapped to the metadata keys
+	FormatSwarmUI: {
+		"prompt":               "$.sui_image_params.prompt",
+		"negative_prompt":      "$.sui_image_params.negativeprompt",
+		"seed":                 "$.sui_image_params.seed",
+		"steps":                "$.sui_image_params.steps",
+		"cfg_scale":            "$.sui_image_params.cfgscale",
+		"width":                "$.sui_image_params.width",
+		"height":               "$.sui_image_params.height",
+		"sampler_name":         "$.sui_image_params.sampler",
+		"scheduler":            "$.sui_image_params.scheduler",
+		"refiner_checkpoint":   "$.sui_image_params.refinermodel",
+		"refiner_switch_at":    "$.sui_image_params.refinercontrolpercentage",
+		"denoising_strength":   "$.sui_image_params.refinercontrolpercentage",
+		"enable_hr":            "$.sui_image_params.refinerupscale",
+		"hr_scale":             "$.sui_image_params.refinerupscale",
+		"hr_second_pass_steps": "$.sui_image_params.refinersteps",
+		"override_settings.CLIP_stop_at_last_layers": "$.sui_image_params.clipstopatlayer",
+		"override_settings.sd_model_checkpoint":      "$.sui_image_params.model",
+		"override_settings.sd_checkpoint_hash":       "$.sui_models",
+		"override_settings.sd_vae":                   "$.sui_image_params.vae",
+	},
+	FormatCivitai: {
+		"prompt":               "$.prompt",
+		"negative_prompt":      "$.negativePrompt",
+		"cfg_scale":            "$.cfgScale",
+		"steps":                "$.steps",
+		"sampler_name":         "$.sampler",
+		"seed":                 "$.seed",
+		"width":                "$.Size",
+		"height":               "$.Size",
+		"denoising_strength":   "$['Denoising strength']",
+		"enable_hr":            "$['Hires upscale']",
+		"hr_scale":             "$['Hires upscale']",
+		"hr_upscaler":          "$['Hires upscaler']",
+		"hr_second_pass_steps": "$['Hires steps']",
+		"lora_hashes":          "$.resources",
+		"ti_hashes":            "$.resources",
+		"override_settings.CLIP_stop_at_last_layers": "$.clipSkip",
+		"override_settings.sd_model_checkpoint":      "$.Model",
+		"override_settings.sd_checkpoint_hash":       "$['Model hash']",
+	},
+	FormatInvokeAI: invokeAIPaths,
+	FormatSoph:     invokeAIPaths, // Soph writes the InvokeAI metadata of each image
+	FormatEasyDiffusion: {
+		"prompt":                                "$.prompt",
+		"negative_prompt":                       "$.negative_prompt",
+		"batch_size":                            "$.num_outputs",
+		"steps":                                 "$.num_inference_steps",
+		"cfg_scale":                             "$.guidance_scale",
+		"width":                                 "$.width",
+		"height":                                "$.height",
+		"sampler_name":                          "$.sampler_name",
+		"seed":                                  "$.seed",
+		"override_settings.sd_model_checkpoint": "$.use_stable_diffusion_model",
+		"override_settings.sd_vae":              "$.use_vae_model",
+	},
+	FormatCubFest: {
+		"prompt":                                "$.positive_prompt",
+		"width":                                 "$.resolution",
+		"height":                                "$.resolution",
+		"sampler_name":                          "$.sampler_parameters.sampler_name",
+		"seed":                                  "$.sampler_parameters.seed",
+		"steps":                                 "$.sampler_parameters.steps",
+		"cfg_scale":                             "$.sampler_parameters.cfg",
+		"scheduler":                             "$.sampler_parameters.scheduler",
+		"denoising_strength":                    "$.sampler_parameters.denoise",
+		"hr_upscaler":                           "$.upscale_model",
+		"override_settings.sd_model_checkpoint": "$.checkpoint",
+		"override_settings.sd_vae":              "$.vae",
+	},
+	// RNSDAI is read by RNSDAIPatterns, so the keys are the names of the patterns instead.
+	FormatRNSDAI: {
+		"seed":                                  "seed",
+		"override_settings.sd_model_checkpoint": "model",
+	},
+}
+
+// fooocusPaths are the JSON paths of the Fooocus metadata.
+var fooocusPaths = map[string]string{
+	"prompt":             "$.prompt",
+	"negative_prompt":    "$.negative_prompt",
+	"styles":             "$.styles",
+	"sampler_name":       "$.sampler",
+	"scheduler":          "$.scheduler",
+	"width":              "$.resolution",
+	"height":             "$.resolution",
+	"steps":              "$.steps",
+	"seed":               "$.seed",
+	"cfg_scale":          "$.guidance_scale",
+	"refiner_checkpoint": "$.refiner_model",
+	"refiner_switch_at":  "$.refiner_switch",
+	"override_settings.CLIP_stop_at_last_layers": "$.clip_skip",
+	"override_settings.sd_model_checkpoint":      "$.base_model",
+	"override_settings.sd_checkpoint_hash":       "$.base_model_hash",
+	"override_settings.sd_vae":                   "$.vae",
+}
+
+// invokeAIPaths are the JSON paths of the InvokeAI metadata.
+var invokeAIPaths = map[string]string{
+	"prompt":                                "$.positive_prompt",
+	"negative_prompt":                       "$.negative_prompt",
+	"width":                                 "$.width",
+	"height":                                "$.height",
+	"seed":                                  "$.seed",
+	"cfg_scale":                             "$.cfg_scale",
+	"steps":                                 "$.steps",
+	"sampler_name":                          "$.scheduler",
+	"scheduler":                             "$.scheduler",
+	"lora_hashes":                           "$.loras",
+	"override_settings.randn_source":        "$.rand_device",
+	"override_settings.sd_model_checkpoint": "$.model.name",
+	"override_settings.sd_checkpoint_hash":  "$.model.hash",
+}
+
+// novelAIPaths are the JSON paths of the NovelAI metadata, where the parameters are in the Comment chunk.
+var novelAIPaths = map[string]string{
+	"prompt":             "$.Comment.prompt",
+	"negative_prompt":    "$.Comment.uc",
+	"steps":              "$.Comment.steps",
+	"cfg_scale":          "$.Comment.scale",
+	"seed":               "$.Comment.seed",
+	"width":              "$.Comment.width",
+	"height":             "$.Comment.height",
+	"batch_size":         "$.Comment.n_samples",
+	"sampler_name":       "$.Comment.sampler",
+	"scheduler":          "$.Comment.noise_schedule",
+	"denoising_strength": "$.Comment.strength",
+}
+
+// underPath moves the JSON paths under the key of an object, e.g. "$.seed" to "$['image_1'].seed".
+func underPath(paths map[string]string, key string) map[string]string {
+	moved := make(map[string]string, len(paths))
+	for field, path := range paths {
+		moved[field] = fmt.Sprintf("$[%q]", key) + strings.TrimPrefix(path, "$")
+	}
+	return moved
+}
+
+// ComfyUIProvenance records the node ID of the samplers, checkpoint loaders and latent images a field was read from.
+// Fields that can't be traced to a node fall back to ConvertedProvenance with a lower confidence.
+func ComfyUIProvenance(api comfyui.Api, request *entities.TextToImageRequest) entities.Provenance {
+	provenance := ConvertedProvenance(request, entities.SourceComfyUI, nil, ConfidenceComfyUI/2)
+	if request == nil {
+		return provenance
+	}
+	paths := fieldPaths(request)
+
+	for id, node := range api {
+		var inputs map[string]any
+		switch node.ClassType {
+		case comfyui.KSampler, comfyui.KSamplerAdvanced, comfyui.KSamplerEfficient, comfyui.KSamplerAdvancedEfficient:
+			inputs = map[string]any{
+				"seed":         &request.Seed,
+				"noise_seed":   &request.Seed,
+				"steps":        &request.Steps,
+				"cfg":          &request.CFGScale,
+				"sampler_name": &request.SamplerName,
+				"scheduler":    &request.Scheduler,
+				"denoise":      &request.DenoisingStrength,
+			}
+		case comfyui.CheckpointLoaderSimple:
+			inputs = map[string]any{"ckpt_name": &request.OverrideSettings.SDModelCheckpoint}
+		case comfyui.EmptyLatentImage:
+			inputs = map[string]any{"width": &request.Width, "height": &request.Height}
+		default:
+			continue
+		}
+		for input, ptr := range inputs {
+			if _, ok := node.Inputs[input]; !ok || reflect.ValueOf(ptr).Elem().IsZero() {
+				continue
+			}
+			provenance.Add(paths.of(ptr), entities.Evidence{
+				Source:     entities.SourceComfyUI,
+				Key:        id,
+				Text:       input,
+				Start:      -1,
+				End:        -1,
+				Confidence: ConfidenceComfyUI,
+			})
+		}
+	}
+
+	return provenance
+}
+
+// chunkProvenance records the Evidence of a request parsed by parseParams from the PNG chunks of a file.
+// The NovelAI metadata and the generation data in the parameters are JSON, while the rest is an infotext.
+func chunkProvenance(chunk PNGChunk, request *entities.TextToImageRequest) entities.Provenance {
+	if chunk["Software"] == "NovelAI" {
+		return ConvertedProvenance(request, entities.SourceJSON, novelAIPaths, ConfidenceJSON)
+	}
+	parameters, ok := chunk[Parameters]
+	if !ok {
+		return nil
+	}
+	switch kind := DetectGenerationData([]byte(parameters)); kind {
+	case GenerationDataUnknown, GenerationDataCivitaiText:
+		return infotextProvenance(parameters, request)
+	default:
+		return ConvertedProvenance(request, entities.SourceJSON, jsonPaths[Format(kind)], ConfidenceJSON)
+	}
+}
+
+// infotextProvenance records the span of every key of TextToImageFields found in the parameters.
+func infotextProvenance(parameters string, request *entities.TextToImageRequest) entities.Provenance {
+	provenance := make(entities.Provenance)
+	paths := fieldPaths(request)
+
+	spans := make(map[string][2]int)
+	for _, m := range allParams.FindAllStringSubmatchIndex(parameters, -1) {
+		key := parameters[m[2]:m[3]]
+		if _, ok := spans[key]; !ok {
+			spans[key] = [2]int{m[2], m[5]}
+		}
+	}
+
+	for key, ptr := range TextToImageFields(request) {
+		if reflect.ValueOf(ptr).Elem().IsZero() {
+			continue
+		}
+		written := key
+		if alias, ok := infotextAliases[key]; ok {
+			written = alias
+		}
+		span, ok := spans[written]
+		if !ok {
+			provenance.Add(paths.of(ptr), entities.Evidence{
+				Source:     entities.SourceDefault,
+				Key:        key,
+				Start:      -1,
+				End:        -1,
+				Confidence: ConfidenceDefault,
+			})
+			continue
+		}
+		provenance.Add(paths.of(ptr), entities.Evidence{
+			Source:     entities.SourceInfotext,
+			Key:        written,
+			Text:       parameters[span[0]:span[1]],
+			Start:      span[0],
+			End:        span[1],
+			Confidence: ConfidenceInfotext,
+		})
+	}
+
+	for field, text := range map[string]string{"prompt": request.Prompt, "negative_prompt": request.NegativePrompt} {
+		if text == "" {
+			continue
+		}
+		start, end := locate(parameters, text)
+		provenance.Add(field, entities.Evidence{
+			Source:     entities.SourceInfotext,
+			Key:        field,
+			Text:       text,
+			Start:      start,
+			End:        end,
+			Confidence: ConfidenceInfotext,
+		})
+	}
+
+	return provenance
+}
+
+// regexEvidence returns the span of the capture group with the same name as the pattern.
+func regexEvidence(s, name string, r *regexp.Regexp) (entities.Evidence, bool) {
+	m := r.FindStringSubmatchIndex(s)
+	if m == nil {
+		return entities.Evidence{}, false
+	}
+	start, end := m[0], m[1]
+	for i, group := range r.SubexpNames() {
+		if i > 0 && group != "" && m[2*i] >= 0 {
+			start, end = m[2*i], m[2*i+1]
+			break
+		}
+	}
+	confidence, ok := patternConfidence[name]
+	if !ok {
+		confidence = ConfidenceRegex
+	}
+	return entities.Evidence{
+		Source:     entities.SourceRegex,
+		Key:        name,
+		Text:       s[start:end],
+		Start:      start,
+		End:        end,
+		Confidence: confidence,
+	}, true
+}
+
+// shiftProvenance moves the spans found in the substring to their offset in s.
+func shiftProvenance(provenance entities.Provenance, s, substring string) {
+	offset := strings.Index(s, substring)
+	for field, evidence := range provenance {
+		if evidence.Start < 0 {
+			continue
+		}
+		if offset < 0 {
+			evidence.Start, evidence.End = locate(s, evidence.Text)
+		} else {
+			evidence.Start += offset
+			evidence.End += offset
+		}
+		provenance[field] = evidence
+	}
+}
+
+// locate returns the span of text in s, or -1 if it isn't there verbatim.
+func locate(s, text string) (int, int) {
+	if i := strings.Index(s, text); i >= 0 && text != "" {
+		return i, i + len(text)
+	}
+	return -1, -1
+}
+
+type fieldKey struct {
+	addr uintptr
+	typ  reflect.Type
+}
+
+// requestPaths maps the address of each field in a TextToImageRequest to its JSON path.
+type requestPaths map[fieldKey]string
+
+func (p requestPaths) of(ptr any) string {
+	v := reflect.ValueOf(ptr)
+	return p[fieldKey{v.Pointer(), v.Type().Elem()}]
+}
+
+func fieldPaths(request *entities.TextToImageRequest) requestPaths {
+	paths := make(requestPaths)
+	walkFields(reflect.ValueOf(request).Elem(), "", func(path string, v reflect.Value) {
+		paths[fieldKey{v.UnsafeAddr(), v.Type()}] = path
+	})
+	return paths
+}
+
+// setFields returns the JSON path of every field that isn't the zero value, including nested structs.
+func setFields(request *entities.TextToImageRequest) []string {
+	var fields []string
+	walkFields(reflect.ValueOf(request).Elem(), "", func(path string, v reflect.Value) {
+		if v.Kind() != reflect.Struct && !v.IsZero() {
+			fields = append(fields, path)
+		}
+	})
+	return fields
+}
+
+func walkFields(v reflect.Value, prefix string, visit func(path string, v reflect.Value)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		path := prefix + name
+		visit(path, v.Field(i))
+		if f.Type.Kind() == reflect.Struct {
+			walkFields(v.Field(i), path+".", visit)
+		}
+	}
+}
@@ -1,7 +1,6 @@
 package utils
 
 import (
-	"bytes"
 	"regexp"
 )
 
@@ -29,13 +28,12 @@ var (
 		"version":    regexp.MustCompile(`(?i)version[:\s-]+(?P<version>v[\w.-]+)`),
 	}
 
-	// RNSDAIPatterns are preset regexp.Regexp patterns for IDRNSDAI
+	// RNSDAIPatterns are preset regexp.Regexp patterns for IDRNSDAI.
+	// The prompts are found with BBNode.Section instead.
 	RNSDAIPatterns = map[string]*regexp.Regexp{
-		"model":    regexp.MustCompile(`(?i)model[\s•]*\[b](?P<model>[^[]+)\[/b]`),
-		"seed":     regexp.MustCompile(`(?i)seeds[\s•]*\[(?P<seed>\d+)]?`),
-		"version":  regexp.MustCompile(`(?i)image generator[\s•]*[^:]+: v[\d.]+`),
-		"prompt":   regexp.MustCompile(`(?is)positive prompt:\[/b]\n(?P<prompt>.*?)\n\[/q]`),
-		"negative": regexp.MustCompile(`(?is)negative prompt:\[/b]\n(?P<negative>.*?)\n\[/q]`),
+		"model":   regexp.MustCompile(`(?i)model[\s•]*\[b](?P<model>[^[]+)\[/b]`),
+		"seed":    regexp.MustCompile(`(?i)seeds[\s•]*\[(?P<seed>\d+)]?`),
+		"version": regexp.MustCompile(`(?i)image generator[\s•]*[^:]+: v[\d.]+`),
 	}
 
 	// allParms is a regexp.Regexp pattern to extract all parameters from a string.
@@ -57,18 +55,6 @@ var (
 
 	stepsStart = regexp.MustCompile(`(?i)^steps: ?\d`)
 	StepsStart = regexp.MustCompile(`(?im)^Steps: ?\d+, Sampler:`)
-
-	extractJson    = regexp.MustCompile(`(?ms){.*}`)
-	removeComments = regexp.MustCompile(`(?m)//.*$`)
-	fixParentheses = regexp.MustCompile(`\\+([()])`)
-
-	newLineFix       = []byte("\n")
-	quoteFix         = []byte(`\"`)
-	stringExtraction = regexp.MustCompile(`(?s)(:\s+")(.*?)(",\n)|(?s)(:\s+")(.*?)(".*?\n)`)
-
-	parenthesesReplacement = []byte(`\\$1`)
-	newLineReplacement     = []byte(`\n`)
-	quoteReplacement       = []byte(`"`)
 )
 
 func RemoveBBCode(s string) string {
@@ -87,8 +73,10 @@ func CleanText(s string) string {
 
 type ExtractResult map[string]string
 
+// ExtractAll extracts every pattern from s, after translating the keys known to Locales to English.
 func ExtractAll(s string, reg map[string]*regexp.Regexp) ExtractResult {
 	var result = make(ExtractResult)
+	s = Locales.Normalize(s)
 
 	for key, r := range reg {
 		result[key] = Extract(s, r)
@@ -141,22 +129,13 @@ func Extract(s string, r *regexp.Regexp) string {
 	return ""
 }
 
+// ExtractJson returns the largest JSON object in the content using RepairJSON,
+// so that comments, escaped parentheses and newlines in strings from an LLM or a hand-written file are fixed.
+// Use RepairJSON directly to know what was repaired.
 func ExtractJson(content []byte) []byte {
-	// Extracts everything from `{.*}`
-	content = extractJson.Find(content)
-
-	// Fix newlines inside strings
-	// replace 2nd and 5th capturing group's char(10) newlines inside strings to `\n`
-	content = stringExtraction.ReplaceAllFunc(content, func(s []byte) []byte {
-		matches := stringExtraction.FindSubmatch(s)
-		// replace newlines inside strings with \n
-		matches[2] = bytes.ReplaceAll(matches[2], newLineFix, newLineReplacement)
-		matches[5] = bytes.ReplaceAll(matches[5], newLineFix, newLineReplacement)
-		return bytes.Join(matches[1:], nil)
-	})
-
-	// Fix escaped parentheses e.g. `\(text\)` to `\\(text\\)`
-	content = fixParentheses.ReplaceAll(content, parenthesesReplacement)
-	content = removeComments.ReplaceAll(content, nil)
-	return content
+	repaired, _, err := RepairJSON(content)
+	if err != nil {
+		return nil
+	}
+	return repaired
 }
@@ -0,0 +1,526 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// RepairKind is a kind of fix made by RepairJSON.
+type RepairKind string
+
+const (
+	RepairSurroundingText  RepairKind = "surrounding text"  // prose or a markdown fence around the JSON
+	RepairComment          RepairKind = "comment"           // a // or /* */ comment
+	RepairTrailingComma    RepairKind = "trailing comma"    // a comma before a closing bracket, or an extra comma
+	RepairMissingComma     RepairKind = "missing comma"     // two values without a comma between them
+	RepairMissingColon     RepairKind = "missing colon"     // a key without a colon after it
+	RepairMissingValue     RepairKind = "missing value"     // a key without a value, replaced with null
+	RepairSingleQuotes     RepairKind = "single quotes"     // a 'string' instead of a "string"
+	RepairUnquotedKey      RepairKind = "unquoted key"      // {key: value}
+	RepairUnquotedString   RepairKind = "unquoted string"   // a bare word that isn't a literal, e.g. 2024-05-21
+	RepairLiteral          RepairKind = "literal"           // True, False, None, NaN, Infinity or undefined
+	RepairNumber           RepairKind = "number"            // +1, .5 or 1.
+	RepairEscape           RepairKind = "escape"            // an invalid escape such as \( or \'
+	RepairControlCharacter RepairKind = "control character" // a raw newline or tab inside a string
+	RepairUnescapedQuote   RepairKind = "unescaped quote"   // a quote inside a string that doesn't end it
+	RepairBracket          RepairKind = "bracket"           // a closing bracket that doesn't match, e.g. [1, 2}
+	RepairTruncated        RepairKind = "truncated"         // the input ended before the value was closed
+)
+
+// Repair is a fix made by RepairJSON. Offset is the byte offset in the input where it was made.
+type Repair struct {
+	Kind   RepairKind `json:"kind"`
+	Offset int        `json:"offset"`
+}
+
+func (r Repair) String() string {
+	return fmt.Sprintf("%s at %d", r.Kind, r.Offset)
+}
+
+// ErrNoJSON is returned by RepairJSON when the content has no object.
+var ErrNoJSON = errors.New("no JSON object found")
+
+// ErrTooDeep is returned by RepairJSON when the objects and arrays are nested deeper than maxRepairDepth.
+var ErrTooDeep = errors.New("JSON is nested too deeply to repair")
+
+// maxRepairDepth is the deepest RepairJSON recurses, which is far more than any metadata or LLM response needs.
+const maxRepairDepth = 1000
+
+// RepairJSON returns the largest object in the content as valid JSON, and every fix it had to make.
+// Arrays are only repaired as values inside the object.
+// It accepts the relaxed JSON written by an LLM or by hand: comments, trailing commas, single quotes,
+// unquoted keys, Python literals like True and None, invalid escapes, raw newlines in strings,
+// and output that was cut off before it was closed.
+func RepairJSON(content []byte) ([]byte, []Repair, error) {
+	trimmed := bytes.TrimSpace(content)
+	if len(trimmed) > 0 && trimmed[0] == '{' && json.Valid(trimmed) {
+		return trimmed, nil, nil
+	}
+
+	var best *jsonRepairer
+	for start := 0; start < len(content); {
+		i := bytes.IndexByte(content[start:], '{')
+		if i < 0 {
+			break
+		}
+		r := &jsonRepairer{in: content, pos: start + i}
+		r.value()
+		if r.tooDeep {
+			return nil, r.repairs, ErrTooDeep
+		}
+		if best == nil || r.out.Len() > best.out.Len() {
+			best = r
+			best.start = start + i
+		}
+		start = max(r.pos, start+i+1)
+	}
+	if best == nil {
+		return nil, nil, ErrNoJSON
+	}
+
+	if len(bytes.TrimSpace(content[:best.start])) > 0 {
+		best.repairs = slices.Insert(best.repairs, 0, Repair{RepairSurroundingText, 0})
+	}
+	if len(bytes.TrimSpace(content[best.pos:])) > 0 {
+		best.repair(RepairSurroundingText)
+	}
+
+	out := best.out.Bytes()
+	if !json.Valid(out) {
+		return out, best.repairs, errors.New("could not repair JSON")
+	}
+	return out, best.repairs, nil
+}
+
+// jsonRepairer is a recursive descent parser that writes valid JSON as it reads the relaxed input.
+type jsonRepairer struct {
+	in      []byte
+	pos     int
+	start   int
+	out     bytes.Buffer
+	stack   []byte // the closing bracket of every open container
+	repairs []Repair
+	tooDeep bool // the containers are nested deeper than maxRepairDepth
+}
+
+func (r *jsonRepairer) repair(kind RepairKind) {
+	r.repairs = append(r.repairs, Repair{kind, r.pos})
+}
+
+func (r *jsonRepairer) eof() bool {
+	return r.pos >= len(r.in)
+}
+
+func (r *jsonRepairer) peek() byte {
+	if r.eof() {
+		return 0
+	}
+	return r.in[r.pos]
+}
+
+// skip skips whitespace and comments.
+func (r *jsonRepairer) skip() {
+	for !r.eof() {
+		switch c := r.in[r.pos]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			r.pos++
+		case bytes.HasPrefix(r.in[r.pos:], []byte("//")):
+			r.repair(RepairComment)
+			if end := bytes.IndexByte(r.in[r.pos:], '\n'); end >= 0 {
+				r.pos += end + 1
+			} else {
+				r.pos = len(r.in)
+			}
+		case bytes.HasPrefix(r.in[r.pos:], []byte("/*")):
+			r.repair(RepairComment)
+			if end := bytes.Index(r.in[r.pos+2:], []byte("*/")); end >= 0 {
+				r.pos += end + 4
+			} else {
+				r.pos = len(r.in)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// closes reports whether c closes the current container, or a container it's in.
+func (r *jsonRepairer) closes(c byte) bool {
+	return slices.Contains(r.stack, c)
+}
+
+// value writes the value at the current position. It returns false if there was nothing to read.
+func (r *jsonRepairer) value() bool {
+	r.skip()
+	if r.eof() {
+		return false
+	}
+	switch c := r.peek(); c {
+	case '{':
+		r.container('{', '}')
+	case '[':
+		r.container('[', ']')
+	case '"', '\'':
+		r.string()
+	case ',', '}', ']':
+		return false
+	default:
+		r.bare()
+	}
+	return true
+}
+
+// container writes an object or an array, and closes it if the input ends first.
+func (r *jsonRepairer) container(open, close byte) {
+	if len(r.stack) >= maxRepairDepth {
+		r.tooDeep = true
+		r.pos = len(r.in)
+		return
+	}
+	r.pos++
+	r.out.WriteByte(open)
+	r.stack = append(r.stack, close)
+	defer func() { r.stack = r.stack[:len(r.stack)-1] }()
+
+	members := 0
+	for {
+		r.skip()
+		if r.eof() {
+			r.repair(RepairTruncated)
+			break
+		}
+		c := r.peek()
+		if c == close {
+			r.pos++
+			break
+		}
+		if c == '}' || c == ']' {
+			if r.closes(c) {
+				// Close this container and leave the bracket to the container it belongs to
+				r.repair(RepairBracket)
+				break
+			}
+			r.repair(RepairBracket)
+			r.pos++
+			continue
+		}
+		if c == ',' {
+			r.repair(RepairTrailingComma)
+			r.pos++
+			continue
+		}
+
+		mark := r.out.Len()
+		if members > 0 {
+			r.out.WriteByte(',')
+		}
+		if open == '{' && !r.member() {
+			r.out.Truncate(mark)
+			if r.eof() {
+				break
+			}
+			continue
+		}
+		if open == '[' && !r.value() {
+			r.out.Truncate(mark)
+			continue
+		}
+		members++
+
+		r.skip()
+		switch c := r.peek(); {
+		case c == ',':
+			r.pos++
+			r.skip()
+			if r.peek() == close {
+				r.repair(RepairTrailingComma)
+			}
+		case r.eof(), c == close, c == '}', c == ']':
+		default:
+			r.repair(RepairMissingComma)
+		}
+	}
+	r.out.WriteByte(close)
+}
+
+// member writes a key and its value. It returns false if the key has no value because the input ended.
+func (r *jsonRepairer) member() bool {
+	switch r.peek() {
+	case '"', '\'':
+		r.string()
+	default:
+		if !r.key() {
+			return false
+		}
+	}
+
+	r.skip()
+	if r.eof() {
+		r.repair(RepairTruncated)
+		return false
+	}
+	if c := r.peek(); c == ':' || c == '=' {
+		if c == '=' {
+			r.repair(RepairMissingColon)
+		}
+		r.pos++
+	} else {
+		r.repair(RepairMissingColon)
+	}
+	r.out.WriteByte(':')
+
+	r.skip()
+	if r.eof() {
+		r.repair(RepairTruncated)
+		return false
+	}
+	if !r.value() {
+		r.repair(RepairMissingValue)
+		r.out.WriteString("null")
+	}
+	return true
+}
+
+// key writes an unquoted key. It returns false if there was no key to read.
+func (r *jsonRepairer) key() bool {
+	start := r.pos
+	for !r.eof() && !strings.ContainsRune(" \t\r\n:=,{}[]\"'", rune(r.peek())) {
+		r.pos++
+	}
+	if r.pos == start {
+		// Skip a character that can't start a key so that the object can continue
+		r.repair(RepairUnquotedKey)
+		r.pos++
+		return false
+	}
+	r.repairs = append(r.repairs, Repair{RepairUnquotedKey, start})
+	writeString(&r.out, string(r.in[start:r.pos]))
+	return true
+}
+
+// string writes a single or double quoted string.
+func (r *jsonRepairer) string() {
+	quote := r.peek()
+	if quote == '\'' {
+		r.repair(RepairSingleQuotes)
+	}
+	r.pos++
+	r.out.WriteByte('"')
+	defer r.out.WriteByte('"')
+
+	for {
+		if r.eof() {
+			r.repair(RepairTruncated)
+			return
+		}
+		c := r.in[r.pos]
+		switch {
+		case c == '\\':
+			if r.pos+1 >= len(r.in) {
+				r.repair(RepairTruncated)
+				r.pos++
+				return
+			}
+			switch n := r.in[r.pos+1]; n {
+			case '"', '\\', '/', 'b', 'f', 'n', 'r', 't':
+				r.out.Write(r.in[r.pos : r.pos+2])
+				r.pos += 2
+			case 'u':
+				if r.pos+6 <= len(r.in) && isHex(r.in[r.pos+2:r.pos+6]) {
+					r.out.Write(r.in[r.pos : r.pos+6])
+					r.pos += 6
+					continue
+				}
+				r.repair(RepairEscape)
+				r.out.WriteString(`\\`)
+				r.pos++
+			case '\'':
+				r.repair(RepairEscape)
+				r.out.WriteByte('\'')
+				r.pos += 2
+			default:
+				// Keep the backslash, e.g. the \( of an escaped parenthesis in a prompt
+				r.repair(RepairEscape)
+				r.out.WriteString(`\\`)
+				r.pos++
+			}
+		case c == quote:
+			if !r.stringEnds(r.pos + 1) {
+				r.repair(RepairUnescapedQuote)
+				if quote == '"' {
+					r.out.WriteString(`\"`)
+				} else {
+					r.out.WriteByte(quote)
+				}
+				r.pos++
+				continue
+			}
+			r.pos++
+			return
+		case c == '"':
+			r.out.WriteString(`\"`)
+			r.pos++
+		case c < 0x20:
+			r.repair(RepairControlCharacter)
+			switch c {
+			case '\n':
+				r.out.WriteString(`\n`)
+			case '\r':
+				r.out.WriteString(`\r`)
+			case '\t':
+				r.out.WriteString(`\t`)
+			default:
+				fmt.Fprintf(&r.out, `\u%04x`, c)
+			}
+			r.pos++
+		default:
+			r.out.WriteByte(c)
+			r.pos++
+		}
+	}
+}
+
+// stringEnds reports whether a quote followed by the text at i ends a string,
+// which is when it's followed by a colon, a closing bracket, the end of the input,
+// or a comma before something that starts a value or a key.
+func (r *jsonRepairer) stringEnds(i int) bool {
+	for i < len(r.in) && (r.in[i] == ' ' || r.in[i] == '\t' || r.in[i] == '\r' || r.in[i] == '\n') {
+		i++
+	}
+	if i >= len(r.in) {
+		return true
+	}
+	switch r.in[i] {
+	case ':', '}', ']':
+		return true
+	case '/':
+		return i+1 < len(r.in) && (r.in[i+1] == '/' || r.in[i+1] == '*')
+	case ',':
+	default:
+		return false
+	}
+
+	for i++; i < len(r.in) && (r.in[i] == ' ' || r.in[i] == '\t' || r.in[i] == '\r' || r.in[i] == '\n'); i++ {
+	}
+	if i >= len(r.in) {
+		return true
+	}
+	switch c := r.in[i]; {
+	case strings.IndexByte(`"'{}[]-/`, c) >= 0, c >= '0' && c <= '9':
+		return true
+	}
+	// An unquoted key, e.g. `"a cat", steps: 20`
+	j := i
+	for j < len(r.in) && (isWordByte(r.in[j])) {
+		j++
+	}
+	for j < len(r.in) && (r.in[j] == ' ' || r.in[j] == '\t') {
+		j++
+	}
+	return j > i && j < len(r.in) && r.in[j] == ':'
+}
+
+// bareLiterals are the words written by Python, JavaScript or by hand in place of a JSON literal.
+var bareLiterals = map[string]string{
+	"True":      "true",
+	"False":     "false",
+	"None":      "null",
+	"nil":       "null",
+	"undefined": "null",
+	"NaN":       "null",
+	"Infinity":  "null",
+	"-Infinity": "null",
+	"+Infinity": "null",
+}
+
+// bare writes an unquoted number, literal or string, which ends at a comma, a closing bracket or a newline.
+func (r *jsonRepairer) bare() {
+	start := r.pos
+	for !r.eof() {
+		c := r.peek()
+		if c == ',' || c == '}' || c == ']' || c == '\n' || c == '\r' ||
+			bytes.HasPrefix(r.in[r.pos:], []byte("//")) || bytes.HasPrefix(r.in[r.pos:], []byte("/*")) {
+			break
+		}
+		r.pos++
+	}
+	token := strings.TrimSpace(string(r.in[start:r.pos]))
+
+	switch {
+	case token == "true" || token == "false" || token == "null":
+		r.out.WriteString(token)
+		return
+	case bareLiterals[token] != "":
+		r.repairs = append(r.repairs, Repair{RepairLiteral, start})
+		r.out.WriteString(bareLiterals[token])
+		return
+	}
+
+	if number, ok := normalizeNumber(token); ok {
+		if number != token {
+			r.repairs = append(r.repairs, Repair{RepairNumber, start})
+		}
+		r.out.WriteString(number)
+		return
+	}
+
+	r.repairs = append(r.repairs, Repair{RepairUnquotedString, start})
+	writeString(&r.out, token)
+}
+
+// normalizeNumber returns the number as valid JSON, e.g. "+.5" as "0.5" and "1." as "1".
+func normalizeNumber(s string) (string, bool) {
+	if s == "" {
+		return "", false
+	}
+	if _, err := strconv.ParseFloat(s, 64); err != nil {
+		return "", false
+	}
+	if json.Valid([]byte(s)) {
+		return s, true
+	}
+
+	sign := ""
+	switch s[0] {
+	case '-':
+		sign, s = "-", s[1:]
+	case '+':
+		s = s[1:]
+	}
+	if strings.HasPrefix(s, ".") {
+		s = "0" + s
+	}
+	s = strings.Replace(s, ".e", "e", 1)
+	s = strings.Replace(s, ".E", "E", 1)
+	s = strings.TrimSuffix(s, ".")
+	for len(s) > 1 && s[0] == '0' && s[1] != '.' && s[1] != 'e' && s[1] != 'E' {
+		s = s[1:]
+	}
+	if !json.Valid([]byte(sign + s)) {
+		return "", false
+	}
+	return sign + s, true
+}
+
+func writeString(out *bytes.Buffer, s string) {
+	b, _ := json.Marshal(s)
+	out.Write(b)
+}
+
+func isHex(b []byte) bool {
+	for _, c := range b {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c == '-' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
@@ -0,0 +1,221 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ellypaws/inkbunny-sd/entities"
+)
+
+var (
+	// adetailerKey matches "ADetailer model", "ADetailer prompt 2nd", "ADetailer CFG scale 3rd"
+	adetailerKey = regexp.MustCompile(`^ADetailer (.+?)(?: (\d+)(?:st|nd|rd|th))?$`)
+	// controlNetKey matches the quoted unit "ControlNet 0"
+	controlNetKey = regexp.MustCompile(`^ControlNet (\d+)$`)
+	// controlNetLegacyKey matches the older flat keys "ControlNet-0 Module"
+	controlNetLegacyKey = regexp.MustCompile(`^ControlNet-(\d+) (.+)$`)
+)
+
+// ScriptHeuristics fills the alwayson_scripts of the request from the extension keys of an infotext.
+// It recognizes ADetailer (including the "2nd", "3rd" suffixes for extra units),
+// ControlNet ("ControlNet 0: \"Module: ..., Model: ...\"" and the older "ControlNet-0 Module: ...")
+// and Regional Prompter ("RP Active: True, RP Divide mode: ...").
+func ScriptHeuristics(results ExtractResult, scripts *entities.Scripts) error {
+	if scripts == nil {
+		return nil
+	}
+
+	var (
+		adetailer  = make(map[int]ExtractResult)
+		controlNet = make(map[int]ExtractResult)
+		rp         = make(ExtractResult)
+	)
+
+	for key, value := range results {
+		switch {
+		case key == "ADetailer version":
+			continue
+		case adetailerKey.MatchString(key):
+			match := adetailerKey.FindStringSubmatch(key)
+			unit := 0
+			if match[2] != "" {
+				unit, _ = strconv.Atoi(match[2])
+				unit--
+			}
+			if adetailer[unit] == nil {
+				adetailer[unit] = make(ExtractResult)
+			}
+			adetailer[unit][strings.ToLower(match[1])] = unquote(value)
+		case controlNetKey.MatchString(key):
+			unit, _ := strconv.Atoi(controlNetKey.FindStringSubmatch(key)[1])
+			if controlNet[unit] == nil {
+				controlNet[unit] = make(ExtractResult)
+			}
+			for k, v := range ExtractKeys(unquote(value)) {
+				controlNet[unit][strings.ToLower(k)] = unquote(v)
+			}
+		case controlNetLegacyKey.MatchString(key):
+			match := controlNetLegacyKey.FindStringSubmatch(key)
+			unit, _ := strconv.Atoi(match[1])
+			if controlNet[unit] == nil {
+				controlNet[unit] = make(ExtractResult)
+			}
+			controlNet[unit][strings.ToLower(match[2])] = unquote(value)
+		case strings.HasPrefix(key, "RP "):
+			rp[strings.ToLower(strings.TrimPrefix(key, "RP "))] = unquote(value)
+		}
+	}
+
+	for _, unit := range sortedUnits(adetailer) {
+		var args entities.ADetailerParameters
+		if err := ResultsToFields(adetailer[unit], adetailerFields(&args)); err != nil {
+			return fmt.Errorf("error parsing ADetailer unit %d: %w", unit+1, err)
+		}
+		if scripts.ADetailer == nil {
+			scripts.ADetailer = &entities.ADetailer{}
+		}
+		scripts.ADetailer.Args = append(scripts.ADetailer.Args, &args)
+	}
+
+	for _, unit := range sortedUnits(controlNet) {
+		result := controlNet[unit]
+		if enabled, ok := result["enabled"]; ok && enabled != "True" {
+			continue
+		}
+		// thresholds and processor resolution are written as floats but the API takes ints
+		for _, key := range []string{"processor res", "threshold a", "threshold b"} {
+			if f, err := strconv.ParseFloat(result[key], 64); err == nil {
+				result[key] = strconv.Itoa(int(f))
+			}
+		}
+		var args entities.ControlNetParameters
+		if err := ResultsToFields(result, controlNetFields(&args)); err != nil {
+			return fmt.Errorf("error parsing ControlNet unit %d: %w", unit, err)
+		}
+		if scripts.ControlNet == nil {
+			scripts.NewControlNet()
+		}
+		scripts.ControlNet.Args = append(scripts.ControlNet.Args, &args)
+	}
+
+	if active, ok := rp["active"]; len(rp) > 0 && (!ok || active == "True") {
+		var args entities.RegionalPrompterParameters
+		if err := ResultsToFields(rp, regionalPrompterFields(&args)); err != nil {
+			return fmt.Errorf("error parsing Regional Prompter: %w", err)
+		}
+		scripts.RegionalPrompter = &entities.RegionalPrompter{Args: args}
+	}
+
+	return nil
+}
+
+func sortedUnits(units map[int]ExtractResult) []int {
+	keys := make([]int, 0, len(units))
+	for k := range units {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// unquote removes the quotes the webui adds with json.dumps when a value contains a comma, colon, newline or quote.
+func unquote(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+	var out string
+	if err := json.Unmarshal([]byte(s), &out); err != nil {
+		return strings.Trim(s, `"`)
+	}
+	return out
+}
+
+// adetailerFields maps the lowercased ADetailer infotext keys without the "ADetailer " prefix and unit suffix.
+func adetailerFields(args *entities.ADetailerParameters) map[string]any {
+	return map[string]any{
+		"model":                         &args.AdModel,
+		"prompt":                        &args.AdPrompt,
+		"negative prompt":               &args.AdNegativePrompt,
+		"confidence":                    &args.AdConfidence,
+		"mask only top k largest":       &args.AdMaskKLargest,
+		"mask min ratio":                &args.AdMaskMinRatio,
+		"mask max ratio":                &args.AdMaskMaxRatio,
+		"dilate erode":                  &args.AdDilateErode,
+		"dilate/erode":                  &args.AdDilateErode,
+		"x offset":                      &args.AdXOffset,
+		"y offset":                      &args.AdYOffset,
+		"mask merge invert":             &args.AdMaskMergeInvert,
+		"mask blur":                     &args.AdMaskBlur,
+		"denoising strength":            &args.AdDenoisingStrength,
+		"inpaint only masked":           &args.AdInpaintOnlyMasked,
+		"inpaint padding":               &args.AdInpaintOnlyMaskedPadding,
+		"use inpaint width height":      &args.AdUseInpaintWidthHeight,
+		"use inpaint width/height":      &args.AdUseInpaintWidthHeight,
+		"inpaint width":                 &args.AdInpaintWidth,
+		"inpaint height":                &args.AdInpaintHeight,
+		"use separate steps":            &args.AdUseSteps,
+		"steps":                         &args.AdSteps,
+		"use separate cfg scale":        &args.AdUseCfgScale,
+		"cfg scale":                     &args.AdCfgScale,
+		"use separate sampler":          &args.AdUseSampler,
+		"sampler":                       &args.AdSampler,
+		"use separate noise multiplier": &args.AdUseNoiseMultiplier,
+		"noise multiplier":              &args.AdNoiseMultiplier,
+		"use separate clip skip":        &args.AdUseClipSkip,
+		"clip skip":                     &args.AdClipSkip,
+		"restore face":                  &args.AdRestoreFace,
+		"controlnet model":              &args.AdControlnetModel,
+		"controlnet module":             &args.AdControlnetModule,
+		"controlnet weight":             &args.AdControlnetWeight,
+		"controlnet guidance start":     &args.AdControlnetGuidanceStart,
+		"controlnet guidance end":       &args.AdControlnetGuidanceEnd,
+	}
+}
+
+// controlNetFields maps the lowercased keys inside a quoted ControlNet unit.
+func controlNetFields(args *entities.ControlNetParameters) map[string]any {
+	return map[string]any{
+		"module":         &args.Module,
+		"preprocessor":   &args.Module,
+		"model":          &args.Model,
+		"weight":         &args.Weight,
+		"resize mode":    (*string)(&args.ResizeMode),
+		"low vram":       &args.Lowvram,
+		"processor res":  &args.ProcessorRes,
+		"threshold a":    &args.ThresholdA,
+		"threshold b":    &args.ThresholdB,
+		"guidance start": &args.GuidanceStart,
+		"guidance end":   &args.GuidanceEnd,
+		"pixel perfect":  &args.PixelPerfect,
+		"control mode":   (*string)(&args.ControlMode),
+	}
+}
+
+// regionalPrompterFields maps the lowercased Regional Prompter keys without the "RP " prefix.
+func regionalPrompterFields(args *entities.RegionalPrompterParameters) map[string]any {
+	return map[string]any{
+		"active":               &args.Active,
+		"divide mode":          &args.Mode,
+		"matrix submode":       &args.MatrixMode,
+		"mask submode":         &args.MaskMode,
+		"prompt submode":       &args.PromptMode,
+		"ratios":               &args.Ratios,
+		"base ratios":          &args.BaseRatios,
+		"use base":             &args.UseBase,
+		"use common":           &args.UseCommon,
+		"use ncommon":          &args.UseNegCommon,
+		"calc mode":            &args.CalcMode,
+		"change and":           &args.NotChangeAND,
+		"lora neg te ratios":   &args.LoRATextEncoder,
+		"lora neg u ratios":    &args.LoRAUNet,
+		"threshold":            &args.Threshold,
+		"lora stop step":       &args.LoRAStopStep,
+		"lora hires stop step": &args.LoRAHiresStopStep,
+		"flip":                 &args.Flip,
+	}
+}
@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Words returns the set of lowercase words in s, split on anything that isn't a letter or a number.
+func Words(s string) map[string]bool {
+	set := make(map[string]bool)
+	for _, word := range strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}) {
+		set[word] = true
+	}
+	return set
+}
+
+// Jaccard is the similarity of two sets of Words, from 0 for no shared words to 1 for the same words.
+func Jaccard(a, b map[string]bool) float64 {
+	var shared int
+	for word := range a {
+		if b[word] {
+			shared++
+		}
+	}
+	if union := len(a) + len(b) - shared; union > 0 {
+		return float64(shared) / float64(union)
+	}
+	return 0
+}
+
+// EstimateTokens is a rough count of the tokens of the text, at about four characters per token.
+func EstimateTokens(s string) int {
+	return (len(s) + 3) / 4
+}
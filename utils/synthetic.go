@@ -0,0 +1,344 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ellypaws/inkbunny-sd/entities"
+)
+
+// SynthStyle is a layout Synthesizer renders requests in.
+type SynthStyle string
+
+const (
+	SynthInfotext SynthStyle = "infotext" // the prompt, the negative prompt and a line of comma separated parameters
+	SynthList     SynthStyle = "list"     // a "key: value" line per field in any order
+	SynthBBCode   SynthStyle = "bbcode"   // a list with BBCode formatting, as written in Inkbunny descriptions
+	SynthAutoSnep SynthStyle = "autosnep" // the PNG text chunks layout of AutoSnep
+	SynthCirn0    SynthStyle = "cirn0"    // the === sections of Cirn0 with the shared parameters on top
+	SynthSoph     SynthStyle = "soph"     // the ./file: and InvokeAI JSON of Soph
+)
+
+// SynthStyles are every SynthStyle.
+var SynthStyles = []SynthStyle{SynthInfotext, SynthList, SynthBBCode, SynthAutoSnep, SynthCirn0, SynthSoph}
+
+// Synthesizer renders known-good requests, such as the ones parsed from clean infotext, into noisy descriptions.
+// The key names, their order, the formatting and the omitted fields vary with Rand, so a seed always renders the same text.
+type Synthesizer struct {
+	Rand   *rand.Rand
+	Styles []SynthStyle // defaults to SynthStyles
+	Omit   float64      // chance of leaving out each field other than the prompt
+}
+
+// NewSynthesizer returns a Synthesizer of every style that omits a fifth of the fields.
+func NewSynthesizer(seed uint64) *Synthesizer {
+	return &Synthesizer{Rand: rand.New(rand.NewPCG(seed, seed)), Omit: 0.2}
+}
+
+// Synthetic is a description rendered by Synthesizer. Request only has the fields that are in the Text,
+// so it's what an extractor is expected to return.
+type Synthetic struct {
+	Style   SynthStyle                  `json:"style"`
+	Text    string                      `json:"text"`
+	Request entities.TextToImageRequest `json:"request"`
+}
+
+// synthField is a field of the request that can be rendered, with the names it's written as.
+type synthField struct {
+	name    string // the name used by the A1111 infotext
+	aliases []string
+	emoji   string
+	value   string
+	set     func(*entities.TextToImageRequest)
+}
+
+var synthPreambles = []string{
+	"Hope you enjoy this one!",
+	"Made this over the weekend, let me know what you think.",
+	"Another one from the queue.",
+	"Generated locally, then upscaled.",
+	"Commission for a friend.",
+}
+
+// Render renders the request in one of the Styles.
+func (s *Synthesizer) Render(request entities.TextToImageRequest) Synthetic {
+	styles := s.Styles
+	if len(styles) == 0 {
+		styles = SynthStyles
+	}
+	style := styles[s.Rand.IntN(len(styles))]
+	fields, label := s.fields(request, synthSupported[style])
+
+	var text string
+	switch style {
+	case SynthInfotext:
+		text = s.infotext(request, fields)
+	case SynthList:
+		text = s.list(request, fields, false)
+	case SynthBBCode:
+		text = s.list(request, fields, true)
+	case SynthAutoSnep:
+		text = s.autoSnep(request, fields)
+	case SynthCirn0:
+		text = s.cirn0(request, fields)
+	case SynthSoph:
+		text = s.soph(request, fields)
+	}
+	return Synthetic{Style: style, Text: text, Request: label}
+}
+
+// Samples renders every request n times as training samples, paired with the JSON of the rendered fields.
+// The renderings of a request share its name as the artist, so that they end up in the same split of ExportDataset.
+func (s *Synthesizer) Samples(requests map[string]entities.TextToImageRequest, n int) ([]Sample, error) {
+	names := make([]string, 0, len(requests))
+	for name := range requests {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var samples []Sample
+	for _, name := range names {
+		for i := range n {
+			synthetic := s.Render(requests[name])
+			response, err := json.MarshalIndent(synthetic.Request, "", "  ")
+			if err != nil {
+				return nil, fmt.Errorf("error marshalling %s: %w", name, err)
+			}
+			samples = append(samples, Sample{
+				Name:        fmt.Sprintf("%s_%s_%d", name, synthetic.Style, i),
+				Artist:      name,
+				Instruction: datasetInstruction,
+				Input:       synthetic.Text,
+				Description: synthetic.Text,
+				Response:    string(response),
+			})
+		}
+	}
+	return samples, nil
+}
+
+// synthSupported are the fields a layout can hold, for the styles that can't hold every field.
+var synthSupported = map[SynthStyle][]string{
+	SynthCirn0: {"Negative prompt", "Steps", "Sampler", "CFG scale", "Seed", "Model"},
+	SynthSoph:  {"Negative prompt", "Steps", "Sampler", "CFG scale", "Seed", "Size", "Model"},
+}
+
+// fields returns the fields of the request that are kept, and the request with only those fields.
+// If supported isn't nil, the other fields are left out.
+func (s *Synthesizer) fields(request entities.TextToImageRequest, supported []string) ([]synthField, entities.TextToImageRequest) {
+	label := entities.TextToImageRequest{Prompt: request.Prompt}
+	var fields []synthField
+	add := func(ok bool, field synthField) {
+		if supported != nil && !slices.Contains(supported, field.name) {
+			return
+		}
+		if ok && s.Rand.Float64() >= s.Omit {
+			fields = append(fields, field)
+			field.set(&label)
+		}
+	}
+
+	add(request.NegativePrompt != "", synthField{
+		name: "Negative prompt", aliases: []string{"Negative prompt", "negative", "Negative Prompt", "Neg", "Negatives"}, emoji: "🚫",
+		value: request.NegativePrompt, set: func(r *entities.TextToImageRequest) { r.NegativePrompt = request.NegativePrompt },
+	})
+	add(request.Steps > 0, synthField{
+		name: "Steps", aliases: []string{"Steps", "steps", "Sampling steps", "STEPS"}, emoji: "👣",
+		value: strconv.Itoa(request.Steps), set: func(r *entities.TextToImageRequest) { r.Steps = request.Steps },
+	})
+	add(request.SamplerName != "", synthField{
+		name: "Sampler", aliases: []string{"Sampler", "sampler", "Sampling method", "Sampler name"}, emoji: "🎲",
+		value: request.SamplerName, set: func(r *entities.TextToImageRequest) { r.SamplerName = request.SamplerName },
+	})
+	add(request.CFGScale > 0, synthField{
+		name: "CFG scale", aliases: []string{"CFG scale", "CFG", "cfg", "Guidance"}, emoji: "🎚️",
+		value: strconv.FormatFloat(request.CFGScale, 'f', -1, 64), set: func(r *entities.TextToImageRequest) { r.CFGScale = request.CFGScale },
+	})
+	add(request.Seed > 0, synthField{
+		name: "Seed", aliases: []string{"Seed", "seed", "SEED"}, emoji: "🌱",
+		value: strconv.FormatInt(request.Seed, 10), set: func(r *entities.TextToImageRequest) { r.Seed = request.Seed },
+	})
+	add(request.Width > 0 && request.Height > 0, synthField{
+		name: "Size", aliases: []string{"Size", "Resolution", "size", "Dimensions"}, emoji: "📐",
+		value: fmt.Sprintf("%dx%d", request.Width, request.Height),
+		set:   func(r *entities.TextToImageRequest) { r.Width, r.Height = request.Width, request.Height },
+	})
+	if model := request.OverrideSettings.SDModelCheckpoint; model != nil && *model != "" {
+		add(true, synthField{
+			name: "Model", aliases: []string{"Model", "Checkpoint", "model", "Base model"}, emoji: "🧠",
+			value: *model, set: func(r *entities.TextToImageRequest) { r.OverrideSettings.SDModelCheckpoint = model },
+		})
+	}
+	add(request.DenoisingStrength > 0, synthField{
+		name: "Denoising strength", aliases: []string{"Denoising strength", "Denoise", "denoising"}, emoji: "🌫️",
+		value: strconv.FormatFloat(request.DenoisingStrength, 'f', -1, 64), set: func(r *entities.TextToImageRequest) { r.DenoisingStrength = request.DenoisingStrength },
+	})
+	return fields, label
+}
+
+func (s *Synthesizer) pick(options []string) string {
+	return options[s.Rand.IntN(len(options))]
+}
+
+// splitPrompt breaks the prompt into lines at its commas when the coin flip says so.
+func (s *Synthesizer) splitPrompt(prompt string) string {
+	tags := strings.Split(prompt, ",")
+	if len(tags) < 4 || s.Rand.IntN(2) == 0 {
+		return prompt
+	}
+	per := 2 + s.Rand.IntN(3)
+	var lines []string
+	for i := 0; i < len(tags); i += per {
+		lines = append(lines, strings.TrimSpace(strings.Join(tags[i:min(i+per, len(tags))], ",")))
+	}
+	return strings.Join(lines, ",\n")
+}
+
+func (s *Synthesizer) preamble() string {
+	if s.Rand.IntN(3) > 0 {
+		return ""
+	}
+	return s.pick(synthPreambles) + "\n\n"
+}
+
+func (s *Synthesizer) shuffle(fields []synthField) []synthField {
+	fields = slices.Clone(fields)
+	s.Rand.Shuffle(len(fields), func(i, j int) { fields[i], fields[j] = fields[j], fields[i] })
+	return fields
+}
+
+// parameters returns the negative prompt and the rest of the fields in the A1111 infotext order.
+func parameters(fields []synthField) (negative string, rest []synthField) {
+	for _, f := range fields {
+		if f.name == "Negative prompt" {
+			negative = f.value
+		} else {
+			rest = append(rest, f)
+		}
+	}
+	return negative, rest
+}
+
+func (s *Synthesizer) infotext(request entities.TextToImageRequest, fields []synthField) string {
+	var b strings.Builder
+	b.WriteString(s.preamble())
+	b.WriteString(request.Prompt)
+	negative, rest := parameters(fields)
+	if negative != "" {
+		fmt.Fprintf(&b, "\n%s: %s", s.pick([]string{"Negative prompt", "Negative Prompt"}), negative)
+	}
+	var params []string
+	for _, f := range rest {
+		params = append(params, f.name+": "+f.value)
+	}
+	if len(params) > 0 {
+		b.WriteString("\n" + strings.Join(params, ", "))
+	}
+	return b.String()
+}
+
+func (s *Synthesizer) list(request entities.TextToImageRequest, fields []synthField, bbcode bool) string {
+	emoji := s.Rand.IntN(3) == 0
+	key := func(name, emojiPrefix string) string {
+		if bbcode {
+			switch s.Rand.IntN(3) {
+			case 0:
+				name = "[b]" + name + "[/b]"
+			case 1:
+				name = "[u][b]" + name + "[/b][/u]"
+			}
+		}
+		if emoji {
+			name = emojiPrefix + " " + name
+		}
+		return name
+	}
+	value := func(v string) string {
+		if bbcode && s.Rand.IntN(3) == 0 {
+			return "[i]" + v + "[/i]"
+		}
+		return v
+	}
+
+	var b strings.Builder
+	b.WriteString(s.preamble())
+	if bbcode && s.Rand.IntN(2) == 0 {
+		b.WriteString(s.pick([]string{"[center][b]Generation details[/b][/center]\n", "|| Technical Information ||\n\n"}))
+	}
+	prompt := s.pick([]string{"Prompt", "Positive prompt", "prompt", "Positive"})
+	fmt.Fprintf(&b, "%s: %s\n", key(prompt, "🎨"), value(s.splitPrompt(request.Prompt)))
+	for _, f := range s.shuffle(fields) {
+		fmt.Fprintf(&b, "%s: %s\n", key(s.pick(f.aliases), f.emoji), value(f.value))
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func (s *Synthesizer) autoSnep(request entities.TextToImageRequest, fields []synthField) string {
+	var b strings.Builder
+	name := fmt.Sprintf("%08d.png", s.Rand.IntN(100000000))
+	fmt.Fprintf(&b, "%s:\n  PNG text chunks:\n    parameters:\n", name)
+	for _, line := range strings.Split(s.infotext(request, fields), "\n") {
+		if line == "" {
+			continue
+		}
+		b.WriteString("      " + line + "\n")
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func (s *Synthesizer) cirn0(request entities.TextToImageRequest, fields []synthField) string {
+	var b strings.Builder
+	var seed, negative string
+	for _, f := range fields {
+		switch f.name {
+		case "Steps":
+			fmt.Fprintf(&b, "steps: %s\n", f.value)
+		case "Sampler":
+			fmt.Fprintf(&b, "sampler: %s\n", f.value)
+		case "CFG scale":
+			fmt.Fprintf(&b, "cfg: %s\n", f.value)
+		case "Model":
+			fmt.Fprintf(&b, "model: %s\n", f.value)
+		case "Seed":
+			seed = f.value
+		case "Negative prompt":
+			negative = f.value
+		}
+	}
+	fmt.Fprintf(&b, "\n=== #%d\n%s\n", 1+s.Rand.IntN(20), request.Prompt)
+	if negative != "" {
+		fmt.Fprintf(&b, "negative prompt:\n%s\n", negative)
+	}
+	if seed != "" {
+		fmt.Fprintf(&b, "seed: %s\n", seed)
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func (s *Synthesizer) soph(request entities.TextToImageRequest, fields []synthField) string {
+	invokeAI := map[string]any{"positive_prompt": request.Prompt, "generation_mode": "txt2img"}
+	for _, f := range fields {
+		switch f.name {
+		case "Negative prompt":
+			invokeAI["negative_prompt"] = request.NegativePrompt
+		case "Steps":
+			invokeAI["steps"] = request.Steps
+		case "Sampler":
+			invokeAI["scheduler"] = request.SamplerName
+		case "CFG scale":
+			invokeAI["cfg_scale"] = request.CFGScale
+		case "Seed":
+			invokeAI["seed"] = request.Seed
+		case "Size":
+			invokeAI["width"], invokeAI["height"] = request.Width, request.Height
+		case "Model":
+			invokeAI["model"] = map[string]string{"name": f.value}
+		}
+	}
+	data, _ := json.MarshalIndent(invokeAI, "", "  ")
+	return fmt.Sprintf("./%08d.png:\n%s", s.Rand.IntN(100000000), data)
+}
@@ -20,6 +20,19 @@ type Config struct {
 	KeyCondition  func(string) bool
 	SkipCondition func(string) bool
 	Filename      string
+	Artist        *ArtistProfile // applied by every Processor after every other option
+}
+
+// newConfig applies the options, then the profile of the Artist so that its layout wins.
+func newConfig(opts []func(*Config)) Config {
+	var c Config
+	for _, f := range opts {
+		f(&c)
+	}
+	if c.Artist != nil {
+		c.Artist.apply(&c)
+	}
+	return c
 }
 
 type Processor func(...func(*Config)) (Params, error)
@@ -30,7 +43,13 @@ const (
 	Extras         = "extras"
 	Objects        = "objects"
 	Caption        = "caption"
+)
 
+// The Inkbunny user IDs of the artists with a known layout.
+//
+// Deprecated: the IDs are the user_id of the profiles in artists.json, which a loaded profile can change.
+// Use Artists.ByName or Artists.ByID instead.
+const (
 	IDAutoSnep    = 1004248
 	IDDruge       = 151203
 	IDArtieDragon = 1190392
@@ -48,10 +67,7 @@ const (
 // AutoSnep is a Processor that parses yaml like raw txt where each two spaces is a new dict
 // It's mostly seen in multi-chunk parameter output from AutoSnep
 func AutoSnep(opts ...func(*Config)) (Params, error) {
-	var c Config
-	for _, f := range opts {
-		f(&c)
-	}
+	c := newConfig(opts)
 	var chunks Params = make(Params)
 	scanner := bufio.NewScanner(strings.NewReader(c.Text))
 
@@ -99,10 +115,7 @@ func AutoSnep(opts ...func(*Config)) (Params, error) {
 var seedLine = regexp.MustCompile(`seed: (\d+)`)
 
 func Cirn0(opts ...func(*Config)) (Params, error) {
-	var c Config
-	for _, f := range opts {
-		f(&c)
-	}
+	c := newConfig(opts)
 	var chunks Params = make(Params)
 	scanner := bufio.NewScanner(strings.NewReader(c.Text))
 
@@ -210,10 +223,7 @@ var SophStartInvokeAI = regexp.MustCompile(`(?m)^{$`)
 // Soph is a Processor that parses the InvokeAI format by IDSoph.
 // Check if the content follows the InvokeAI format using SophStartKey.
 func Soph(opts ...func(*Config)) (map[string]entities.TextToImageRequest, error) {
-	var c Config
-	for _, f := range opts {
-		f(&c)
-	}
+	c := newConfig(opts)
 	if len(c.Text) == 0 {
 		return nil, errors.New("empty text")
 	}
@@ -267,10 +277,7 @@ func Soph(opts ...func(*Config)) (map[string]entities.TextToImageRequest, error)
 }
 
 func Sequential(opts ...func(*Config)) (Params, error) {
-	var c Config
-	for _, f := range opts {
-		f(&c)
-	}
+	c := newConfig(opts)
 	if len(c.Text) == 0 {
 		return nil, errors.New("empty text")
 	}
@@ -313,110 +320,49 @@ func Sequential(opts ...func(*Config)) (Params, error) {
 	return chunks, nil
 }
 
-var drugeMatchDigit = regexp.MustCompile(`(?m)^\d+`)
-
+// UseDruge uses the "druge" profile in Artists.
 func UseDruge() func(*Config) {
-	return func(c *Config) {
-		c.KeyCondition = func(line string) bool {
-			return drugeMatchDigit.MatchString(line)
-		}
-		c.Filename = "druge_"
-		if !drugeMatchDigit.MatchString(c.Text) {
-			c.Text = "1\n" + c.Text
-		}
-	}
+	return useArtist("druge")
 }
 
+// UseArtie uses the "ArtieDragon" profile in Artists.
 func UseArtie() func(*Config) {
-	return func(c *Config) {
-		c.KeyCondition = func(line string) bool {
-			return strings.HasSuffix(line, "Image")
-		}
-		c.Filename = "artiedragon_"
-	}
+	return useArtist("ArtieDragon")
 }
 
-var aiBeanKey = regexp.MustCompile(`(?i)^(image )?\d+`)
-
+// UseAIBean uses the "AIBean" profile in Artists.
 func UseAIBean() func(*Config) {
-	return func(c *Config) {
-		c.KeyCondition = func(line string) bool {
-			return aiBeanKey.MatchString(line)
-		}
-		c.Filename = "AIBean_"
-		c.SkipCondition = func(line string) bool {
-			return line == "parameters"
-		}
-		if aiBeanKey.MatchString(c.Text) {
-			return
-		}
-		if strings.HasPrefix(c.Text, "parameters") {
-			c.Text = strings.Replace(c.Text, "parameters", "1", 1)
-			return
-		}
-		c.Text = "1\n" + c.Text
-	}
+	return useArtist("AIBean")
 }
 
+// UseFairyGarden uses the "FairyGarden" profile in Artists, which prepends "photo 1" in case it's missing.
 func UseFairyGarden() func(*Config) {
-	return func(c *Config) {
-		c.KeyCondition = func(line string) bool {
-			return strings.HasPrefix(line, "photo")
-		}
-		c.Filename = "fairygarden_"
-		// prepend "photo 1" to the input in case it's missing
-		c.Text = "photo 1\n" + c.Text
-	}
+	return useArtist("FairyGarden")
 }
 
+// UseCirn0 uses the "Cirn0" profile in Artists.
 func UseCirn0() func(*Config) {
-	return func(c *Config) {
-		c.KeyCondition = func(line string) bool {
-			return strings.HasPrefix(line, "===")
-		}
-		c.Filename = "cirn0_"
+	return useArtist("Cirn0")
+}
 
-		var part string
-		lines := strings.Split(c.Text, "\n")
-		for i, line := range lines {
-			if strings.HasPrefix(line, "=== #") {
-				part = strings.TrimPrefix(line, "=== #")
-			}
-			if strings.HasPrefix(line, "---") {
-				lines[i] = fmt.Sprintf("=== Part #%s", part)
-			}
+// cirn0Transform renames the "---" parts to "=== Part #" so that they start a new key.
+func cirn0Transform(c *Config) {
+	var part string
+	lines := strings.Split(c.Text, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "=== #") {
+			part = strings.TrimPrefix(line, "=== #")
+		}
+		if strings.HasPrefix(line, "---") {
+			lines[i] = fmt.Sprintf("=== Part #%s", part)
 		}
-		c.Text = strings.Join(lines, "\n")
 	}
+	c.Text = strings.Join(lines, "\n")
 }
 
+// UseHornybunny uses the "Hornybunny" profile in Artists.
 func UseHornybunny() func(*Config) {
-	return func(c *Config) {
-		c.Text = "(1)\n" + c.Text
-		c.KeyCondition = func(line string) bool {
-			return regexp.MustCompile(`^\(\d+\)$`).MatchString(line)
-		}
-		c.Filename = "Hornybunny_"
-		// c.Text = strings.ReplaceAll(c.Text, "----", "")
-		// c.Text = strings.ReplaceAll(c.Text, "Original generation details", "")
-		// c.Text = strings.ReplaceAll(c.Text, "Upscaling details", "")
-		c.Text = strings.ReplaceAll(c.Text, "Positive Prompt: ", "")
-		c.Text = strings.ReplaceAll(c.Text, "Other details: ", "")
-		c.SkipCondition = func(line string) bool {
-			switch line {
-			case "----":
-				return true
-			case "==========":
-				return true
-			case "Original generation details":
-				return true
-			case "Upscaling details":
-				return true
-			default:
-				return false
-			}
-		}
-	}
+	return useArtist("Hornybunny")
 }
 
 var (
@@ -426,28 +372,32 @@ var (
 	methuzalachSteps    = regexp.MustCompile(`.*(Steps: \d+[^\n]*)`)
 )
 
+// UseMethuzalach uses the "Methuzalach" profile in Artists.
 func UseMethuzalach() func(*Config) {
-	return func(c *Config) {
-		c.KeyCondition = func(line string) bool {
-			return strings.HasPrefix(line, "Image")
-		}
+	return useArtist("Methuzalach")
+}
 
-		model := methuzalachModel.FindString(c.Text)
-		c.Text = methuzalachNegative.ReplaceAllString(c.Text, "Negative Prompt: ")
-		c.Text = methuzalachSeed.ReplaceAllString(c.Text, "")
-		c.Text = methuzalachSteps.ReplaceAllString(c.Text, `$1 `+model)
-	}
+// methuzalachTransform moves the model to the end of the Steps line and removes the non-numeric seeds.
+func methuzalachTransform(c *Config) {
+	model := methuzalachModel.FindString(c.Text)
+	c.Text = methuzalachNegative.ReplaceAllString(c.Text, "Negative Prompt: ")
+	c.Text = methuzalachSeed.ReplaceAllString(c.Text, "")
+	c.Text = methuzalachSteps.ReplaceAllString(c.Text, `$1 `+model)
 }
 
+// UseSoph uses the "Soph" profile in Artists.
 func UseSoph() func(*Config) {
-	return func(c *Config) {
-		c.KeyCondition = func(line string) bool {
-			return strings.HasPrefix(line, c.Filename)
-		}
-		c.Text = c.Filename + "\n" + c.Text
-		c.SkipCondition = func(line string) bool {
-			return strings.HasPrefix(line, "<comment: ")
-		}
+	return useArtist("Soph")
+}
+
+// sophTransform uses the filename as the only key.
+func sophTransform(c *Config) {
+	c.KeyCondition = func(line string) bool {
+		return strings.HasPrefix(line, c.Filename)
+	}
+	c.Text = c.Filename + "\n" + c.Text
+	c.SkipCondition = func(line string) bool {
+		return strings.HasPrefix(line, "<comment: ")
 	}
 }
 
@@ -482,10 +432,7 @@ func WithKeyCondition(f func(string) bool) func(*Config) {
 }
 
 func Common(opts ...func(*Config)) (Params, error) {
-	var c Config
-	for _, f := range opts {
-		f(&c)
-	}
+	c := newConfig(opts)
 	if c.KeyCondition == nil {
 		return nil, errors.New("condition for key is not set")
 	}
@@ -577,12 +524,49 @@ func Common(opts ...func(*Config)) (Params, error) {
 	return chunks, nil
 }
 
+// ParseParams converts the params of each file into a request, skipping the files that fail to parse.
 func ParseParams(p Params) map[string]entities.TextToImageRequest {
-	var request map[string]entities.TextToImageRequest
+	request, _ := parseParams(p)
+	return request
+}
+
+// ParseParamsErr is ParseParams that also returns the error of every file that failed to parse, joined with errors.Join.
+// The requests of the other files are still returned.
+func ParseParamsErr(p Params) (map[string]entities.TextToImageRequest, error) {
+	request, errs := parseParams(p)
+	return request, errors.Join(errs...)
+}
+
+func parseParams(p Params) (map[string]entities.TextToImageRequest, []error) {
+	var (
+		request map[string]entities.TextToImageRequest
+		errs    []error
+	)
 	for file, chunk := range p {
+		if chunk["Software"] == "NovelAI" {
+			novelAI, err := entities.NovelAIFromChunks(chunk)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("error decoding NovelAI metadata of %s: %w", file, err))
+				continue
+			}
+			if request == nil {
+				request = make(map[string]entities.TextToImageRequest)
+			}
+			request[file] = *novelAI.Convert()
+			continue
+		}
 		if params, ok := chunk[Parameters]; ok {
-			r, err := ParameterHeuristics(params)
+			var (
+				r   entities.TextToImageRequest
+				err error
+			)
+			if DetectGenerationData([]byte(params)) != GenerationDataUnknown {
+				r, err = GenerationDataHeuristics([]byte(params))
+			} else {
+				r, err = ParameterHeuristics(params)
+			}
 			if err != nil {
+				errs = append(errs, fmt.Errorf("error parsing %s: %w", file, err))
 				continue
 			}
 			if request == nil {
@@ -591,5 +575,5 @@ func ParseParams(p Params) map[string]entities.TextToImageRequest {
 			request[file] = r
 		}
 	}
-	return request
+	return request, errs
 }
@@ -3,7 +3,10 @@ package utils
 import (
 	_ "embed"
 	"encoding/json"
+	"strings"
 	"testing"
+
+	"github.com/ellypaws/inkbunny-sd/entities"
 )
 
 //go:embed samples/multi-chunk.txt
@@ -35,3 +38,323 @@ func TestParseParams(t *testing.T) {
 
 	t.Logf("%s", marshal)
 }
+
+const novelAIChunks = `image.png:
+  PNG text chunks:
+    Title:
+      AI generated image
+    Description:
+      {{masterpiece}}, 1girl, [blurry], (fox ears)
+    Software:
+      NovelAI
+    Source:
+      NovelAI Diffusion V3 7BCCAA2C
+    Comment:
+      {"prompt": "{{masterpiece}}, 1girl, [blurry], (fox ears)", "steps": 28, "height": 1216, "width": 832, "scale": 5.0, "uncond_scale": 1.0, "cfg_rescale": 0.2, "seed": 3817292, "n_samples": 1, "noise_schedule": "karras", "sampler": "k_euler_ancestral", "sm": true, "sm_dyn": false, "uc": "lowres, {bad anatomy}", "request_type": "PromptGenerateRequest"}
+`
+
+func TestNovelAI(t *testing.T) {
+	params, err := AutoSnep(WithString(novelAIChunks))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests, err := ParseParamsErr(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, ok := requests["image.png"]
+	if !ok {
+		t.Fatalf("Expected image.png, got %v", requests)
+	}
+
+	if request.Prompt != `(masterpiece:1.1025), 1girl, (blurry:0.9524), \(fox ears\)` {
+		t.Errorf("Unexpected prompt %s", request.Prompt)
+	}
+	if request.NegativePrompt != "lowres, (bad anatomy:1.05)" {
+		t.Errorf("Unexpected negative prompt %s", request.NegativePrompt)
+	}
+	if request.SamplerName != "Euler a" || request.Scheduler == nil || *request.Scheduler != "Karras" {
+		t.Errorf("Unexpected sampler %s %v", request.SamplerName, request.Scheduler)
+	}
+	if request.Steps != 28 || request.CFGScale != 5 || request.Seed != 3817292 || request.Width != 832 || request.Height != 1216 {
+		t.Errorf("Unexpected parameters %+v", request)
+	}
+	if request.CFGRescale == nil || request.CFGRescale.Args.CfgRescale != 0.2 {
+		t.Errorf("Expected cfg rescale 0.2, got %v", request.CFGRescale)
+	}
+
+	if request.OverrideSettings.SDModelCheckpoint != nil || request.Comments["source"] != "NovelAI Diffusion V3 7BCCAA2C" {
+		t.Errorf("Expected the source in the comments and not as the checkpoint, got %v and %v", request.OverrideSettings.SDModelCheckpoint, request.Comments)
+	}
+
+	broken, err := AutoSnep(WithString(strings.Replace(novelAIChunks, `{"prompt"`, `{"prompt`, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests, err := ParseParamsErr(broken); err == nil || len(requests) != 0 {
+		t.Errorf("Expected an error decoding the comment, got %v and %v", requests, err)
+	}
+	both := novelAIChunks + strings.Replace(strings.Replace(novelAIChunks, `{"prompt"`, `{"prompt`, 1), "image.png", "broken.png", 1)
+	result, err := Parse([]byte(both), Hints{Format: FormatAutoSnep})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := result.Requests["image.png"]; !ok || len(result.Errors) != 1 {
+		t.Errorf("Expected the parsed request and the error of the broken file, got %v and %v", result.Requests, result.Errors)
+	}
+	if evidence := result.Provenance["image.png"]["seed"]; evidence.Source != entities.SourceJSON || evidence.Key != "$.Comment.seed" {
+		t.Errorf("Unexpected NovelAI seed evidence %+v", evidence)
+	}
+
+	if prompt := entities.NovelAIPrompt("1.5::red hair::, blue eyes"); prompt != "(red hair:1.5), blue eyes" {
+		t.Errorf("Unexpected numeric emphasis %s", prompt)
+	}
+}
+
+func TestGenerationDataHeuristics(t *testing.T) {
+	tests := []struct {
+		name     string
+		blob     string
+		kind     GenerationData
+		expected func(entities.TextToImageRequest) bool
+	}{
+		{
+			name: "fooocus",
+			blob: `{"prompt": "a cat", "negative_prompt": "", "styles": "['Fooocus V2', 'Fooocus Sharp']", "performance": "Speed", "resolution": "(1024, 1024)", "guidance_scale": 4, "sharpness": 2, "sampler": "dpmpp_2m_sde_gpu", "scheduler": "karras", "seed": "1234567", "steps": 30, "base_model": "juggernautXL_v8Rundiffusion.safetensors", "loras": [["sd_xl_offset_example-lora_1.0.safetensors", 0.1, "4852686128"]], "metadata_scheme": "fooocus", "version": "Fooocus v2.4.3"}`,
+			kind: GenerationDataFooocus,
+			expected: func(r entities.TextToImageRequest) bool {
+				return r.Prompt == "a cat<lora:sd_xl_offset_example-lora_1.0.safetensors:0.10>" &&
+					len(r.Styles) == 2 && r.Styles[1] == "Fooocus Sharp" &&
+					r.Width == 1024 && r.Height == 1024 && r.Seed == 1234567 && r.Steps == 30 && r.CFGScale == 4 &&
+					r.Comments["performance"] == "Speed"
+			},
+		},
+		{
+			name: "fooocus log",
+			blob: `<div><table class='metadata'>
+<tr><td class='key'>Prompt</td><td class='value'>a cat</td></tr>
+<tr><td class='key'>Styles</td><td class='value'>[&#x27;Fooocus V2&#x27;]</td></tr>
+<tr><td class='key'>Resolution</td><td class='value'>(896, 1152)</td></tr>
+<tr><td class='key'>Guidance Scale</td><td class='value'>7</td></tr>
+<tr><td class='key'>Seed</td><td class='value'>42</td></tr>
+<tr><td class='key'>LoRA 1</td><td class='value'>detail.safetensors : 0.5</td></tr>
+<tr><td class='key'>Refiner Model</td><td class='value'>None</td></tr>
+</table></div>`,
+			kind: GenerationDataFooocusLog,
+			expected: func(r entities.TextToImageRequest) bool {
+				return r.Prompt == "a cat<lora:detail.safetensors:0.50>" &&
+					len(r.Styles) == 1 && r.Width == 896 && r.Height == 1152 && r.CFGScale == 7 && r.Seed == 42 &&
+					r.RefinerCheckpoint == nil
+			},
+		},
+		{
+			name: "swarmui",
+			blob: `{"sui_image_params": {"prompt": "a cat", "negativeprompt": "blurry", "model": "sd_xl_base_1.0", "seed": 7, "steps": 20, "cfgscale": 6.5, "width": 1024, "height": 768, "sampler": "euler", "scheduler": "normal", "clipstopatlayer": -2, "loras": ["detail"], "loraweights": ["0.8"], "swarm_version": "0.9.2.1"}, "sui_models": [{"name": "sd_xl_base_1.0.safetensors", "param": "model", "hash": "0xabcdef"}]}`,
+			kind: GenerationDataSwarmUI,
+			expected: func(r entities.TextToImageRequest) bool {
+				return r.Prompt == "a cat<lora:detail:0.80>" && r.NegativePrompt == "blurry" &&
+					r.Seed == 7 && r.CFGScale == 6.5 && r.Width == 1024 && r.Height == 768 &&
+					r.OverrideSettings.CLIPStopAtLastLayers == 2 && r.OverrideSettings.SDCheckpointHash == "abcdef"
+			},
+		},
+		{
+			name: "civitai",
+			blob: `{"prompt": "a cat", "negativePrompt": "blurry", "cfgScale": 7, "steps": 25, "sampler": "DPM++ 2M Karras", "seed": 99, "Size": "832x1216", "clipSkip": 2, "resources": [{"name": "detail", "type": "lora", "weight": 0.8, "hash": "abc123"}], "civitaiResources": [{"type": "checkpoint", "modelVersionId": 290640}]}`,
+			kind: GenerationDataCivitai,
+			expected: func(r entities.TextToImageRequest) bool {
+				return r.Prompt == "a cat" && r.Width == 832 && r.Height == 1216 &&
+					r.LoraHashes["abc123"] == "detail" && r.Comments["civitai_model_version_ids"] == "290640"
+			},
+		},
+		{
+			name: "civitai infotext",
+			blob: `a cat
+Negative prompt: blurry
+Steps: 25, Sampler: Euler a, CFG scale: 7, Seed: 99, Size: 832x1216, Civitai resources: [{"type":"checkpoint","modelVersionId":290640,"modelName":"Pony, XL"},{"type":"lora","weight":0.8,"modelVersionId":12345}], Clip skip: 2, Civitai metadata: {"remixOfId":1}`,
+			kind: GenerationDataCivitaiText,
+			expected: func(r entities.TextToImageRequest) bool {
+				return r.Prompt == "a cat" && r.NegativePrompt == "blurry" && r.Steps == 25 && r.Seed == 99 &&
+					r.Width == 832 && r.Height == 1216 && r.OverrideSettings.CLIPStopAtLastLayers == 2 &&
+					r.Comments["civitai_model_version_ids"] == "290640,12345"
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if kind := DetectGenerationData([]byte(test.blob)); kind != test.kind {
+				t.Fatalf("Expected %q, got %q", test.kind, kind)
+			}
+			request, err := GenerationDataHeuristics([]byte(test.blob))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !test.expected(request) {
+				t.Errorf("Unexpected request %+v", request)
+			}
+		})
+	}
+
+	if kind := DetectGenerationData([]byte("a cat\nSteps: 20, Seed: 1")); kind != GenerationDataUnknown {
+		t.Errorf("Expected an infotext to be unknown, got %q", kind)
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		blob     string
+		hints    Hints
+		format   Format
+		requests int
+	}{
+		{
+			name:     "infotext",
+			blob:     "a cat\nNegative prompt: blurry\nSteps: 20, Sampler: Euler a, CFG scale: 7, Seed: 1, Size: 512x768",
+			format:   FormatInfotext,
+			requests: 1,
+		},
+		{
+			name:     "sequential",
+			blob:     "a cat\nSteps: 20, Seed: 1\na dog\nSteps: 30, Seed: 2",
+			format:   FormatSequential,
+			requests: 2,
+		},
+		{
+			name:     "comfyui api",
+			blob:     `{"3": {"class_type": "KSampler", "inputs": {"seed": 5, "steps": 20, "cfg": 7, "sampler_name": "euler", "scheduler": "normal", "positive": ["6", 0], "negative": ["7", 0]}}, "6": {"class_type": "CLIPTextEncode", "inputs": {"text": "a cat"}}, "7": {"class_type": "CLIPTextEncode", "inputs": {"text": "blurry"}}}`,
+			format:   FormatComfyUIAPI,
+			requests: 1,
+		},
+		{
+			name:     "easydiffusion",
+			blob:     `{"prompt": "a cat", "seed": 3, "negative_prompt": "", "num_inference_steps": 25, "guidance_scale": 7.5, "width": 512, "height": 512}`,
+			format:   FormatEasyDiffusion,
+			requests: 1,
+		},
+		{
+			name:     "swarmui",
+			blob:     `{"sui_image_params": {"prompt": "a cat", "steps": 20}}`,
+			format:   FormatSwarmUI,
+			requests: 1,
+		},
+		{
+			name:     "autosnep",
+			blob:     novelAIChunks,
+			format:   FormatAutoSnep,
+			requests: 1,
+		},
+		{
+			name:     "druge",
+			blob:     "1\na cat\nNegative prompt: blurry\nSteps: 20, Seed: 1\n2\na dog\nNegative prompt: blurry\nSteps: 30, Seed: 2",
+			hints:    Hints{Username: "druge"},
+			format:   FormatArtist,
+			requests: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := Parse([]byte(test.blob), test.hints)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Format != test.format {
+				t.Errorf("Expected format %q, got %q", test.format, result.Format)
+			}
+			if result.Confidence <= 0 || result.Confidence > 1 {
+				t.Errorf("Unexpected confidence %v", result.Confidence)
+			}
+			if len(result.Requests) != test.requests {
+				t.Errorf("Expected %d requests, got %d: %+v", test.requests, len(result.Requests), result.Requests)
+			}
+		})
+	}
+
+	result, err := Parse([]byte("a cat\nSteps: 20, Seed: 1"), Hints{Format: FormatInfotext})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Confidence != 1 {
+		t.Errorf("Expected a hinted format to have confidence 1, got %v", result.Confidence)
+	}
+}
+
+func TestArtistProfiles(t *testing.T) {
+	if p, ok := Artists.ByID(151203); !ok || p.Name != "druge" {
+		t.Fatalf("Expected the druge profile, got %v", p)
+	}
+	if p, ok := Artists.ByFilename("123_AutoSnep_image.txt"); !ok || p.Name != "AutoSnep" {
+		t.Errorf("Expected the AutoSnep profile, got %v", p)
+	}
+
+	params, err := Common(WithString("(1) ignored\na cat\nSteps: 20, Seed: 1\n----\n(2)\nPositive Prompt: a dog\nSteps: 30, Seed: 2"), UseHornybunny())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := params["Hornybunny_(2)"][Parameters]; p != "a dog\nSteps: 30, Seed: 2" {
+		t.Errorf("Unexpected Hornybunny parameters %q", p)
+	}
+
+	params, err = Common(WithString("a cat\nSteps: 20, Seed: 1\n2girls, a dog\nSteps: 30, Seed: 2"), UseAIBean())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := params["AIBean_1"][Parameters]; !strings.HasPrefix(p, "a cat") {
+		t.Errorf("Expected 1 to be prepended when the text doesn't start with a key, got %v", params)
+	}
+
+	var registry ArtistRegistry
+	err = registry.Load(strings.NewReader(`[{"name": "newcomer", "usernames": ["(?i)^newcomer$"], "processor": "Common", "key_pattern": "^#\\d+", "filename_prefix": "newcomer_"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile, ok := registry.ByUsername("NewComer")
+	if !ok {
+		t.Fatal("Expected the newcomer profile")
+	}
+	params, err = profile.GetProcessor()(WithString("#1\na cat\nSteps: 20, Seed: 1\n#2\na dog\nSteps: 30, Seed: 2"), WithArtist(profile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(params) != 2 || params["newcomer_#2"][Parameters] != "a dog\nSteps: 30, Seed: 2" {
+		t.Errorf("Unexpected params %v", params)
+	}
+
+	params, err = AutoSnep(WithString("image.png:\n  PNG text chunks:\n    parameters:\n      a cat\n      Steps: 20, Seed: 1"), WithArtist(&ArtistProfile{FilenamePrefix: "snep_"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := params["snep_image.png"]; !ok {
+		t.Errorf("Expected AutoSnep to apply the profile, got %v", params)
+	}
+
+	if err := registry.Load(strings.NewReader(`[{"name": "broken", "processor": "Unknown"}]`)); err == nil {
+		t.Error("Expected an error for an unknown processor")
+	}
+
+	defer Artists.Add(mustArtist(t, "Hornybunny"))
+	moved := *mustArtist(t, "Hornybunny")
+	moved.UserID = 1
+	moved.FilenamePrefix = "moved_"
+	if err := Artists.Add(&moved); err != nil {
+		t.Fatal(err)
+	}
+	params, err = Common(WithString("(1)\na cat\nSteps: 20, Seed: 1"), UseHornybunny())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := params["moved_(1)"]; !ok {
+		t.Errorf("Expected UseHornybunny to use the loaded profile with a different user ID, got %v", params)
+	}
+}
+
+func mustArtist(t *testing.T, name string) *ArtistProfile {
+	t.Helper()
+	p, ok := Artists.ByName(name)
+	if !ok {
+		t.Fatalf("Expected the %s profile", name)
+	}
+	return p
+}
@@ -1,9 +1,20 @@
 package utils
 
 import (
+	"crypto/sha256"
 	_ "embed"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+
+	"github.com/ellypaws/inkbunny-sd/entities"
+	"github.com/ellypaws/inkbunny/api"
 )
 
 const sample = `"See me after class, young lady."
@@ -129,3 +140,689 @@ func assert(t *testing.T, result map[string]string, expected map[string]string)
 		}
 	}
 }
+
+func TestParseInfotextVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		app     string
+		webUI   WebUI
+		base    Semver
+		known   bool
+	}{
+		{"v1.6.0-2-g4afaaf8a", "", WebUIA1111, Semver{1, 6, 0, "", 2}, true},
+		{"v1.7.0-225-g16bc2b4b", "", WebUIA1111, Semver{1, 7, 0, "", 225}, true},
+		{"1.7.3", "", WebUIA1111, Semver{1, 7, 3, "", 0}, true},
+		{"v1.8.0-RC", "", WebUIA1111, Semver{1, 8, 0, "rc", 0}, true},
+		{"f0.0.17v1.8.0rc-latest-276-g29be1da7", "", WebUIForge, Semver{1, 8, 0, "rc", 0}, true},
+		{"f2.0.1v1.10.1-previous-635-gf5330788", "", WebUIForge, Semver{1, 10, 1, "", 0}, true},
+		{"9a3d9f9", "SD.Next", WebUISDNext, Semver{}, false},
+		{"2024-06-14", "", WebUISDNext, Semver{}, false},
+	}
+
+	for _, test := range tests {
+		v := ParseInfotextVersion(test.version, test.app)
+		if v.WebUI != test.webUI {
+			t.Errorf("%s: expected webui %q, got %q", test.version, test.webUI, v.WebUI)
+		}
+		if v.Base != test.base {
+			t.Errorf("%s: expected base %v, got %v", test.version, test.base, v.Base)
+		}
+		if v.Known != test.known {
+			t.Errorf("%s: expected known %t, got %t", test.version, test.known, v.Known)
+		}
+	}
+
+	if !ParseInfotextVersion("v1.7.0-224", "").Before(v170TerminalS) {
+		t.Error("Expected v1.7.0-224 to be before v1.7.0-225")
+	}
+	if ParseInfotextVersion("v1.7.0-225", "").Before(v170TerminalS) {
+		t.Error("Expected v1.7.0-225 not to be before v1.7.0-225")
+	}
+	if !ParseInfotextVersion("v1.8.0-RC", "").Before(v180) {
+		t.Error("Expected v1.8.0-RC to be before v1.8.0")
+	}
+}
+
+func TestParameterHeuristicsBackcompat(t *testing.T) {
+	t2i, err := ParameterHeuristics(testParameters)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	if !t2i.OverrideSettings.DowncastAlphasCumprodToFP16 {
+		t.Error("Expected v1.6.0 to downcast alphas_cumprod to fp16")
+	}
+	if t2i.SamplerName != "DPM++ 2M" {
+		t.Errorf("Expected sampler to be DPM++ 2M, got %s", t2i.SamplerName)
+	}
+	if t2i.Scheduler == nil || *t2i.Scheduler != "Karras" {
+		t.Errorf("Expected schedule type to be Karras, got %v", t2i.Scheduler)
+	}
+	if t2i.Width != 768 || t2i.Height != 1024 {
+		t.Errorf("Expected size to be 768x1024, got %dx%d", t2i.Width, t2i.Height)
+	}
+	if !t2i.EnableHr {
+		t.Error("Expected hires fix to be enabled")
+	}
+	if t2i.OverrideSettings.Emphasis != "Original" {
+		t.Errorf("Expected emphasis to be Original for a weighted prompt, got %s", t2i.OverrideSettings.Emphasis)
+	}
+
+	const forge = `(masterpiece:1.2), [cat]
+Negative prompt: lowres
+Steps: 30, Sampler: DPM++ 2M Karras, CFG scale: 7, Seed: 1, Size: 512x512, Version: f0.0.17v1.8.0rc-latest-276-g29be1da7`
+
+	t2i, err = ParameterHeuristics(forge)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if t2i.OverrideSettings.DowncastAlphasCumprodToFP16 {
+		t.Error("Expected Forge not to downcast alphas_cumprod")
+	}
+	if t2i.Scheduler == nil || *t2i.Scheduler != "Karras" {
+		t.Errorf("Expected schedule type to be Karras, got %v", t2i.Scheduler)
+	}
+	if t2i.OverrideSettings.Emphasis != "Original" || !t2i.OverrideSettings.EnableEmphasis {
+		t.Errorf("Expected emphasis to be Original, got %s", t2i.OverrideSettings.Emphasis)
+	}
+
+	const sdNext = `a cat
+Steps: 20, Sampler: DPM++ 2M Karras, Seed: 1, Size: 512x512, App: SD.Next, Version: 9a3d9f9`
+
+	t2i, err = ParameterHeuristics(sdNext)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if t2i.SamplerName != "DPM++ 2M Karras" {
+		t.Errorf("Expected SD.Next sampler to be unchanged, got %s", t2i.SamplerName)
+	}
+
+	const oldHires = `a cat
+Steps: 20, Sampler: Euler a, Seed: 1, Size: 1024x1024, Denoising strength: 0.7, First pass size: 0x0`
+
+	t2i, err = ParameterHeuristics(oldHires)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if t2i.Width != 512 || t2i.Height != 512 || t2i.HrResizeX != 1024 || t2i.HrResizeY != 1024 {
+		t.Errorf("Expected 512x512 upscaled to 1024x1024, got %dx%d to %dx%d", t2i.Width, t2i.Height, t2i.HrResizeX, t2i.HrResizeY)
+	}
+	if !t2i.EnableHr {
+		t.Error("Expected hires fix to be enabled")
+	}
+}
+
+func TestParsePromptAttention(t *testing.T) {
+	attention := ParsePromptAttention(`a (cat:1.5) \(b\) [dog] BREAK c`)
+	expected := []Attention{
+		{"a ", 1},
+		{"cat", 1.5},
+		{" (b) ", 1},
+		{"dog", 1 / 1.1},
+		{"", 1},
+		{"BREAK", -1},
+		{"c", 1},
+	}
+	if len(attention) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, attention)
+	}
+	for i := range expected {
+		if attention[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected[i], attention[i])
+		}
+	}
+}
+
+const testScripts = `a portrait of a fox
+Negative prompt: lowres
+Steps: 25, Sampler: Euler a, CFG scale: 7, Seed: 1, Size: 512x768, ADetailer model: face_yolov8n.pt, ADetailer prompt: "detailed face, smile", ADetailer confidence: 0.3, ADetailer denoising strength: 0.4, ADetailer inpaint only masked: True, ADetailer model 2nd: hand_yolov8n.pt, ADetailer denoising strength 2nd: 0.5, ADetailer version: 24.1.2, ControlNet 0: "Module: openpose_full, Model: control_v11p_sd15_openpose [cab727d4], Weight: 1.0, Resize Mode: Crop and Resize, Processor Res: 512, Threshold A: 0.5, Threshold B: 0.5, Guidance Start: 0.0, Guidance End: 1.0, Pixel Perfect: True, Control Mode: Balanced", RP Active: True, RP Divide mode: Matrix, RP Matrix submode: Horizontal, RP Ratios: "1,1", RP Calc Mode: Attention, Version: v1.9.3`
+
+func TestScriptHeuristics(t *testing.T) {
+	t2i, err := ParameterHeuristics(testScripts)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	if t2i.ADetailer == nil || len(t2i.ADetailer.Args) != 2 {
+		t.Fatalf("Expected 2 ADetailer units, got %+v", t2i.ADetailer)
+	}
+	if face := t2i.ADetailer.Args[0]; face.AdModel != "face_yolov8n.pt" || face.AdPrompt != "detailed face, smile" || face.AdDenoisingStrength != 0.4 || !face.AdInpaintOnlyMasked {
+		t.Errorf("Unexpected first ADetailer unit %+v", face)
+	}
+	if hand := t2i.ADetailer.Args[1]; hand.AdModel != "hand_yolov8n.pt" || hand.AdDenoisingStrength != 0.5 {
+		t.Errorf("Unexpected second ADetailer unit %+v", hand)
+	}
+
+	if t2i.ControlNet == nil || len(t2i.ControlNet.Args) != 1 {
+		t.Fatalf("Expected 1 ControlNet unit, got %+v", t2i.ControlNet)
+	}
+	if unit := t2i.ControlNet.Args[0]; unit.Module != "openpose_full" || unit.Model != "control_v11p_sd15_openpose [cab727d4]" || unit.ResizeMode != entities.ResizeModeCropAndResize || unit.ProcessorRes != 512 || !unit.PixelPerfect || unit.ControlMode != entities.ControlModeBalanced {
+		t.Errorf("Unexpected ControlNet unit %+v", unit)
+	}
+
+	if t2i.RegionalPrompter == nil {
+		t.Fatal("Expected Regional Prompter to be set")
+	}
+	if rp := t2i.RegionalPrompter.Args; !rp.Active || rp.Mode != "Matrix" || rp.MatrixMode != "Horizontal" || rp.Ratios != "1,1" || rp.CalcMode != "Attention" {
+		t.Errorf("Unexpected Regional Prompter args %+v", rp)
+	}
+
+	inactive, err := ParameterHeuristics(strings.Replace(testScripts, "RP Active: True", "RP Active: False", 1))
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if inactive.RegionalPrompter != nil {
+		t.Errorf("Expected an inactive Regional Prompter to be skipped, got %+v", inactive.RegionalPrompter.Args)
+	}
+}
+
+const testResponse = `{
+  "images": [],
+  "parameters": {},
+  "info": "{\"prompt\": \"a cat\", \"seed\": 1, \"all_seeds\": [1], \"all_subseeds\": [2], \"extra_generation_params\": {\"Schedule type\": \"Karras\", \"Hires upscale\": 2.0, \"Hires steps\": 15, \"Hires upscaler\": \"Latent\", \"Lora hashes\": \"fluffy: 1d5a77d6b141\", \"Downcast alphas_cumprod\": true, \"ADetailer model\": \"face_yolov8n.pt\", \"ADetailer denoising strength\": 0.4, \"NGMS\": 0.2}}"
+}`
+
+func TestMergeExtraGenerationParams(t *testing.T) {
+	response, err := entities.JSONToTextToImageResponse([]byte(testResponse))
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	params := response.Info.ExtraGenerationParams
+	if params == nil {
+		t.Fatal("Expected extra generation params")
+	}
+	if params.ScheduleType != "Karras" || params.HiresUpscale != 2 || params.HiresSteps != 15 || !params.DowncastAlphasCumprod {
+		t.Errorf("Unexpected typed params %+v", params)
+	}
+	if params.Extra["NGMS"] != 0.2 {
+		t.Errorf("Expected NGMS to be kept in Extra, got %v", params.Extra)
+	}
+	if params.ADetailer["ADetailer model"] != "face_yolov8n.pt" {
+		t.Errorf("Expected ADetailer model in ADetailer, got %v", params.ADetailer)
+	}
+
+	var request entities.TextToImageRequest
+	if err := MergeExtraGenerationParams(&request, params); err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if request.Scheduler == nil || *request.Scheduler != "Karras" {
+		t.Errorf("Expected schedule type Karras, got %v", request.Scheduler)
+	}
+	if !request.EnableHr || request.HrScale != 2 || request.HrSecondPassSteps != 15 || request.HrUpscaler != "Latent" {
+		t.Errorf("Unexpected hires fix %+v", request)
+	}
+	if !request.OverrideSettings.DowncastAlphasCumprodToFP16 {
+		t.Error("Expected downcast alphas_cumprod")
+	}
+	if request.LoraHashes["1d5a77d6b141"] != "fluffy" {
+		t.Errorf("Unexpected lora hashes %v", request.LoraHashes)
+	}
+	if request.ADetailer == nil || len(request.ADetailer.Args) != 1 || request.ADetailer.Args[0].AdDenoisingStrength != 0.4 {
+		t.Errorf("Unexpected ADetailer %+v", request.ADetailer)
+	}
+
+	b, err := json.Marshal(params)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	var roundTrip map[string]any
+	if err := json.Unmarshal(b, &roundTrip); err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if len(roundTrip) != 9 {
+		t.Errorf("Expected 9 keys after marshalling, got %v", roundTrip)
+	}
+}
+
+func TestProvenance(t *testing.T) {
+	const parameters = "a cat\nNegative prompt: blurry\nSteps: 20, Sampler: Euler a, CFG scale: 7, Seed: 1234, Size: 512x768"
+	request, provenance, err := ParameterHeuristicsProvenance(parameters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed, ok := provenance["seed"]
+	if !ok || seed.Source != entities.SourceInfotext || seed.Key != "Seed" || seed.Confidence != ConfidenceInfotext {
+		t.Fatalf("Unexpected seed evidence %+v", seed)
+	}
+	if parameters[seed.Start:seed.End] != "Seed: 1234" {
+		t.Errorf("Unexpected seed span %q", parameters[seed.Start:seed.End])
+	}
+	if width := provenance["width"]; width.Key != "Size" || width.Text != "Size: 512x768" {
+		t.Errorf("Unexpected width evidence %+v", width)
+	}
+	if prompt := provenance["prompt"]; prompt.Start != 0 || prompt.Text != request.Prompt {
+		t.Errorf("Unexpected prompt evidence %+v", prompt)
+	}
+	if emphasis, ok := provenance["override_settings.emphasis"]; ok && emphasis.Source != entities.SourceDefault {
+		t.Errorf("Expected a missing key to be a default, got %+v", emphasis)
+	}
+
+	const description = "A cat in the snow.\nI used 30 steps and the seed was 99"
+	_, provenance, err = DescriptionHeuristicsProvenance(description)
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps, ok := provenance["steps"]
+	if !ok || steps.Source != entities.SourceRegex || steps.Key != "stepsAlt" || steps.Confidence >= ConfidenceInfotext {
+		t.Fatalf("Unexpected steps evidence %+v", steps)
+	}
+	if description[steps.Start:steps.End] != "30" {
+		t.Errorf("Unexpected steps span %q", description[steps.Start:steps.End])
+	}
+
+	result, err := Parse([]byte(`{"sui_image_params": {"prompt": "a cat", "steps": 20}}`), Hints{Filename: "image.png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evidence := result.Provenance["image.png"]["steps"]; evidence.Source != entities.SourceJSON || evidence.Key != "$.sui_image_params.steps" {
+		t.Errorf("Unexpected JSON evidence %+v", evidence)
+	}
+}
+
+func TestParseBBCode(t *testing.T) {
+	const description = "[b]Positive prompt[/b] [q]a [dog:cat:0.5], [url=https://example.com]link[/url][/q]\nstray [/b] tag\n" +
+		"[q][b]Negative prompt:[/b]\nblurry, lowres\n[/q]"
+	tree := ParseBBCode(description)
+
+	quotes := tree.Find("q")
+	if len(quotes) != 2 {
+		t.Fatalf("Expected 2 quotes, got %d", len(quotes))
+	}
+	if urls := tree.Find("url"); len(urls) != 1 || urls[0].Value != "https://example.com" {
+		t.Errorf("Unexpected url nodes %+v", urls)
+	}
+	if got := description[quotes[0].Start:quotes[0].End]; !strings.HasPrefix(got, "[q]") || !strings.HasSuffix(got, "[/q]") {
+		t.Errorf("Unexpected quote span %q", got)
+	}
+	if plain := tree.PlainText(); !strings.Contains(plain, "[dog:cat:0.5]") || !strings.Contains(plain, "stray [/b] tag") {
+		t.Errorf("Expected prompt brackets and stray tags to stay text, got %q", plain)
+	}
+
+	if prompt, ok := tree.Section(positiveHeader); !ok || prompt != "a [dog:cat:0.5], link" {
+		t.Errorf("Unexpected positive section %q", prompt)
+	}
+	if negative, ok := tree.Section(negativeHeader); !ok || negative != "blurry, lowres" {
+		t.Errorf("Unexpected negative section %q", negative)
+	}
+
+	request, err := DescriptionHeuristics(description)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.Prompt != "a [dog:cat:0.5], link" || request.NegativePrompt != "blurry, lowres" {
+		t.Errorf("Unexpected prompts %q / %q", request.Prompt, request.NegativePrompt)
+	}
+
+	inline := ParseBBCode("[b]Prompt:[/b] a cat in the snow Negative prompt: blurry\nSteps: 20, Seed: 1")
+	if prompt, ok := inline.Section(positiveHeader); !ok || prompt != "a cat in the snow" {
+		t.Errorf("Expected the section to stop at the next parameter key, got %q", prompt)
+	}
+
+	const undelimited = "Positive prompt: a cat in the snow\n[b]Negative prompt[/b] none this time"
+	request, err = DescriptionHeuristics(undelimited)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if regex := ExtractNegativePrompt(CleanText(undelimited)); regex == "" || request.NegativePrompt != regex {
+		t.Errorf("Expected a section without a block not to replace the regex prompt %q, got %q", regex, request.NegativePrompt)
+	}
+}
+
+func TestPageHeuristics(t *testing.T) {
+	const description = "A short comic about a cat.\n" +
+		"Sampler: Euler a, Steps: 30, CFG scale: 7\n\n" +
+		"[b]Image 1:[/b]\nprompt: a cat sleeping\nseed: 11\n\n" +
+		"Page 2 - prompt: a cat waking up\nsteps: 40, seed: 22\n\n" +
+		"#3\nprompt: a cat eating\nseed: 33"
+
+	header, pages := SplitPages(description)
+	if len(pages) != 3 {
+		t.Fatalf("Expected 3 pages, got %d: %+v", len(pages), pages)
+	}
+	if !strings.HasPrefix(header, "A short comic") || pages[1].Number != 2 || !strings.HasPrefix(pages[1].Text, "prompt: a cat waking up") {
+		t.Errorf("Unexpected split %q %+v", header, pages)
+	}
+
+	files := []api.File{
+		{FileName: "page3.png", MimeType: "image/png", SubmissionFileOrder: 2},
+		{FileName: "page1.png", MimeType: "image/png", SubmissionFileOrder: 0},
+		{FileName: "parameters.txt", MimeType: "text/plain", SubmissionFileOrder: 3},
+		{FileName: "page2.png", MimeType: "image/png", SubmissionFileOrder: 1},
+	}
+	requests, err := PageHeuristics(description, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != len(files) || requests[2] != nil {
+		t.Fatalf("Expected a request for each image, got %+v", requests)
+	}
+	for i, expected := range []struct {
+		seed  int64
+		steps int
+	}{{33, 30}, {11, 30}, {}, {22, 40}} {
+		if requests[i] == nil {
+			continue
+		}
+		if requests[i].Seed != expected.seed || requests[i].Steps != expected.steps || requests[i].SamplerName != "Euler a" {
+			t.Errorf("Unexpected request for %s: seed %d, steps %d, sampler %q", files[i].FileName, requests[i].Seed, requests[i].Steps, requests[i].SamplerName)
+		}
+	}
+
+	shared, err := PageHeuristics("Prompt: a cat\nSteps: 30, Model: furry\n\n#1\nprompt: a cat sleeping\nseed: 11\n\n#2\nprompt: a cat waking up\nseed: 22", []api.File{
+		{FileName: "page1.png", MimeType: "image/png", SubmissionFileOrder: 0},
+		{FileName: "page2.png", MimeType: "image/png", SubmissionFileOrder: 1},
+		{FileName: "cover.png", MimeType: "image/png", SubmissionFileOrder: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, request := range shared {
+		if request == nil || request.OverrideSettings.SDModelCheckpoint == nil {
+			t.Fatalf("Expected every page to inherit the model, got %+v", shared)
+		}
+	}
+	*shared[0].OverrideSettings.SDModelCheckpoint = "changed"
+	if *shared[1].OverrideSettings.SDModelCheckpoint != "furry" || *shared[2].OverrideSettings.SDModelCheckpoint != "furry" {
+		t.Errorf("Expected changing one page to leave the others, got %q and %q", *shared[1].OverrideSettings.SDModelCheckpoint, *shared[2].OverrideSettings.SDModelCheckpoint)
+	}
+
+	const text = "image_001.png\na cat\nSteps: 20, Seed: 1\nimage_002.png\na dog\nSteps: 20, Seed: 2"
+	requests, err = PageHeuristics(text, []api.File{
+		{FileName: "image_002.png", MimeType: "image/png", SubmissionFileOrder: 0},
+		{FileName: "image_001.png", MimeType: "image/png", SubmissionFileOrder: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests[0] == nil || requests[0].Seed != 2 || requests[1] == nil || requests[1].Seed != 1 {
+		t.Errorf("Expected the pages to be matched by filename, got %+v", requests)
+	}
+
+	requests, err = PageHeuristics("Prompt: a cat\n\n#1\nseed: 11\n\n#2\nparameters\na dog", []api.File{
+		{FileName: "page1.png", MimeType: "image/png", SubmissionFileOrder: 0},
+		{FileName: "page2.png", MimeType: "image/png", SubmissionFileOrder: 1},
+	})
+	if err == nil {
+		t.Error("Expected the error of the broken page")
+	}
+	if len(requests) != 2 || requests[0] == nil || requests[0].Seed != 11 || requests[1] != nil {
+		t.Errorf("Expected the first page to parse and the broken one to be nil, got %+v", requests)
+	}
+}
+
+func TestLocales(t *testing.T) {
+	for _, test := range []struct {
+		description string
+		prompt      string
+		negative    string
+		steps       int
+		seed        int64
+	}{
+		{"プロンプト：1girl, smile\nネガティブプロンプト：lowres\nステップ：28\nシード：1234", "1girl, smile", "lowres", 28, 1234},
+		{"正向提示词：1girl, smile\n反向提示词：lowres\n步数：28\n随机种子：1234", "1girl, smile", "lowres", 28, 1234},
+		{"Prompt: 1girl, smile\nPrompt negativo: lowres\nPasos: 28\nSemilla: 1234", "1girl, smile", "lowres", 28, 1234},
+		{"Positiver Prompt: 1girl, smile\nNegativer Prompt: lowres\nSchritte: 28\nStartwert: 1234", "1girl, smile", "lowres", 28, 1234},
+	} {
+		request, err := DescriptionHeuristics(test.description)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if request.Prompt != test.prompt || request.NegativePrompt != test.negative || request.Steps != test.steps || request.Seed != test.seed {
+			t.Errorf("Unexpected request for %q: %q / %q, steps %d, seed %d", test.description, request.Prompt, request.NegativePrompt, request.Steps, request.Seed)
+		}
+	}
+
+	if got := Locales.Normalize("repasos: the pasos are done"); got != "repasos: the pasos are done" {
+		t.Errorf("Expected aliases inside words to be kept, got %q", got)
+	}
+	const prompt = "Prompt: a girl counting pasos: one, two, a field of semilla\nPasos: 28, Semilla: 1234"
+	if got := Locales.Normalize(prompt); got != "Prompt: a girl counting pasos: one, two, a field of semilla\nsteps: 28, seed: 1234" {
+		t.Errorf("Expected only the keys to be normalized, got %q", got)
+	}
+
+	var registry LocaleRegistry
+	if err := registry.Load(strings.NewReader(`[{"language": "fr", "keys": {"steps": ["étapes"], "negative prompt": ["prompt négatif"]}}]`)); err != nil {
+		t.Fatal(err)
+	}
+	if got := registry.Normalize("Prompt négatif : flou\nÉtapes: 30"); got != "negative prompt: flou\nsteps: 30" {
+		t.Errorf("Unexpected normalized text %q", got)
+	}
+	if err := registry.Add(LocalePack{Language: "it", Keys: map[string][]string{"passi": {"passi"}}}); err == nil {
+		t.Error("Expected an error for an unknown key")
+	}
+}
+
+func TestRepairJSON(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		input    string
+		expected string
+		repairs  []RepairKind
+	}{
+		{"valid", `{"a": [1, 2]}`, `{"a": [1, 2]}`, nil},
+		{"markdown", "Sure!\n```json\n{\"a\": 1}\n```", `{"a":1}`, []RepairKind{RepairSurroundingText, RepairSurroundingText}},
+		{"comments and trailing commas", "{\"a\": 1, // one\n\"b\": [1, 2,], /* two */}", `{"a":1,"b":[1,2]}`, []RepairKind{RepairComment, RepairTrailingComma, RepairComment, RepairTrailingComma}},
+		{"python", `{'a': True, 'b': None, c: 'it's'}`, `{"a":true,"b":null,"c":"it's"}`, []RepairKind{RepairSingleQuotes, RepairLiteral, RepairSingleQuotes, RepairLiteral, RepairUnquotedKey, RepairSingleQuotes, RepairUnescapedQuote}},
+		{"escapes", "{\"prompt\": \"\\(extra\\), \"quoted\" text\nnext line\"}", `{"prompt":"\\(extra\\), \"quoted\" text\nnext line"}`, []RepairKind{RepairEscape, RepairEscape, RepairUnescapedQuote, RepairUnescapedQuote, RepairControlCharacter}},
+		{"nested braces in prompt", `{"prompt": "{cat}, [dog:0.5]", "steps": 20}`, `{"prompt": "{cat}, [dog:0.5]", "steps": 20}`, nil},
+		{"numbers", `{"a": +1, "b": .5, "c": 1., "d": 2024-05-21}`, `{"a":1,"b":0.5,"c":1,"d":"2024-05-21"}`, []RepairKind{RepairNumber, RepairNumber, RepairNumber, RepairUnquotedString}},
+		{"truncated", `{"a": {"b": [1, 2`, `{"a":{"b":[1,2]}}`, []RepairKind{RepairTruncated, RepairTruncated, RepairTruncated}},
+		{"truncated key", `{"a": "text", "b`, `{"a":"text"}`, []RepairKind{RepairTruncated, RepairTruncated}},
+		{"largest object", `{"a": 1} and then {"b": 2, "c": 3}`, `{"b":2,"c":3}`, []RepairKind{RepairSurroundingText}},
+		{"object not array", `[1, 2, 3, 4, 5, 6] and {"a": 1}`, `{"a":1}`, []RepairKind{RepairSurroundingText}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			repaired, repairs, err := RepairJSON([]byte(test.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(repaired) != test.expected {
+				t.Errorf("Expected %s, got %s", test.expected, repaired)
+			}
+			var kinds []RepairKind
+			for _, r := range repairs {
+				kinds = append(kinds, r.Kind)
+			}
+			if !slices.Equal(kinds, test.repairs) {
+				t.Errorf("Expected repairs %v, got %v", test.repairs, repairs)
+			}
+		})
+	}
+
+	if _, _, err := RepairJSON([]byte("no json here")); !errors.Is(err, ErrNoJSON) {
+		t.Errorf("Expected ErrNoJSON, got %v", err)
+	}
+	if _, _, err := RepairJSON([]byte("[1, 2]")); !errors.Is(err, ErrNoJSON) {
+		t.Errorf("Expected ErrNoJSON for an array, got %v", err)
+	}
+	if _, _, err := RepairJSON([]byte(`{"a": ` + strings.Repeat("[", 100000))); !errors.Is(err, ErrTooDeep) {
+		t.Errorf("Expected ErrTooDeep, got %v", err)
+	}
+
+	result, err := Parse([]byte(`{sui_image_params: {prompt: 'a cat', steps: 20,},}`), Hints{Filename: "image.png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Format != FormatSwarmUI || result.Requests["image.png"].Steps != 20 || len(result.Repairs) == 0 {
+		t.Errorf("Expected the repaired SwarmUI parameters, got %+v", result)
+	}
+}
+
+func TestExportDataset(t *testing.T) {
+	var samples []Sample
+	for i := range 20 {
+		samples = append(samples, Sample{
+			Name:        fmt.Sprintf("sample_%d", i),
+			Artist:      fmt.Sprintf("artist_%d", i%5),
+			Instruction: "Output JSON",
+			Input:       fmt.Sprintf("image %d of a cat in style %d", i, i%5),
+			Response:    fmt.Sprintf(`{"seed": %d}`, i),
+		})
+	}
+	samples = append(samples,
+		Sample{Name: "exact", Artist: "artist_0", Input: samples[0].Input, Response: "{}"},
+		Sample{Name: "near", Artist: "artist_1", Input: samples[1].Input + " cat", Response: "{}"},
+		Sample{Name: "empty", Input: "no response"},
+		Sample{Name: "long", Input: strings.Repeat("word ", 100), Response: "{}"},
+	)
+
+	dir := t.TempDir()
+	manifest, err := ExportDataset(dir, samples, ExportOptions{Format: ExportChat, Seed: "test", Duplicates: 0.9, MaxTokens: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Samples != 24 || manifest.Duplicates != 2 || manifest.Empty != 1 || manifest.Filtered != 1 {
+		t.Errorf("Unexpected counts %+v", manifest)
+	}
+
+	artists := make(map[string]string)
+	var total int
+	for _, file := range manifest.Files {
+		data, err := os.ReadFile(filepath.Join(dir, file.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != file.SHA256 {
+			t.Errorf("Checksum of %s doesn't match", file.Name)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			if line == "" {
+				continue
+			}
+			var chat struct {
+				Messages []struct{ Role, Content string } `json:"messages"`
+			}
+			if err := json.Unmarshal([]byte(line), &chat); err != nil || len(chat.Messages) != 3 {
+				t.Fatalf("Unexpected line %s: %v", line, err)
+			}
+			var seed struct{ Seed int }
+			json.Unmarshal([]byte(chat.Messages[2].Content), &seed)
+			artist := fmt.Sprintf("artist_%d", seed.Seed%5)
+			if split, ok := artists[artist]; ok && split != file.Split {
+				t.Errorf("Expected %s to be in a single split, found in %s and %s", artist, split, file.Split)
+			}
+			artists[artist] = file.Split
+			total++
+		}
+	}
+	if total != 20 {
+		t.Errorf("Expected 20 samples to be written, got %d", total)
+	}
+
+	again, err := ExportDataset(t.TempDir(), samples, ExportOptions{Format: ExportChat, Seed: "test", Duplicates: 0.9, MaxTokens: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(again.Files, manifest.Files) {
+		t.Errorf("Expected the export to be deterministic, got %+v and %+v", manifest.Files, again.Files)
+	}
+
+	if _, err := ExportDataset(t.TempDir(), samples, ExportOptions{Format: "csv"}); !errors.Is(err, ErrUnknownExportFormat) {
+		t.Errorf("Expected ErrUnknownExportFormat, got %v", err)
+	}
+
+	const description = "a cat\nSteps: 20, Seed: 1"
+	named := DatasetSamples(
+		NameContent{"first.txt": []byte(description), "second.txt": []byte(description)},
+		NameContent{"first.txt": []byte(`{"seed": 1}`), "second.txt": []byte(`{"seed": 1}`)},
+	)
+	manifest, err = ExportDataset(t.TempDir(), named, ExportOptions{Format: ExportChat})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Duplicates != 1 {
+		t.Errorf("Expected the same description under two file names to be a duplicate, got %+v", manifest)
+	}
+
+	byName := DatasetSamples(NameContent{"1_Alice_cat.txt": nil, "2_alice_dog.txt": nil, "notes.txt": nil}, nil)
+	if byName[0].Artist != "alice" || byName[1].Artist != "alice" || byName[2].Artist != "" || byName[2].artist() != "notes.txt" {
+		t.Errorf("Expected the username of the file names as the artist, got %+v", byName)
+	}
+}
+
+func TestSynthesizer(t *testing.T) {
+	model := "furryrock_V70"
+	request := entities.TextToImageRequest{
+		Prompt:            "golden retriever, in a classroom, indoors, background blur, <lora:fluffy:0.8>",
+		NegativePrompt:    "deformityv6, bwu, dfc",
+		Steps:             50,
+		SamplerName:       "Euler a",
+		CFGScale:          12,
+		Seed:              581623237,
+		Width:             768,
+		Height:            1024,
+		OverrideSettings:  entities.Config{SDModelCheckpoint: &model},
+		DenoisingStrength: 0.45,
+	}
+
+	if a, b := NewSynthesizer(1).Render(request), NewSynthesizer(1).Render(request); a.Text != b.Text {
+		t.Errorf("Expected the same seed to render the same text, got %q and %q", a.Text, b.Text)
+	}
+
+	parsers := map[SynthStyle]func(string) (map[string]entities.TextToImageRequest, error){
+		SynthInfotext: func(text string) (map[string]entities.TextToImageRequest, error) {
+			r, err := ParameterHeuristics(text)
+			return map[string]entities.TextToImageRequest{"": r}, err
+		},
+		SynthAutoSnep: func(text string) (map[string]entities.TextToImageRequest, error) {
+			params, err := AutoSnep(WithString(text))
+			return ParseParams(params), err
+		},
+		SynthCirn0: func(text string) (map[string]entities.TextToImageRequest, error) {
+			params, err := Cirn0(WithString(text))
+			return ParseParams(params), err
+		},
+		SynthSoph: func(text string) (map[string]entities.TextToImageRequest, error) {
+			return Soph(WithString(text))
+		},
+	}
+	for style, parse := range parsers {
+		synthesizer := NewSynthesizer(2)
+		synthesizer.Styles = []SynthStyle{style}
+		synthesizer.Omit = 0
+		synthetic := synthesizer.Render(request)
+
+		parsed, err := parse(synthetic.Text)
+		if err != nil || len(parsed) != 1 {
+			t.Fatalf("%s: expected a request, got %v: %v\n%s", style, parsed, err, synthetic.Text)
+		}
+		for _, got := range parsed {
+			want := synthetic.Request
+			if got.Prompt != want.Prompt || got.NegativePrompt != want.NegativePrompt || got.Steps != want.Steps ||
+				got.Seed != want.Seed || got.CFGScale != want.CFGScale || got.SamplerName != want.SamplerName {
+				t.Errorf("%s: expected %q %q %d %d %g %q, got %q %q %d %d %g %q\n%s", style,
+					want.Prompt, want.NegativePrompt, want.Steps, want.Seed, want.CFGScale, want.SamplerName,
+					got.Prompt, got.NegativePrompt, got.Steps, got.Seed, got.CFGScale, got.SamplerName, synthetic.Text)
+			}
+		}
+	}
+
+	synthesizer := NewSynthesizer(3)
+	synthesizer.Omit = 0.5
+	samples, err := synthesizer.Samples(map[string]entities.TextToImageRequest{"a": request, "b": request}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 20 {
+		t.Fatalf("Expected 20 samples, got %d", len(samples))
+	}
+	var omitted bool
+	for _, s := range samples {
+		label, err := entities.UnmarshalTextToImageRequest([]byte(s.Response))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if label.Prompt != request.Prompt || s.Artist != s.Name[:1] {
+			t.Errorf("Unexpected sample %+v", s)
+		}
+		if label.Steps == 0 {
+			omitted = true
+		} else if !strings.Contains(s.Input, "50") {
+			t.Errorf("Expected the steps in the input of %s:\n%s", s.Name, s.Input)
+		}
+	}
+	if !omitted {
+		t.Error("Expected some samples to omit the steps")
+	}
+}
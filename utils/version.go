@@ -0,0 +1,146 @@
+package utils
+
+import (
+	"cmp"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// WebUI is the frontend that wrote an infotext, as far as we can tell from the Version and App keys.
+type WebUI string
+
+const (
+	WebUIUnknown WebUI = ""
+	WebUIA1111   WebUI = "AUTOMATIC1111"
+	WebUIForge   WebUI = "Forge"
+	WebUISDNext  WebUI = "SD.Next"
+)
+
+// Semver is a loose semantic version as written by the webui in the infotext.
+// Pre is the pre-release tag such as "rc", and Post is the number of commits after the tag,
+// e.g. v1.7.0-225-g... is {1, 7, 0, "", 225}.
+type Semver struct {
+	Major int
+	Minor int
+	Patch int
+	Pre   string
+	Post  int
+}
+
+// Compare returns -1, 0 or +1 following the ordering of packaging.version in python.
+// A pre-release sorts before its release, and a post-release sorts after it.
+func (v Semver) Compare(o Semver) int {
+	if c := cmp.Compare(v.Major, o.Major); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(v.Minor, o.Minor); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(v.Patch, o.Patch); c != 0 {
+		return c
+	}
+	switch {
+	case v.Pre == "" && o.Pre != "":
+		return 1
+	case v.Pre != "" && o.Pre == "":
+		return -1
+	}
+	if c := strings.Compare(v.Pre, o.Pre); c != 0 {
+		return c
+	}
+	return cmp.Compare(v.Post, o.Post)
+}
+
+func (v Semver) String() string {
+	s := "v" + strconv.Itoa(v.Major) + "." + strconv.Itoa(v.Minor) + "." + strconv.Itoa(v.Patch)
+	if v.Pre != "" {
+		s += "-" + v.Pre
+	}
+	if v.Post != 0 {
+		s += "-" + strconv.Itoa(v.Post)
+	}
+	return s
+}
+
+// InfotextVersion is the parsed Version key of an infotext.
+// Base is the AUTOMATIC1111 version the UI is built on, which is what the version gates compare against.
+// For Forge, Forge holds its own version, e.g. f0.0.17v1.8.0rc is Forge 0.0.17 based on 1.8.0rc.
+// SD.Next only writes a commit hash or date, so Base stays empty and Known is false.
+type InfotextVersion struct {
+	WebUI WebUI
+	Raw   string
+	Base  Semver
+	Forge Semver
+	Known bool
+}
+
+var (
+	a1111Version  = regexp.MustCompile(`^v?(\d+)\.(\d+)(?:\.(\d+))?(?:-?((?i:rc)\d*))?(?:-(\d+))?`)
+	forgeVersion  = regexp.MustCompile(`^f(\d+)\.(\d+)\.(\d+)(v.*)?`)
+	sdNextVersion = regexp.MustCompile(`^(?:[0-9a-f]{7,40}|\d{4}-\d{2}-\d{2})\b`)
+)
+
+// Version gates from modules/infotext_versions.py and the releases that changed infotext semantics.
+var (
+	v160          = Semver{Major: 1, Minor: 6}
+	v170TerminalS = Semver{Major: 1, Minor: 7, Post: 225}
+	v180          = Semver{Major: 1, Minor: 8}
+	v190          = Semver{Major: 1, Minor: 9}
+)
+
+// ParseInfotextVersion parses the Version key and optionally the App key of an infotext.
+// It recognizes AUTOMATIC1111 (v1.7.0-225-g...), Forge (f0.0.17v1.8.0rc-latest-276-g...) and SD.Next (commit hash or date).
+func ParseInfotextVersion(version, app string) InfotextVersion {
+	version = strings.Trim(strings.TrimSpace(version), `"`)
+	v := InfotextVersion{Raw: version}
+
+	if strings.EqualFold(strings.TrimSpace(app), "SD.Next") {
+		v.WebUI = WebUISDNext
+		return v
+	}
+
+	if match := forgeVersion.FindStringSubmatch(version); match != nil {
+		v.WebUI = WebUIForge
+		v.Forge = Semver{Major: atoi(match[1]), Minor: atoi(match[2]), Patch: atoi(match[3])}
+		v.Base, v.Known = parseSemver(match[4])
+		return v
+	}
+
+	if base, ok := parseSemver(version); ok {
+		v.WebUI = WebUIA1111
+		v.Base, v.Known = base, true
+		return v
+	}
+
+	if sdNextVersion.MatchString(version) {
+		v.WebUI = WebUISDNext
+	}
+
+	return v
+}
+
+// Before reports whether the version is known and its base is older than o.
+// Unknown versions are never considered old, the same way backcompat in the webui skips them.
+func (v InfotextVersion) Before(o Semver) bool {
+	return v.Known && v.Base.Compare(o) < 0
+}
+
+func parseSemver(s string) (Semver, bool) {
+	match := a1111Version.FindStringSubmatch(s)
+	if match == nil {
+		return Semver{}, false
+	}
+	return Semver{
+		Major: atoi(match[1]),
+		Minor: atoi(match[2]),
+		Patch: atoi(match[3]),
+		Pre:   strings.ToLower(match[4]),
+		Post:  atoi(match[5]),
+	}, true
+}
+
+func atoi(s string) int {
+	i, _ := strconv.Atoi(s)
+	return i
+}